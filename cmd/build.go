@@ -17,6 +17,7 @@
 package cmd
 
 import (
+	"bytes"
 	"os"
 
 	log "github.com/sirupsen/logrus"
@@ -79,11 +80,28 @@ func runBuild(args []string, wd string) {
 		AgentPort:                agentPort.String(),
 		Center:                   center,
 		Singleton:                singleton,
+		PushInterval:             pushInterval.String(),
+		CoverDir:                 coverDir,
+		CoverDirInterval:         coverDirInterval.String(),
+		CountersDir:              countersDir,
+		AgentDisabled:            agentDisabled,
+		StartPaused:              startPaused,
+		Tunnel:                   tunnel,
+		Labels:                   labels,
+		AgentToken:               buildAgentToken(),
+		AgentReadToken:           agentReadToken,
+		TLSCert:                  readPEM(agentTLSCert),
+		TLSKey:                   readPEM(agentTLSKey),
+		TLSClientCA:              readPEM(agentClientCA),
+		CenterCA:                 readPEM(centerCA),
 		IsMod:                    gocBuild.IsMod,
 		ModRootPath:              gocBuild.ModRootPath,
 		OneMainPackage:           true, // it is a go build
 		GlobalCoverVarImportPath: gocBuild.GlobalCoverVarImportPath,
 	}
+	if uploadSource {
+		uploadSources(gocBuild.Pkgs)
+	}
 	err = cover.Execute(ci)
 	if err != nil {
 		log.Fatalf("Fail to build: %v", err)
@@ -95,3 +113,18 @@ func runBuild(args []string, wd string) {
 	}
 	return
 }
+
+// uploadSources uploads the sources of the packages to the center for the html report,
+// the build goes on if it fails
+func uploadSources(pkgs map[string]*cover.Package) {
+	var buf bytes.Buffer
+	if err := cover.ArchiveSources(&buf, pkgs); err != nil {
+		log.Warnf("failed to archive the sources, err: %v", err)
+		return
+	}
+	if _, err := newWorker(center).UploadSource(&buf); err != nil {
+		log.Warnf("failed to upload the sources to %s, err: %v", center, err)
+		return
+	}
+	log.Infof("sources uploaded to %s", center)
+}
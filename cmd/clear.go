@@ -29,20 +29,25 @@ import (
 var clearCmd = &cobra.Command{
 	Use:   "clear",
 	Short: "Clear code coverage counters of all the registered services",
-	Long:  `Clear code coverage counters for the services under test at runtime.`,
+	Long:  `Clear code coverage counters for the services under test at runtime, and the last profiles retained of the services selected which deregistered or died.`,
 	Example: `
 # Clear coverage counter from default register center http://127.0.0.1:7777.
 goc clear
 
 # Clear coverage counter from specified register center.
 goc clear --center=http://192.168.1.1:8080
+
+# Clear coverage counter of the services labeled env=staging.
+goc clear --selector=env=staging
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		p := cover.ProfileParam{
-			Service: svrList,
-			Address: addrList,
+			Service:         svrList,
+			Address:         addrList,
+			ServicePatterns: servicePatterns,
+			Selector:        selector,
 		}
-		res, err := cover.NewWorker(center).Clear(p)
+		res, err := newWorker(center).Clear(p)
 		if err != nil {
 			log.Fatalf("call host %v failed, err: %v, response: %v", center, err, string(res))
 		}
@@ -54,5 +59,6 @@ func init() {
 	addBasicFlags(clearCmd.Flags())
 	clearCmd.Flags().StringSliceVarP(&svrList, "service", "", nil, "service name to clear profile, see 'goc list' for all services.")
 	clearCmd.Flags().StringSliceVarP(&addrList, "address", "", nil, "address to clear profile, see 'goc list' for all addresses.")
+	addSelectorFlags(clearCmd.Flags())
 	rootCmd.AddCommand(clearCmd)
 }
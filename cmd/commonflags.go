@@ -19,7 +19,9 @@ package cmd
 import (
 	"fmt"
 	"net"
+	"time"
 
+	"github.com/qiniu/goc/pkg/cover"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -32,6 +34,15 @@ var (
 	debugInCISyncFile string
 	buildFlags        string
 	singleton         bool
+	pushInterval      time.Duration
+	coverDir          string
+	coverDirInterval  time.Duration
+	countersDir       string
+	agentDisabled     bool
+	startPaused       bool
+	tunnel            bool
+	labels            string
+	uploadSource      bool
 
 	goRunExecFlag  string
 	goRunArguments string
@@ -44,6 +55,8 @@ var coverMode = CoverMode{
 // addBasicFlags adds a
 func addBasicFlags(cmdset *pflag.FlagSet) {
 	cmdset.StringVar(&center, "center", "http://127.0.0.1:7777", "cover profile host center")
+	cmdset.StringVar(&token, "token", "", "token to contact goc center with, can be given by GOC_TOKEN env")
+	addClientTLSFlags(cmdset)
 	// bind to viper
 	viper.BindPFlags(cmdset)
 }
@@ -53,6 +66,21 @@ func addCommonFlags(cmdset *pflag.FlagSet) {
 	cmdset.Var(&coverMode, "mode", "coverage mode: set, count, atomic")
 	cmdset.Var(&agentPort, "agentport", "a fixed port such as :8100 for registered service communicate with goc server. if not provided, using a random one")
 	cmdset.BoolVar(&singleton, "singleton", false, "singleton mode, not register to goc center")
+	cmdset.DurationVar(&pushInterval, "push-interval", 0, "push mode, the service uploads its profile to goc center at this interval and on exit, for services goc center can not reach. can be overridden by GOC_PUSH_INTERVAL env")
+	cmdset.StringVar(&coverDir, "coverdir", "", "offline mode, the service writes its profile into the directory at --coverdir-interval, on exit and when main returns, one file per process for 'goc merge' to combine. can be overridden by GOC_COVERDIR env")
+	cmdset.DurationVar(&coverDirInterval, "coverdir-interval", time.Minute, "the interval to write the profile into --coverdir, 0 only writes it on exit. can be overridden by GOC_COVERDIR_INTERVAL env")
+	cmdset.StringVar(&countersDir, "counters-dir", "", "the service keeps its counters in a file memory-mapped in the directory, one per process, which survives the crashes and is read by 'goc counters'. can be overridden by GOC_COUNTERS_DIR env, empty keeps them in memory")
+	cmdset.BoolVar(&agentDisabled, "disable-agent", false, "the kill switch, the service starts with no listener and no registration, and its coverage is never sent. can be overridden by GOC_DISABLE_AGENT env, e.g. GOC_DISABLE_AGENT=false to turn it on")
+	cmdset.BoolVar(&startPaused, "start-paused", false, "the service starts with the counting paused, until resumed by 'goc resume', to exclude e.g. the warm-up traffic. can be overridden by GOC_START_PAUSED env")
+	cmdset.BoolVar(&tunnel, "tunnel", false, "tunnel mode, the service keeps an outbound connection to goc center, over which goc center reaches it. can be overridden by GOC_TUNNEL env")
+	cmdset.StringVar(&labels, "labels", "", "labels the service registers to goc center, e.g. env=staging,version=v1. can be extended or overridden by GOC_LABELS env")
+	cmdset.StringVar(&agentToken, "agent-token", "", "token the service registers to goc center with, and requires from the requests to it in singleton mode. can be overridden by GOC_AGENT_TOKEN env")
+	cmdset.StringVar(&agentReadToken, "agent-read-token", "", "token only allowed to get the coverage and the profile of the service. can be overridden by GOC_AGENT_READ_TOKEN env")
+	cmdset.StringVar(&agentTLSCert, "agent-tls-cert", "", "the certificate for the service to serve over https, built into the service. can be overridden by the file given by GOC_TLS_CERT env")
+	cmdset.StringVar(&agentTLSKey, "agent-tls-key", "", "the key of --agent-tls-cert, built into the service. can be overridden by the file given by GOC_TLS_KEY env")
+	cmdset.StringVar(&agentClientCA, "agent-client-ca", "", "the CA the clients of the service, e.g. goc center, are required to present a certificate signed by. can be overridden by the file given by GOC_TLS_CLIENT_CA env")
+	cmdset.StringVar(&centerCA, "center-ca", "", "the CA pinned by the service to contact goc center over https. can be overridden by the file given by GOC_CENTER_CA env")
+	cmdset.StringVar(&tokenSecret, "token-secret", "", "the secret of goc center to sign the agent token with if --agent-token is not given, can be given by GOC_TOKEN_SECRET env")
 	cmdset.StringVar(&buildFlags, "buildflags", "", "specify the build flags")
 	// bind to viper
 	viper.BindPFlags(cmdset)
@@ -60,6 +88,7 @@ func addCommonFlags(cmdset *pflag.FlagSet) {
 
 func addBuildFlags(cmdset *pflag.FlagSet) {
 	addCommonFlags(cmdset)
+	cmdset.BoolVar(&uploadSource, "upload-source", false, "upload the sources to goc center, which renders them in the html report")
 	// bind to viper
 	viper.BindPFlags(cmdset)
 }
@@ -72,6 +101,12 @@ func addRunFlags(cmdset *pflag.FlagSet) {
 	viper.BindPFlags(cmdset)
 }
 
+// newWorker creates a worker contacting the center with the token given by --token or GOC_TOKEN env,
+// and the TLS config given by --ca, --cert and --key
+func newWorker(host string) cover.Action {
+	return cover.NewWorker(host, cover.WithToken(centerToken()), cover.WithTLSConfig(clientTLSConfig()))
+}
+
 // CoverMode represents the covermode when doing cover for source code
 type CoverMode struct {
 	mode string
@@ -0,0 +1,119 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/qiniu/goc/pkg/cover"
+)
+
+var convertCmd = &cobra.Command{
+	Use:   "convert [files...]",
+	Short: "Convert coverage profiles into the formats read by other tools",
+	Long: `Convert merges the Go coverage profiles and writes the result in one of the formats:
+  text       the text format of go test -coverprofile
+  cobertura  Cobertura XML, read by Jenkins and GitLab
+  lcov       LCOV tracefile
+  sonar      SonarQube generic test coverage XML
+  json       structured JSON with the statements and blocks of every file
+`,
+	Example: `
+# Convert the profile into Cobertura XML for Jenkins.
+goc convert coverage.cov --format=cobertura --output=coverage.xml
+
+# Convert the profile into SonarQube generic coverage, with the paths relative to the repository root.
+goc convert coverage.cov --format=sonar --path-map=github.com/qiniu/goc=. --output=sonar.xml
+
+# Convert the profile got from the center into LCOV.
+goc profile | goc convert - --format=lcov
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runConvert(args, convertFormat, pathMappings, convertOutput)
+	},
+}
+
+var (
+	convertFormat string   // --format flag
+	convertOutput string   // --output flag
+	pathMappings  []string // --path-map flag
+)
+
+func init() {
+	convertCmd.Flags().StringVarP(&convertFormat, "format", "", cover.FormatCobertura, "the format to convert into, one of text, cobertura, lcov, sonar and json")
+	convertCmd.Flags().StringVarP(&convertOutput, "output", "o", "-", "output file, - for stdout")
+	addPathMapFlag(convertCmd.Flags())
+	rootCmd.AddCommand(convertCmd)
+}
+
+// addPathMapFlag adds the flag mapping the import paths to the paths in the repository
+func addPathMapFlag(cmdset *pflag.FlagSet) {
+	cmdset.StringSliceVarP(&pathMappings, "path-map", "", nil, "map the files under an import path to a path relative to the repository root, e.g. github.com/qiniu/goc=.")
+}
+
+func runConvert(args []string, format string, mappings []string, output string) {
+	if len(args) == 0 {
+		log.Fatalln("Expected at least one coverage file.")
+		return
+	}
+	pm, err := cover.ParsePathMappings(mappings)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	merger := cover.NewProfileMerger()
+	for _, path := range args {
+		var f io.ReadCloser = os.Stdin
+		if path != "-" {
+			if f, err = os.Open(path); err != nil {
+				log.Fatalf("failed to open %s: %v", path, err)
+				return
+			}
+		}
+		err = merger.Parse(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("failed to parse %s: %v", path, err)
+			return
+		}
+	}
+	profiles := merger.Profiles()
+	if len(profiles) == 0 {
+		log.Fatalln("no coverage data in the files")
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatalf("failed to create file %s, err: %v", output, err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := cover.Export(w, format, profiles, pm); err != nil {
+		log.Fatalf("failed to convert into %s, err: %v", format, err)
+	}
+}
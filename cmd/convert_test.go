@@ -0,0 +1,55 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertProfiles(t *testing.T) {
+	profileA := filepath.Join(baseDir, "../tests/samples/merge_profile_samples/a.voc")
+	profileB := filepath.Join(baseDir, "../tests/samples/merge_profile_samples/b.voc")
+	output := filepath.Join(baseDir, "../tests/samples/merge_profile_samples/coverage.info")
+	defer os.Remove(output)
+
+	fatal = false
+	runConvert([]string{profileA, profileB}, "lcov", []string{"qiniu.com/kodo=."}, output)
+
+	contents, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "SF:apiserver/server/main.go\n")
+	assert.Contains(t, string(contents), "DA:32,60\n")
+	assert.Equal(t, fatal, false)
+}
+
+func TestConvertWithWrongFormat(t *testing.T) {
+	profileA := filepath.Join(baseDir, "../tests/samples/merge_profile_samples/a.voc")
+
+	fatalStr = ""
+	fatal = false
+	defer func() { fatal = false }()
+
+	runConvert([]string{profileA}, "html", nil, "-")
+
+	assert.Equal(t, fatal, true)
+	assert.Contains(t, fatalStr, "unknown format")
+}
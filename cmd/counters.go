@@ -0,0 +1,93 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/qiniu/goc/pkg/cover"
+)
+
+var countersCmd = &cobra.Command{
+	Use:   "counters [files or directories...]",
+	Short: "Get the profile from the counters files of the services built with --counters-dir",
+	Long: `Counters reads the counters files the services built with --counters-dir keep their counters in,
+and writes the merged profile. The services do not need to be reachable, or even running, as the
+files survive the crashes of the services. The counters files in a directory are the files ending
+with .counters.
+`,
+	Example: `
+# Get the profile of the services built with --counters-dir=/data/goc, running or dead.
+goc counters /data/goc -o coverage.cov
+
+# Get the profile of a process.
+goc counters /data/goc/app_host_1234_1600000000000000000.counters
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runCounters(args, countersOutput)
+	},
+}
+
+var countersOutput string // --output flag
+
+func init() {
+	countersCmd.Flags().StringVarP(&countersOutput, "output", "o", "-", "output file, - for stdout")
+	rootCmd.AddCommand(countersCmd)
+}
+
+func runCounters(args []string, output string) {
+	if len(args) == 0 {
+		log.Fatalln("Expected at least one counters file.")
+		return
+	}
+	files, err := profileFiles(args, cover.CountersFileExt)
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	merger := cover.NewProfileMerger()
+	for _, path := range files {
+		profiles, err := cover.ReadCountersFile(path)
+		if err != nil {
+			log.Fatalf("failed to read %s: %v", path, err)
+			return
+		}
+		if err := merger.Add(profiles); err != nil {
+			log.Fatalf("failed to merge %s: %v", path, err)
+			return
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatalf("failed to create file %s, err: %v", output, err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := cover.Export(w, cover.FormatText, merger.Profiles(), nil); err != nil {
+		log.Fatalf("failed to write the profile, err: %v", err)
+	}
+}
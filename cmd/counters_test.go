@@ -0,0 +1,53 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountersWithoutFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-counters")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fatalStr = ""
+	fatal = false
+	runCounters([]string{}, "-")
+	assert.Equal(t, fatal, true)
+	assert.Equal(t, fatalStr, "Expected at least one counters file.")
+
+	// the profiles written with --coverdir are not counters files
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.cov"), []byte("mode: count\n"), 0644))
+	fatalStr = ""
+	fatal = false
+	runCounters([]string{dir}, "-")
+	assert.Equal(t, fatal, true)
+	assert.Contains(t, fatalStr, "no profiles in")
+
+	fatalStr = ""
+	fatal = false
+	runCounters([]string{filepath.Join(dir, "a.cov")}, "-")
+	assert.Equal(t, fatal, true)
+	assert.Contains(t, fatalStr, "not a counters file")
+	fatal = false
+}
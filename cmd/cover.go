@@ -45,14 +45,28 @@ goc cover --center=http://127.0.0.1:7777 --target=/path/to/target --mode=atomic
 func runCover(target string) {
 	buildFlags := viper.GetString("buildflags")
 	ci := &cover.CoverInfo{
-		Args:           buildFlags,
-		GoPath:         "",
-		Target:         target,
-		Mode:           coverMode.String(),
-		AgentPort:      agentPort.String(),
-		Center:         center,
-		Singleton:      singleton,
-		OneMainPackage: false,
+		Args:             buildFlags,
+		GoPath:           "",
+		Target:           target,
+		Mode:             coverMode.String(),
+		AgentPort:        agentPort.String(),
+		Center:           center,
+		Singleton:        singleton,
+		PushInterval:     pushInterval.String(),
+		CoverDir:         coverDir,
+		CoverDirInterval: coverDirInterval.String(),
+		CountersDir:      countersDir,
+		AgentDisabled:    agentDisabled,
+		StartPaused:      startPaused,
+		Tunnel:           tunnel,
+		Labels:           labels,
+		AgentToken:       buildAgentToken(),
+		AgentReadToken:   agentReadToken,
+		TLSCert:          readPEM(agentTLSCert),
+		TLSKey:           readPEM(agentTLSKey),
+		TLSClientCA:      readPEM(agentClientCA),
+		CenterCA:         readPEM(centerCA),
+		OneMainPackage:   false,
 	}
 	_ = cover.Execute(ci)
 }
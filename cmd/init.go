@@ -18,16 +18,14 @@ package cmd
 
 import (
 	log "github.com/sirupsen/logrus"
-
-	"github.com/qiniu/goc/pkg/cover"
 	"github.com/spf13/cobra"
 )
 
 var initCmd = &cobra.Command{
 	Use:   "init",
-	Short: "Clear the register information in order to start a new round of tests",
+	Short: "Clear the register information, the retained profiles and the sessions in order to start a new round of tests",
 	Run: func(cmd *cobra.Command, args []string) {
-		if res, err := cover.NewWorker(center).InitSystem(); err != nil {
+		if res, err := newWorker(center).InitSystem(); err != nil {
 			log.Fatalf("call host %v failed, err: %v, response: %v", center, err, string(res))
 		}
 	},
@@ -72,11 +72,28 @@ func runInstall(args []string, wd string) {
 		AgentPort:                agentPort.String(),
 		Center:                   center,
 		Singleton:                singleton,
+		PushInterval:             pushInterval.String(),
+		CoverDir:                 coverDir,
+		CoverDirInterval:         coverDirInterval.String(),
+		CountersDir:              countersDir,
+		AgentDisabled:            agentDisabled,
+		StartPaused:              startPaused,
+		Tunnel:                   tunnel,
+		Labels:                   labels,
+		AgentToken:               buildAgentToken(),
+		AgentReadToken:           agentReadToken,
+		TLSCert:                  readPEM(agentTLSCert),
+		TLSKey:                   readPEM(agentTLSKey),
+		TLSClientCA:              readPEM(agentClientCA),
+		CenterCA:                 readPEM(centerCA),
 		IsMod:                    gocBuild.IsMod,
 		ModRootPath:              gocBuild.ModRootPath,
 		OneMainPackage:           false,
 		GlobalCoverVarImportPath: gocBuild.GlobalCoverVarImportPath,
 	}
+	if uploadSource {
+		uploadSources(gocBuild.Pkgs)
+	}
 	err = cover.Execute(ci)
 	if err != nil {
 		log.Fatalf("Fail to install: %v", err)
@@ -17,9 +17,15 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/olekukonko/tablewriter"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/qiniu/goc/pkg/cover"
@@ -31,19 +37,80 @@ var listCmd = &cobra.Command{
 	Short: "Lists all the registered services",
 	Long:  "Lists all the registered services",
 	Example: `
+# List the registered services in json format, as {"service": ["address"]}.
 goc list [flags]
+
+# List the registered services with their health state and last heartbeat.
+goc list --detail
+
+# List the registered services with their health state in json format.
+goc list --detail --json
+
+# List the registered services labeled env=staging.
+goc list --selector=env=staging
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		res, err := cover.NewWorker(center).ListServices()
+		p := cover.ProfileParam{
+			ServicePatterns: servicePatterns,
+			Selector:        selector,
+		}
+		if !listDetail {
+			res, err := newWorker(center).ListServices(p)
+			if err != nil {
+				log.Fatalf("list failed, err: %v", err)
+			}
+			log.Infoln(string(res))
+			fmt.Fprint(os.Stdout, string(res))
+			return
+		}
+
+		res, err := newWorker(center).ListServiceStatus(p)
 		if err != nil {
 			log.Fatalf("list failed, err: %v", err)
 		}
 		log.Infoln(string(res))
-		fmt.Fprint(os.Stdout, string(res))
+		if listJSON {
+			fmt.Fprint(os.Stdout, string(res))
+			return
+		}
+
+		var statuses []cover.ServiceStatus
+		if err := json.Unmarshal(res, &statuses); err != nil {
+			log.Fatalf("unexpected response from %s, err: %v", center, err)
+		}
+		printServiceStatuses(os.Stdout, statuses)
 	},
 }
 
+var (
+	listDetail bool // --detail flag
+	listJSON   bool // --json flag
+)
+
+// printServiceStatuses renders the registered services as a table
+func printServiceStatuses(w io.Writer, statuses []cover.ServiceStatus) {
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Service", "Address", "Health", "Last Heartbeat", "Labels"})
+	table.SetAutoFormatHeaders(false)
+	for _, st := range statuses {
+		lastHeartbeat := "-"
+		if !st.LastHeartbeat.IsZero() {
+			lastHeartbeat = st.LastHeartbeat.Local().Format(time.RFC3339)
+		}
+		labels := make([]string, 0, len(st.Labels))
+		for k, v := range st.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		table.Append([]string{st.Name, st.Address, st.Health, lastHeartbeat, strings.Join(labels, ",")})
+	}
+	table.Render()
+}
+
 func init() {
+	listCmd.Flags().BoolVarP(&listDetail, "detail", "", false, "output the health state, the last heartbeat and the labels of the registered services as a table")
+	listCmd.Flags().BoolVarP(&listJSON, "json", "", false, "output the details of --detail in json format")
+	addSelectorFlags(listCmd.Flags())
 	addBasicFlags(listCmd.Flags())
 	rootCmd.AddCommand(listCmd)
 }
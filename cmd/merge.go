@@ -17,21 +17,30 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+
 	log "github.com/sirupsen/logrus"
 
+	"github.com/qiniu/goc/pkg/cover"
 	"github.com/spf13/cobra"
-	"golang.org/x/tools/cover"
-	"k8s.io/test-infra/gopherage/pkg/cov"
 	"k8s.io/test-infra/gopherage/pkg/util"
 )
 
 var mergeCmd = &cobra.Command{
-	Use:   "merge [files...]",
+	Use:   "merge [files or directories...]",
 	Short: "Merge multiple coherent Go coverage files into a single file.",
 	Long: `merge will merge multiple Go coverage files into a single coverage file.
 merge requires that the files are 'coherent', meaning that if they both contain references to the
 same paths, then the contents of those source files were identical for the binary that generated
 each file.
+The profiles in a directory are the files ending with .cov, e.g. the ones written by the services
+built with --coverdir.
+`,
+	Example: `
+# Merge the profiles written by the services built with --coverdir=/data/goc.
+goc merge /data/goc -o coverage.cov
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		runMerge(args, outputMergeProfile)
@@ -52,25 +61,52 @@ func runMerge(args []string, output string) {
 		return
 	}
 
-	profiles := make([][]*cover.Profile, len(args))
-	for _, path := range args {
-		profile, err := util.LoadProfile(path)
+	files, err := profileFiles(args, ".cov")
+	if err != nil {
+		log.Fatalln(err)
+		return
+	}
+
+	// the files are merged as they are read, so that only the merged profile is kept in memory
+	merger := cover.NewProfileMerger()
+	for _, path := range files {
+		f, err := os.Open(path)
 		if err != nil {
 			log.Fatalf("failed to open %s: %v", path, err)
 			return
 		}
-		profiles = append(profiles, profile)
+		err = merger.Parse(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("failed to merge files: %v", err)
+			return
+		}
 	}
 
-	merged, err := cov.MergeMultipleProfiles(profiles)
+	err = util.DumpProfile(output, merger.Profiles())
 	if err != nil {
-		log.Fatalf("failed to merge files: %v", err)
+		log.Fatalln(err)
 		return
 	}
+}
 
-	err = util.DumpProfile(output, merged)
-	if err != nil {
-		log.Fatalln(err)
-		return
+// profileFiles lists the files of the args, a directory is replaced by the files with the extension in it
+func profileFiles(args []string, ext string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil || !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no profiles in %s", arg)
+		}
+		files = append(files, matches...)
 	}
+	return files, nil
 }
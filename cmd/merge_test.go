@@ -154,3 +154,34 @@ func TestMergeEmptyProfile(t *testing.T) {
 	assert.Equal(t, fatal, true)
 	assert.Contains(t, fatalStr, "failed to dump profile")
 }
+
+// merge the profiles in a directory, as written by the services built with --coverdir
+func TestMergeProfilesInDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-coverdir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		contents, err := ioutil.ReadFile(filepath.Join(baseDir, "../tests/samples/merge_profile_samples/"+name+".voc"))
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".cov"), contents, 0644))
+	}
+	// the files being written are skipped
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "c.cov.tmp"), []byte("mode: count\n"), 0644))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "merged"), 0755))
+	mergeprofile := filepath.Join(dir, "merged", "merge.out")
+
+	// clear fatal string in setup
+	fatalStr = ""
+	fatal = false
+
+	runMerge([]string{dir}, mergeprofile)
+
+	contents, err := ioutil.ReadFile(mergeprofile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "qiniu.com/kodo/apiserver/server/main.go:32.49,33.13 1 60")
+	assert.Equal(t, fatal, false)
+
+	runMerge([]string{filepath.Join(dir, "merged")}, mergeprofile)
+	assert.Equal(t, fatal, true)
+	assert.Contains(t, fatalStr, "no profiles in")
+}
@@ -0,0 +1,95 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/qiniu/goc/pkg/cover"
+)
+
+var pauseCmd = &cobra.Command{
+	Use:   "pause",
+	Short: "Pause the counting of the registered services",
+	Long: `Pause excludes the code covered by the services under test from the coverage until 'goc resume',
+e.g. to exclude the warm-up traffic or a load test. The services keep reporting the coverage they had
+when paused.`,
+	Example: `
+# Pause the counting of all the services registered to the default center http://127.0.0.1:7777.
+goc pause
+
+# Pause the counting of the services labeled env=staging during a load test, and resume it after.
+goc pause --selector=env=staging
+goc resume --selector=env=staging
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := newWorker(center).Pause(controlParam())
+		if err != nil {
+			log.Fatalf("call host %v failed, err: %v, response: %v", center, err, string(res))
+		}
+		fmt.Fprint(os.Stdout, string(res))
+	},
+}
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume the counting of the registered services paused by 'goc pause'",
+	Long:  `Resume the counting of the services under test, the code covered while paused is not counted.`,
+	Example: `
+# Resume the counting of all the services registered to the default center http://127.0.0.1:7777.
+goc resume
+
+# Resume the counting of a service.
+goc resume --service=foo
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := newWorker(center).Resume(controlParam())
+		if err != nil {
+			log.Fatalf("call host %v failed, err: %v, response: %v", center, err, string(res))
+		}
+		fmt.Fprint(os.Stdout, string(res))
+	},
+}
+
+func init() {
+	addControlFlags(pauseCmd.Flags())
+	addControlFlags(resumeCmd.Flags())
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(resumeCmd)
+}
+
+// addControlFlags adds the flags selecting the services to pause or resume
+func addControlFlags(cmdset *pflag.FlagSet) {
+	addBasicFlags(cmdset)
+	cmdset.StringSliceVarP(&svrList, "service", "", nil, "service name to pause or resume, see 'goc list' for all services.")
+	cmdset.StringSliceVarP(&addrList, "address", "", nil, "address to pause or resume, see 'goc list' for all addresses.")
+	addSelectorFlags(cmdset)
+}
+
+func controlParam() cover.ProfileParam {
+	return cover.ProfileParam{
+		Service:         svrList,
+		Address:         addrList,
+		ServicePatterns: servicePatterns,
+		Selector:        selector,
+	}
+}
@@ -18,14 +18,19 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"strings"
+	"time"
 
+	"github.com/olekukonko/tablewriter"
 	"github.com/qiniu/goc/pkg/cover"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var profileCmd = &cobra.Command{
@@ -48,8 +53,26 @@ goc profile --address=address1,address2,address3
 # Only get the coverage data of files matching the special patterns
 goc profile --coverfile=pattern1,pattern2,pattern3
 
+# Only get the coverage data of the packages under github.com/qiniu/goc/pkg, the services only send the files selected.
+goc profile --package=github.com/qiniu/goc/pkg
+
 # Force fetching all available profiles.
 goc profile --force
+
+# Exclude the retained profiles of the services which have deregistered or died.
+goc profile --tombstones=false
+
+# Get coverage counter of the services labeled env=staging but not version=v1, whose names start with 'api-'.
+goc profile --selector=env=staging,version!=v1 --service-regex='^api-'
+
+# Get the coverage counter merged from several register centers, add --force to skip the centers failed.
+goc profile --center=http://staging:7777,http://perf:7777,http://canary:7777
+
+# Get the coverage counter in Cobertura XML, with the paths relative to the repository root. See 'goc convert' for all the formats.
+goc profile --format=cobertura --path-map=github.com/qiniu/goc=. --output=coverage.xml
+
+# Give up the services not answered in 10 seconds, get the profile of the others, and print which ones succeeded, timed out or failed.
+goc profile --agent-timeout=10s --force --report
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		p := cover.ProfileParam{
@@ -58,39 +81,113 @@ goc profile --force
 			Address:           addrList,
 			CoverFilePatterns: coverFilePatterns,
 			SkipFilePatterns:  skipFilePatterns,
+			Packages:          packages,
+			SkipTombstones:    !tombstones,
+			ServicePatterns:   servicePatterns,
+			Selector:          selector,
+			Report:            report,
+			Format:            profileFormat,
+			PathMappings:      pathMappings,
 		}
-		res, err := cover.NewWorker(center).Profile(p)
+		if collectTimeout > 0 {
+			p.Timeout = collectTimeout.String()
+		}
+		if collectAgentTimeout > 0 {
+			p.AgentTimeout = collectAgentTimeout.String()
+		}
+		res, err := getProfile(strings.Split(center, ","), p)
 		if err != nil {
 			log.Fatalf("Goc server %v return an error: %v", center, err)
 		}
 
-		if output == "" {
-			fmt.Fprint(os.Stdout, string(res))
-		} else {
-			var dir, filename string = path.Split(output)
-			if dir != "" {
-				err = os.MkdirAll(dir, os.ModePerm)
-				if err != nil {
-					log.Fatalf("failed to create directory %s, err:%v", dir, err)
-				}
-			}
-			if filename == "" {
-				output += "coverage.cov"
-			}
-
-			f, err := os.Create(output)
-			if err != nil {
-				log.Fatalf("failed to create file %s, err:%v", output, err)
-			}
-			defer f.Close()
-			_, err = io.Copy(f, bytes.NewReader(res))
-			if err != nil {
-				log.Fatalf("failed to write file: %v, err: %v", output, err)
-			}
-		}
+		writeOutput(output, res)
 	},
 }
 
+// writeOutput writes the profile to the file, or to stdout if no file is given
+func writeOutput(output string, res []byte) {
+	if output == "" {
+		fmt.Fprint(os.Stdout, string(res))
+		return
+	}
+	var dir, filename string = path.Split(output)
+	if dir != "" {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			log.Fatalf("failed to create directory %s, err:%v", dir, err)
+		}
+	}
+	if filename == "" {
+		output += "coverage.cov"
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		log.Fatalf("failed to create file %s, err:%v", output, err)
+	}
+	defer f.Close()
+	_, err = io.Copy(f, bytes.NewReader(res))
+	if err != nil {
+		log.Fatalf("failed to write file: %v, err: %v", output, err)
+	}
+}
+
+// getProfile gets the profile from the center, or merges the ones from all the centers
+func getProfile(centers []string, p cover.ProfileParam) ([]byte, error) {
+	if len(centers) == 1 {
+		res, err := newWorker(centers[0]).Profile(p)
+		if err != nil || !p.Report {
+			return res, err
+		}
+		var envelope cover.ProfileEnvelope
+		if err := json.Unmarshal(res, &envelope); err != nil {
+			return nil, fmt.Errorf("unexpected response, err: %v", err)
+		}
+		printProfileReport(os.Stderr, envelope.Report)
+		return []byte(envelope.Profile), nil
+	}
+	if p.Report {
+		log.Warnf("the report is not supported when merging the profiles from several centers")
+	}
+
+	merged, failures, err := cover.FederatedProfile(centers, p, cover.WithToken(centerToken()), cover.WithTLSConfig(clientTLSConfig()))
+	for _, f := range failures {
+		log.Warnf("get profile from center failed, %s", f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(merged) == 0 {
+		return nil, fmt.Errorf("no profiles")
+	}
+	mappings, err := cover.ParsePathMappings(p.PathMappings)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := cover.Export(&buf, p.Format, merged, mappings); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// printProfileReport renders the result of collecting from every address as a table
+func printProfileReport(w io.Writer, report cover.ProfileReport) {
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Service", "Address", "Status", "Duration", "Error"})
+	table.SetAutoFormatHeaders(false)
+	for _, a := range report.Addresses {
+		table.Append([]string{a.Service, a.Address, a.Status, a.Duration, a.Error})
+	}
+	for _, f := range report.FailedCenters {
+		table.Append([]string{"-", f.Center, cover.CollectFailed, "-", f.Error})
+	}
+	for _, addr := range report.SkippedTombstones {
+		table.Append([]string{"-", addr, cover.CollectSkipped, "-", "the retained profile mismatches the others"})
+	}
+	table.Render()
+}
+
 var (
 	svrList           []string // --service flag
 	addrList          []string // --address flag
@@ -98,8 +195,23 @@ var (
 	output            string   // --output flag
 	coverFilePatterns []string // --coverfile flag
 	skipFilePatterns  []string // --skipfile flag
+	packages          []string // --package flag
+	tombstones        bool     // --tombstones flag
+	selector          string   // --selector flag
+	servicePatterns   []string // --service-regex flag
+	report            bool     // --report flag
+	profileFormat     string   // --format flag
+	// the flags of the same names of goc server have their own defaults
+	collectTimeout      time.Duration // --timeout flag
+	collectAgentTimeout time.Duration // --agent-timeout flag
 )
 
+// addSelectorFlags adds the flags selecting the services by name patterns and labels
+func addSelectorFlags(cmdset *pflag.FlagSet) {
+	cmdset.StringVarP(&selector, "selector", "", "", "select the services by their labels, e.g. env=staging,version!=v1")
+	cmdset.StringSliceVarP(&servicePatterns, "service-regex", "", nil, "select the services whose names match the regular expressions")
+}
+
 func init() {
 	profileCmd.Flags().StringVarP(&output, "output", "o", "", "download cover profile")
 	profileCmd.Flags().StringSliceVarP(&svrList, "service", "", nil, "service name to fetch profile, see 'goc list' for all services.")
@@ -107,6 +219,14 @@ func init() {
 	profileCmd.Flags().BoolVarP(&force, "force", "f", false, "force fetching all available profiles")
 	profileCmd.Flags().StringSliceVarP(&coverFilePatterns, "coverfile", "", nil, "only output coverage data of the files matching the patterns")
 	profileCmd.Flags().StringSliceVarP(&skipFilePatterns, "skipfile", "", nil, "skip the files matching the patterns when outputing coverage data")
+	profileCmd.Flags().StringSliceVarP(&packages, "package", "", nil, "only output coverage data of the packages under the import paths")
+	profileCmd.Flags().BoolVarP(&tombstones, "tombstones", "", true, "include the retained profiles of the services which have deregistered or died")
+	profileCmd.Flags().DurationVarP(&collectTimeout, "timeout", "", 0, "give up the services not answered after this long, the center's --profile-timeout if 0")
+	profileCmd.Flags().DurationVarP(&collectAgentTimeout, "agent-timeout", "", 0, "give up a service not answered after this long, the center's --agent-timeout if 0")
+	profileCmd.Flags().BoolVarP(&report, "report", "", false, "print which services succeeded, timed out or failed to stderr")
+	profileCmd.Flags().StringVarP(&profileFormat, "format", "", cover.FormatText, "the format of the profile, one of text, cobertura, lcov, sonar and json")
+	addPathMapFlag(profileCmd.Flags())
+	addSelectorFlags(profileCmd.Flags())
 	addBasicFlags(profileCmd.Flags())
 	rootCmd.AddCommand(profileCmd)
 }
@@ -33,11 +33,16 @@ var registerCmd = &cobra.Command{
 goc register [flags] 
 `,
 	Run: func(cmd *cobra.Command, args []string) {
+		serviceLabels, err := cover.ParseLabels(labels)
+		if err != nil {
+			log.Fatalf("invalid labels, err: %v", err)
+		}
 		s := cover.ServiceUnderTest{
 			Name:    name,
 			Address: address,
+			Labels:  serviceLabels,
 		}
-		res, err := cover.NewWorker(center).RegisterService(s)
+		res, err := newWorker(center).RegisterService(s)
 		if err != nil {
 			log.Fatalf("register service failed, err: %v", err)
 		}
@@ -52,8 +57,11 @@ var (
 
 func init() {
 	registerCmd.Flags().StringVarP(&center, "center", "", "http://127.0.0.1:7777", "cover profile host center")
+	registerCmd.Flags().StringVarP(&token, "token", "", "", "token to contact goc center with, can be given by GOC_TOKEN env")
+	addClientTLSFlags(registerCmd.Flags())
 	registerCmd.Flags().StringVarP(&name, "name", "n", "", "service name")
 	registerCmd.Flags().StringVarP(&address, "address", "a", "", "service address")
+	registerCmd.Flags().StringVarP(&labels, "labels", "", "", "service labels, e.g. env=staging,version=v1")
 	registerCmd.MarkFlagRequired("name")
 	registerCmd.MarkFlagRequired("address")
 	rootCmd.AddCommand(registerCmd)
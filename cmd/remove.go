@@ -36,13 +36,18 @@ goc remove --service=mongo
 
 # Remove the service 'http://127.0.0.1:53' from the specified register center.
 goc remove --address="http://127.0.0.1:53" --center=http://192.168.1.1:8080
+
+# Remove the services whose names start with 'mongo' and are labeled version=v1.
+goc remove --service-regex='^mongo' --selector=version=v1
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		p := cover.ProfileParam{
-			Service: svrList,
-			Address: addrList,
+			Service:         svrList,
+			Address:         addrList,
+			ServicePatterns: servicePatterns,
+			Selector:        selector,
 		}
-		res, err := cover.NewWorker(center).Remove(p)
+		res, err := newWorker(center).Remove(p)
 		if err != nil {
 			log.Fatalf("call host %v failed, err: %v, response: %v", center, err, string(res))
 		}
@@ -54,5 +59,6 @@ func init() {
 	addBasicFlags(removeCmd.Flags())
 	removeCmd.Flags().StringSliceVarP(&svrList, "service", "", nil, "service name to clear profile, see 'goc list' for all services.")
 	removeCmd.Flags().StringSliceVarP(&addrList, "address", "", nil, "address to clear profile, see 'goc list' for all addresses.")
+	addSelectorFlags(removeCmd.Flags())
 	rootCmd.AddCommand(removeCmd)
 }
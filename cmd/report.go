@@ -0,0 +1,174 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/tools/cover"
+
+	gocover "github.com/qiniu/goc/pkg/cover"
+)
+
+var reportCmd = &cobra.Command{
+	Use:   "report [files...]",
+	Short: "Report the coverage of every package, or render the annotated source as html",
+	Long: `Report the coverage of the profile got from the center, or merged from the files if given.
+With --html, the source annotated with the coverage is rendered as a single html page. The center finds
+the sources in its --source-root, or the ones uploaded by 'goc build --upload-source'; for the files,
+the sources are found in --source-root.
+`,
+	Example: `
+# Print the coverage of every package of the services registered to the default center.
+goc report
+
+# Render the html report of service1 from the center.
+goc report --html --service=service1 --output=coverage.html
+
+# Render the html report of the profiles with the sources in the current module.
+goc report --html coverage.cov --source-root=.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p := gocover.ProfileParam{
+			Force:             force,
+			Service:           svrList,
+			Address:           addrList,
+			CoverFilePatterns: coverFilePatterns,
+			SkipFilePatterns:  skipFilePatterns,
+			Packages:          packages,
+			SkipTombstones:    !tombstones,
+			ServicePatterns:   servicePatterns,
+			Selector:          selector,
+		}
+		runReport(args, p, reportOutput)
+	},
+}
+
+var (
+	htmlReport   bool   // --html flag
+	reportOutput string // --output flag
+	// goc server has --source-root of another default
+	reportSourceRoot string // --source-root flag
+)
+
+func init() {
+	reportCmd.Flags().BoolVarP(&htmlReport, "html", "", false, "render the annotated source as html")
+	reportCmd.Flags().StringVarP(&reportOutput, "output", "o", "", "output file, stdout if empty, coverage.html if empty with --html")
+	reportCmd.Flags().StringVarP(&reportSourceRoot, "source-root", "", ".", "the module root, or the GOPATH src directory, to find the sources of the files")
+	reportCmd.Flags().StringSliceVarP(&svrList, "service", "", nil, "service name to report, see 'goc list' for all services.")
+	reportCmd.Flags().StringSliceVarP(&addrList, "address", "", nil, "address to report, see 'goc list' for all addresses.")
+	reportCmd.Flags().BoolVarP(&force, "force", "f", false, "force fetching all available profiles")
+	reportCmd.Flags().StringSliceVarP(&coverFilePatterns, "coverfile", "", nil, "only report the files matching the patterns")
+	reportCmd.Flags().StringSliceVarP(&skipFilePatterns, "skipfile", "", nil, "skip the files matching the patterns")
+	reportCmd.Flags().StringSliceVarP(&packages, "package", "", nil, "only report the packages under the import paths")
+	reportCmd.Flags().BoolVarP(&tombstones, "tombstones", "", true, "include the retained profiles of the services which have deregistered or died")
+	addSelectorFlags(reportCmd.Flags())
+	addBasicFlags(reportCmd.Flags())
+	rootCmd.AddCommand(reportCmd)
+}
+
+func runReport(args []string, p gocover.ProfileParam, output string) {
+	if htmlReport && output == "" {
+		output = "coverage.html"
+	}
+	var w io.Writer = os.Stdout
+	if output != "" {
+		if dir, _ := path.Split(output); dir != "" {
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				log.Fatalf("failed to create directory %s, err: %v", dir, err)
+			}
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatalf("failed to create file %s, err: %v", output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	// the center renders the html with the sources it has
+	if len(args) == 0 && htmlReport {
+		res, err := newWorker(center).HTML(p)
+		if err != nil {
+			log.Fatalf("Goc server %v return an error: %v", center, err)
+		}
+		if _, err := w.Write(res); err != nil {
+			log.Fatalf("failed to write file: %v, err: %v", output, err)
+		}
+		return
+	}
+
+	profiles, err := reportProfiles(args, p)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !htmlReport {
+		printPackageCoverage(w, profiles)
+		return
+	}
+	if err := gocover.RenderHTML(w, profiles, gocover.SourceLookup(reportSourceRoot, "")); err != nil {
+		log.Fatalf("failed to write the report, err: %v", err)
+	}
+	if output != "" {
+		log.Infof("report written to %s", output)
+	}
+}
+
+// reportProfiles merges the files, or gets the profile from the center if there is no file
+func reportProfiles(files []string, p gocover.ProfileParam) ([]*cover.Profile, error) {
+	if len(files) == 0 {
+		res, err := newWorker(center).Profile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Goc server %v return an error: %v", center, err)
+		}
+		return gocover.ParseProfile(bytes.NewReader(res))
+	}
+
+	merger := gocover.NewProfileMerger()
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", file, err)
+		}
+		err = merger.Parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge files: %v", err)
+		}
+	}
+	return merger.Profiles(), nil
+}
+
+// printPackageCoverage prints the coverage of every package as a table
+func printPackageCoverage(w io.Writer, profiles []*cover.Profile) {
+	list := gocover.PackageCovList(profiles)
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Package", "Statements", "Covered", "Coverage"})
+	table.SetAutoFormatHeaders(false)
+	for _, c := range list {
+		table.Append([]string{c.Name(), fmt.Sprint(c.NAllStmts), fmt.Sprint(c.NCoveredStmts), c.Percentage()})
+	}
+	table.SetFooter([]string{"total", "", "", list.TotalPercentage()})
+	table.Render()
+}
@@ -0,0 +1,55 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/qiniu/goc/pkg/cover"
+)
+
+func TestReportProfiles(t *testing.T) {
+	profileA := filepath.Join(baseDir, "../tests/samples/merge_profile_samples/a.voc")
+	profileB := filepath.Join(baseDir, "../tests/samples/merge_profile_samples/b.voc")
+	output := filepath.Join(baseDir, "../tests/samples/merge_profile_samples/report.txt")
+	defer os.Remove(output)
+
+	fatal = false
+	htmlReport = false
+	runReport([]string{profileA, profileB}, cover.ProfileParam{}, output)
+	contents, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "qiniu.com/kodo/apiserver/server")
+	assert.Contains(t, string(contents), "total")
+	assert.Equal(t, fatal, false)
+
+	output = filepath.Join(baseDir, "../tests/samples/merge_profile_samples/report.html")
+	defer os.Remove(output)
+	htmlReport = true
+	defer func() { htmlReport = false }()
+	runReport([]string{profileA, profileB}, cover.ProfileParam{}, output)
+	contents, err = ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "qiniu.com/kodo/apiserver/server/main.go")
+	assert.Contains(t, string(contents), "source not found")
+	assert.Equal(t, fatal, false)
+}
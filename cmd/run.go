@@ -71,12 +71,29 @@ goc run . [--buildflags] [--exec] [--arguments]
 			Mode:                     coverMode.String(),
 			Center:                   gocServer,
 			Singleton:                singleton,
+			PushInterval:             pushInterval.String(),
+			CoverDir:                 coverDir,
+			CoverDirInterval:         coverDirInterval.String(),
+			CountersDir:              countersDir,
+			AgentDisabled:            agentDisabled,
+			StartPaused:              startPaused,
+			Tunnel:                   tunnel,
+			Labels:                   labels,
+			AgentToken:               buildAgentToken(),
+			AgentReadToken:           agentReadToken,
+			TLSCert:                  readPEM(agentTLSCert),
+			TLSKey:                   readPEM(agentTLSKey),
+			TLSClientCA:              readPEM(agentClientCA),
+			CenterCA:                 readPEM(centerCA),
 			AgentPort:                "",
 			IsMod:                    gocBuild.IsMod,
 			ModRootPath:              gocBuild.ModRootPath,
 			OneMainPackage:           true, // go run is similar with go build, build only one main package
 			GlobalCoverVarImportPath: gocBuild.GlobalCoverVarImportPath,
 		}
+		if uploadSource {
+			uploadSources(gocBuild.Pkgs)
+		}
 		err = cover.Execute(ci)
 		if err != nil {
 			log.Fatalf("Fail to run: %v", err)
@@ -17,9 +17,11 @@
 package cmd
 
 import (
+	"log"
+	"time"
+
 	"github.com/qiniu/goc/pkg/cover"
 	"github.com/spf13/cobra"
-	"log"
 )
 
 var serverCmd = &cobra.Command{
@@ -35,20 +37,126 @@ goc server --port=:8080
 
 # Start a service registry center with localhost:8080.
 goc server --port=localhost:8080
+
+# Start a service registry center which removes the services silent for more than 1 minute and failing the probe.
+goc server --heartbeat-ttl=1m --evict-unhealthy
+
+# Start a service registry center which collects the profiles every 5 minutes, so that the coverage of services died in between is kept.
+goc server --snapshot-interval=5m
+
+# Start a service registry center keeping the services, their health and retained profiles in an embedded database,
+# the services saved in the file given by --local-persistence are migrated into it.
+goc server --store=bolt --bolt-db=goc.db
+
+# Start two service registry centers sharing the registered services, a service can register to either of them.
+goc server --port=:7777 --peers=http://center-b:7777
+goc server --port=:7777 --peers=http://center-a:7777
+
+# Start a service registry center which also merges the profiles from the centers of other environments.
+goc server --upstream=http://staging:7777,http://perf:7777
+
+# Start a service registry center which collects the profiles from at most 64 services at the same time,
+# giving up a service after 10 seconds and the whole collection after 1 minute.
+goc server --max-concurrency=64 --agent-timeout=10s --profile-timeout=1m
+
+# Start a service registry center rendering the html report with the sources in the module root, besides the ones uploaded at build time.
+goc server --source-root=/path/to/module
+
+# The coverage and the state of a service registry center are exposed at /metrics in the Prometheus format,
+# add --snapshot-interval to keep the coverage up to date without running 'goc profile'.
+goc server --snapshot-interval=1m
+
+# Start a service registry center requiring tokens, the services built with 'goc build --token-secret' register with signed tokens,
+# and the users get the profiles with 'goc profile --token=r1'.
+goc server --read-tokens=r1,r2 --write-tokens=w1 --token-secret=xxx
+
+# Start a service registry center pushing the blocks newly covered to the clients of /v1/cover/stream every second.
+goc server --stream-interval=1s
+
+# Start a service registry center serving over https, which requires the client certificates signed by ca.pem,
+# and contacts the services over https with its own client certificate.
+goc server --tls-cert=server.pem --tls-key=server-key.pem --client-ca=ca.pem --ca=ca.pem --cert=center.pem --key=center-key.pem
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		server, err := cover.NewFileBasedServer(localPersistence)
+		server, err := cover.NewServer(store, localPersistence, boltDB)
 		if err != nil {
-			log.Fatalf("New file based server failed, err: %v", err)
+			log.Fatalf("New %s based server failed, err: %v", store, err)
 		}
+		server.HeartbeatTTL = heartbeatTTL
+		server.EvictUnhealthy = evictUnhealthy
+		server.SnapshotInterval = snapshotInterval
+		server.Peers = peers
+		server.SyncInterval = syncInterval
+		server.Upstreams = upstreams
+		server.MaxConcurrency = maxConcurrency
+		server.AgentTimeout = agentTimeout
+		server.ProfileTimeout = profileTimeout
+		server.SourceRoot = sourceRoot
+		server.SourceDir = sourceDir
+		server.ReadTokens = readTokens
+		server.WriteTokens = writeTokens
+		server.RegisterTokens = registerTokens
+		server.TokenSecret = secretOrEnv(tokenSecret)
+		server.PeerToken = peerToken
+		server.TLSCert = serverTLSCert
+		server.TLSKey = serverTLSKey
+		server.ClientCA = clientCA
+		server.ClientTLS = clientTLSConfig()
+		server.StreamInterval = streamInterval
 		server.Run(port)
 	},
 }
 
-var port, localPersistence string
+var (
+	port, localPersistence string
+	store, boltDB          string
+	heartbeatTTL           time.Duration
+	evictUnhealthy         bool
+	snapshotInterval       time.Duration
+	peers                  []string
+	syncInterval           time.Duration
+	upstreams              []string
+	maxConcurrency         int
+	agentTimeout           time.Duration
+	profileTimeout         time.Duration
+	sourceRoot, sourceDir  string
+	readTokens             []string
+	writeTokens            []string
+	registerTokens         []string
+	peerToken              string
+	serverTLSCert          string
+	serverTLSKey           string
+	clientCA               string
+	streamInterval         time.Duration
+)
 
 func init() {
 	serverCmd.Flags().StringVarP(&port, "port", "", ":7777", "listen port to start a coverage host center")
 	serverCmd.Flags().StringVarP(&localPersistence, "local-persistence", "", "_svrs_address.txt", "the file to save services address information")
+	serverCmd.Flags().StringVarP(&store, "store", "", "file", "where to save the services information, one of file, bolt and memory")
+	serverCmd.Flags().StringVarP(&boltDB, "bolt-db", "", "_svrs.db", "the database to save services information with --store=bolt")
+	serverCmd.Flags().DurationVarP(&heartbeatTTL, "heartbeat-ttl", "", 30*time.Second, "probe the services which have not sent heartbeat for this long, 0 disables the liveness check")
+	serverCmd.Flags().BoolVarP(&evictUnhealthy, "evict-unhealthy", "", false, "remove the services failing the probe from the center, otherwise only mark them unhealthy")
+	serverCmd.Flags().DurationVarP(&snapshotInterval, "snapshot-interval", "", 0, "collect the profiles of all the services periodically to retain them after the services die, 0 disables it")
+	serverCmd.Flags().StringSliceVarP(&peers, "peers", "", nil, "the other centers to share the registered services with, e.g. http://center-b:7777,http://center-c:7777")
+	serverCmd.Flags().DurationVarP(&syncInterval, "sync-interval", "", 10*time.Second, "how often to pull the registered services from the peers")
+	serverCmd.Flags().StringSliceVarP(&upstreams, "upstream", "", nil, "the independent centers whose profiles are merged into the ones of this center")
+	serverCmd.Flags().IntVarP(&maxConcurrency, "max-concurrency", "", cover.DefaultMaxConcurrency, "the number of services to collect the profiles from at the same time, 0 is unlimited")
+	serverCmd.Flags().DurationVarP(&agentTimeout, "agent-timeout", "", cover.DefaultAgentTimeout, "give up collecting the profile from a service after this long, 0 is unlimited")
+	serverCmd.Flags().DurationVarP(&profileTimeout, "profile-timeout", "", cover.DefaultProfileTimeout, "give up collecting the profiles of a request after this long and report the services not answered, 0 is unlimited")
+	serverCmd.Flags().DurationVarP(&streamInterval, "stream-interval", "", cover.DefaultStreamInterval, "how often to collect the profiles of the services watched by the /v1/cover/stream clients")
+	serverCmd.Flags().StringVarP(&sourceRoot, "source-root", "", "", "the module root, or the GOPATH src directory, to find the sources for the html report")
+	serverCmd.Flags().StringVarP(&sourceDir, "source-dir", "", "_sources", "the directory to save the sources uploaded by 'goc build --upload-source', empty disables the upload")
+	serverCmd.Flags().StringSliceVarP(&readTokens, "read-tokens", "", nil, "the tokens allowed to get the profiles and list the services")
+	serverCmd.Flags().StringSliceVarP(&writeTokens, "write-tokens", "", nil, "the tokens allowed to call all the APIs, e.g. register, clear, init and remove")
+	serverCmd.Flags().StringSliceVarP(&registerTokens, "register-tokens", "", nil, "the tokens only allowed to register the services, to be built into them with --agent-token")
+	serverCmd.Flags().StringVarP(&tokenSecret, "token-secret", "", "", "the secret to verify the tokens signed by 'goc token' and 'goc build --token-secret', can be given by GOC_TOKEN_SECRET env. no token is required if neither the tokens nor the secret are given")
+	serverCmd.Flags().StringVarP(&peerToken, "peer-token", "", "", "the token to contact the peers and the upstream centers with")
+	serverCmd.Flags().StringVarP(&serverTLSCert, "tls-cert", "", "", "the certificate to serve over https, plain http if empty")
+	serverCmd.Flags().StringVarP(&serverTLSKey, "tls-key", "", "", "the key of --tls-cert")
+	serverCmd.Flags().StringVarP(&clientCA, "client-ca", "", "", "require the clients, including the services, to present a certificate signed by the CA")
+	addClientTLSFlags(serverCmd.Flags())
+	serverCmd.Flags().Lookup("ca").Usage = "the CA to verify the services, the peers and the upstream centers with over https, the system ones if empty"
+	serverCmd.Flags().Lookup("cert").Usage = "the client certificate presented to the services, the peers and the upstream centers requiring mutual TLS"
 	rootCmd.AddCommand(serverCmd)
 }
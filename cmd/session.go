@@ -0,0 +1,159 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/qiniu/goc/pkg/cover"
+)
+
+var sessionCmd = &cobra.Command{
+	Use:   "session",
+	Short: "Record the coverage of the named test sessions",
+	Long: `Record what the services covered during a named session, e.g. a test suite, without clearing their counters.
+The center snapshots the counters of all the registered services at start, and keeps the profile counted since then at stop.`,
+	Example: `
+# Record the coverage of the smoke tests.
+goc session start smoke
+make smoke-test
+goc session stop
+
+# List the sessions.
+goc session list
+
+# Get the profile of the smoke tests.
+goc session profile smoke -o smoke.cov
+`,
+}
+
+var sessionStartCmd = &cobra.Command{
+	Use:   "start <name>",
+	Short: "Start a session, at most one session is active at a time",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := newWorker(center).StartSession(args[0])
+		if err != nil {
+			log.Fatalf("start session %s failed, err: %v", args[0], err)
+		}
+		printSessionResult(res)
+	},
+}
+
+var sessionStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the active session and keep its profile",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := newWorker(center).StopSession()
+		if err != nil {
+			log.Fatalf("stop session failed, err: %v", err)
+		}
+		printSessionResult(res)
+	},
+}
+
+var sessionListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the sessions",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := newWorker(center).ListSessions()
+		if err != nil {
+			log.Fatalf("list sessions failed, err: %v", err)
+		}
+		if listJSON {
+			fmt.Fprint(os.Stdout, string(res))
+			return
+		}
+		var sessions []cover.Session
+		if err := json.Unmarshal(res, &sessions); err != nil {
+			log.Fatalf("unexpected response from %s, err: %v", center, err)
+		}
+		printSessions(os.Stdout, sessions)
+	},
+}
+
+var sessionProfileCmd = &cobra.Command{
+	Use:   "profile <name>",
+	Short: "Get the profile of a stopped session",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		res, err := newWorker(center).SessionProfile(args[0], cover.ProfileParam{
+			CoverFilePatterns: coverFilePatterns,
+			SkipFilePatterns:  skipFilePatterns,
+			Packages:          packages,
+			Format:            profileFormat,
+			PathMappings:      pathMappings,
+		})
+		if err != nil {
+			log.Fatalf("get profile of session %s failed, err: %v", args[0], err)
+		}
+		writeOutput(output, res)
+	},
+}
+
+// printSessionResult prints the session started or stopped, and warns about the services failed
+func printSessionResult(res []byte) {
+	var session cover.Session
+	if err := json.Unmarshal(res, &session); err != nil {
+		log.Fatalf("unexpected response from %s, err: %v", center, err)
+	}
+	if len(session.Failed) > 0 {
+		log.Warnf("failed to collect the profiles of %s, their last known profiles are counted", strings.Join(session.Failed, ","))
+	}
+	printSessions(os.Stdout, []cover.Session{session})
+}
+
+// printSessions renders the sessions as a table
+func printSessions(w io.Writer, sessions []cover.Session) {
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Session", "Started", "Stopped", "Failed"})
+	table.SetAutoFormatHeaders(false)
+	for _, s := range sessions {
+		stopped := "-"
+		if !s.Stopped.IsZero() {
+			stopped = s.Stopped.Local().Format(time.RFC3339)
+		}
+		table.Append([]string{s.Name, s.Started.Local().Format(time.RFC3339), stopped, strings.Join(s.Failed, ",")})
+	}
+	table.Render()
+}
+
+func init() {
+	sessionListCmd.Flags().BoolVarP(&listJSON, "json", "", false, "output the sessions in json format")
+	sessionProfileCmd.Flags().StringVarP(&output, "output", "o", "", "download cover profile")
+	sessionProfileCmd.Flags().StringSliceVarP(&coverFilePatterns, "coverfile", "", nil, "only output coverage data of the files matching the patterns")
+	sessionProfileCmd.Flags().StringSliceVarP(&skipFilePatterns, "skipfile", "", nil, "skip the files matching the patterns when outputing coverage data")
+	sessionProfileCmd.Flags().StringSliceVarP(&packages, "package", "", nil, "only output coverage data of the packages under the import paths")
+	sessionProfileCmd.Flags().StringVarP(&profileFormat, "format", "", cover.FormatText, "the format of the profile, one of text, cobertura, lcov, sonar and json")
+	addPathMapFlag(sessionProfileCmd.Flags())
+	for _, c := range []*cobra.Command{sessionStartCmd, sessionStopCmd, sessionListCmd, sessionProfileCmd} {
+		addBasicFlags(c.Flags())
+		sessionCmd.AddCommand(c)
+	}
+	rootCmd.AddCommand(sessionCmd)
+}
@@ -0,0 +1,65 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/qiniu/goc/pkg/cover"
+)
+
+var (
+	tlsCA         string // --ca flag
+	tlsCert       string // --cert flag
+	tlsKey        string // --key flag
+	agentTLSCert  string // --agent-tls-cert flag
+	agentTLSKey   string // --agent-tls-key flag
+	agentClientCA string // --agent-client-ca flag
+	centerCA      string // --center-ca flag
+)
+
+// addClientTLSFlags adds the flags to contact goc center over https
+func addClientTLSFlags(cmdset *pflag.FlagSet) {
+	cmdset.StringVar(&tlsCA, "ca", "", "the CA to verify goc center with over https, the system ones if empty")
+	cmdset.StringVar(&tlsCert, "cert", "", "the client certificate presented to goc center requiring mutual TLS")
+	cmdset.StringVar(&tlsKey, "key", "", "the key of --cert")
+}
+
+// clientTLSConfig loads the config given by --ca, --cert and --key, nil if none is given
+func clientTLSConfig() *tls.Config {
+	config, err := cover.NewClientTLSConfig(tlsCA, tlsCert, tlsKey)
+	if err != nil {
+		log.Fatalf("invalid tls config, err: %v", err)
+	}
+	return config
+}
+
+// readPEM returns the content of the file to build into the services, empty if no file is given
+func readPEM(file string) string {
+	if file == "" {
+		return ""
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("failed to read %s, err: %v", file, err)
+	}
+	return string(pem)
+}
@@ -0,0 +1,112 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/qiniu/goc/pkg/cover"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Sign a token accepted by the centers sharing the secret",
+	Long: `Sign a token with the secret given to 'goc server --token-secret', so that the center accepts it
+without being configured with it. A read token allows to get the profiles and list the services, a write
+token allows all the APIs, and a register token only allows the services to register and report themselves.
+`,
+	Example: `
+# Sign a read token for the dashboards, which expires in 30 days.
+goc token --secret=xxx --scope=read --ttl=720h
+
+# Sign a token to build into the services with 'goc build --agent-token'.
+goc token --secret=xxx --scope=register
+
+# Use the token with all the commands contacting the center.
+export GOC_TOKEN=$(goc token --secret=xxx --scope=write)
+goc clear
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		t, err := signToken(secretOrEnv(tokenSecret), tokenScope, tokenSubject, tokenTTL)
+		if err != nil {
+			log.Fatalf("failed to sign the token, err: %v", err)
+		}
+		fmt.Println(t)
+	},
+}
+
+var (
+	token          string        // --token flag
+	tokenSecret    string        // --token-secret flag
+	tokenScope     string        // --scope flag
+	tokenSubject   string        // --subject flag
+	tokenTTL       time.Duration // --ttl flag
+	agentToken     string        // --agent-token flag
+	agentReadToken string        // --agent-read-token flag
+)
+
+func init() {
+	tokenCmd.Flags().StringVarP(&tokenSecret, "secret", "", "", "the secret of the center, can be given by GOC_TOKEN_SECRET env")
+	tokenCmd.Flags().StringVarP(&tokenScope, "scope", "", cover.ScopeRead, "scope of the token, one of read, write and register")
+	tokenCmd.Flags().StringVarP(&tokenSubject, "subject", "", "", "who the token is for, only informative")
+	tokenCmd.Flags().DurationVarP(&tokenTTL, "ttl", "", 0, "the token expires after this long, 0 never expires")
+	rootCmd.AddCommand(tokenCmd)
+}
+
+func signToken(secret, scope, subject string, ttl time.Duration) (string, error) {
+	claims := cover.TokenClaims{Scope: scope, Subject: subject}
+	if ttl > 0 {
+		claims.Expires = time.Now().Add(ttl).Unix()
+	}
+	return cover.SignToken(secret, claims)
+}
+
+func secretOrEnv(secret string) string {
+	if secret == "" {
+		return os.Getenv("GOC_TOKEN_SECRET")
+	}
+	return secret
+}
+
+func centerToken() string {
+	if token == "" {
+		return os.Getenv("GOC_TOKEN")
+	}
+	return token
+}
+
+// buildAgentToken returns the token built into the services, which is the one given by --agent-token,
+// or a register token signed with --token-secret, so that the services can register to the center
+func buildAgentToken() string {
+	if agentToken != "" {
+		return agentToken
+	}
+	secret := secretOrEnv(tokenSecret)
+	if secret == "" {
+		return ""
+	}
+	t, err := signToken(secret, cover.ScopeRegister, "agent", 0)
+	if err != nil {
+		log.Fatalf("failed to sign the agent token, err: %v", err)
+	}
+	return t
+}
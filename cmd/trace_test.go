@@ -0,0 +1,165 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// traceRequest calls the trace API of the agent, returning the status code and the body
+func traceRequest(t *testing.T, method, url, token string) (int, string) {
+	req, err := http.NewRequest(method, url, nil)
+	assert.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+// hitCount returns the count of the block of hit.go in the trace
+func hitCount(t *testing.T, trace string) string {
+	for _, line := range strings.Split(trace, "\n") {
+		if strings.Contains(line, "/hit.go:") {
+			return line[strings.LastIndex(line, " ")+1:]
+		}
+	}
+	t.Errorf("no block of hit.go in the trace %q", trace)
+	return ""
+}
+
+func TestTraceWindow(t *testing.T) {
+	workingDir := filepath.Join(baseDir, "../tests/samples/simple_trace_project")
+	os.Setenv("GOPATH", "")
+	os.Setenv("GO111MODULE", "on")
+
+	agent, app := freeAddr(t), freeAddr(t)
+	buildFlags, buildOutput = "", ""
+	singleton, agentToken, agentReadToken = true, "w1", "r1"
+	assert.NoError(t, agentPort.Set(agent))
+	defer func() {
+		singleton, agentToken, agentReadToken = false, "", ""
+		_ = agentPort.Set("")
+	}()
+	runBuild([]string{"."}, workingDir)
+
+	cmd := exec.Command(filepath.Join(workingDir, "simple-trace-project"))
+	cmd.Dir = workingDir
+	cmd.Env = append(os.Environ(), "SAMPLE_ADDR="+app, "GOC_TRACE_TIMEOUT=1s")
+	assert.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	trace := "http://" + agent + "/v1/cover/trace/"
+	hit := func() {
+		status, _ := traceRequest(t, "GET", "http://"+app+"/hit", "")
+		assert.Equal(t, http.StatusOK, status)
+	}
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + app + "/hit")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// only one window is open at a time, the other starts wait for it
+	status, _ := traceRequest(t, "POST", trace+"start?id=t1", "w1")
+	assert.Equal(t, http.StatusOK, status)
+	status, body := traceRequest(t, "POST", trace+"start?id=t2&wait=100ms", "w1")
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, body, "another trace window is open")
+	started := make(chan int)
+	go func() {
+		status, _ := traceRequest(t, "POST", trace+"start?id=t2&wait=5s", "w1")
+		started <- status
+	}()
+	time.Sleep(100 * time.Millisecond)
+	hit()
+	hit()
+
+	// the stop returns what was covered since the start
+	status, body = traceRequest(t, "POST", trace+"stop?id=t1", "w1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "2", hitCount(t, body))
+	assert.Equal(t, http.StatusOK, <-started)
+	status, body = traceRequest(t, "POST", trace+"stop?id=t2", "w1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "0", hitCount(t, body))
+
+	// the read token only gets the traces
+	status, body = traceRequest(t, "GET", trace+"t1", "r1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "2", hitCount(t, body))
+	status, _ = traceRequest(t, "POST", trace+"start?id=t3", "r1")
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = traceRequest(t, "GET", trace+"t1", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// the window not stopped in GOC_TRACE_TIMEOUT is dropped
+	status, _ = traceRequest(t, "POST", trace+"start?id=t3", "w1")
+	assert.Equal(t, http.StatusOK, status)
+	time.Sleep(1500 * time.Millisecond)
+	status, body = traceRequest(t, "POST", trace+"stop?id=t3", "w1")
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, body, "trace t3 is not open")
+	status, _ = traceRequest(t, "GET", trace+"t3", "w1")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = traceRequest(t, "POST", trace+"start?id=t4&wait=100ms", "w1")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = traceRequest(t, "POST", trace+"stop?id=t4", "w1")
+	assert.Equal(t, http.StatusOK, status)
+
+	// the last 100 traces are kept
+	for i := 0; i < 98; i++ {
+		id := fmt.Sprintf("e%d", i)
+		status, _ = traceRequest(t, "POST", trace+"start?id="+id, "w1")
+		assert.Equal(t, http.StatusOK, status)
+		status, _ = traceRequest(t, "POST", trace+"stop?id="+id, "w1")
+		assert.Equal(t, http.StatusOK, status)
+	}
+	status, _ = traceRequest(t, "GET", trace+"t1", "w1")
+	assert.Equal(t, http.StatusNotFound, status)
+	for _, id := range []string{"t2", "t4", "e0", "e97"} {
+		status, _ = traceRequest(t, "GET", trace+id, "w1")
+		assert.Equal(t, http.StatusOK, status, id)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ScopeRead allows to get the profiles and list the services
+	ScopeRead = "read"
+	// ScopeWrite allows to change the center and the services, e.g. register, clear, init and remove,
+	// a write token can also read and register
+	ScopeWrite = "write"
+	// ScopeRegister only allows the services to register, report themselves and remove their own addresses,
+	// the tokens built into the services are of this scope
+	ScopeRegister = "register"
+)
+
+// scopeKey keeps the scope granted to the request in the gin context
+const scopeKey = "goc-scope"
+
+// agentKeyHeader carries the key a service generates at start for the center to call it with
+const agentKeyHeader = "X-Goc-Agent-Key"
+
+// signedTokenPrefix marks the tokens signed by SignToken, the rest are static tokens
+const signedTokenPrefix = "goc1."
+
+var (
+	errNoToken      = errors.New("missing token")
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+)
+
+// TokenClaims are carried by a signed token
+type TokenClaims struct {
+	Scope   string `json:"scope"`
+	Subject string `json:"sub,omitempty"`
+	// Expires is the unix time the token expires at, zero never expires
+	Expires int64 `json:"exp,omitempty"`
+}
+
+// SignToken signs the claims with the secret shared with the center, e.g. at build time,
+// so that the center accepts the token without knowing it beforehand
+func SignToken(secret string, claims TokenClaims) (string, error) {
+	if secret == "" {
+		return "", fmt.Errorf("empty secret")
+	}
+	if err := checkScope(claims.Scope); err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return signedTokenPrefix + encoded + "." + signature(secret, encoded), nil
+}
+
+// VerifyToken returns the claims of the token signed with the secret
+func VerifyToken(secret, token string, now time.Time) (TokenClaims, error) {
+	var claims TokenClaims
+	if !strings.HasPrefix(token, signedTokenPrefix) {
+		return claims, errInvalidToken
+	}
+	parts := strings.Split(strings.TrimPrefix(token, signedTokenPrefix), ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signature(secret, parts[0]))) {
+		return claims, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errInvalidToken
+	}
+	if checkScope(claims.Scope) != nil {
+		return claims, errInvalidToken
+	}
+	if claims.Expires != 0 && now.Unix() >= claims.Expires {
+		return claims, errExpiredToken
+	}
+	return claims, nil
+}
+
+func signature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signedTokenPrefix + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func checkScope(scope string) error {
+	if scope != ScopeRead && scope != ScopeWrite && scope != ScopeRegister {
+		return fmt.Errorf("unknown scope %q, should be one of read, write and register", scope)
+	}
+	return nil
+}
+
+// grants reports whether a token of the granted scope is allowed the APIs of the scope
+func grants(granted, scope string) bool {
+	return granted == scope || granted == ScopeWrite
+}
+
+// bearerToken returns the token in the Authorization header, empty if none
+func bearerToken(header string) string {
+	const prefix = "Bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// authEnabled reports whether the center requires tokens, which is the case once any is configured
+func (s *server) authEnabled() bool {
+	return len(s.ReadTokens) > 0 || len(s.WriteTokens) > 0 || len(s.RegisterTokens) > 0 || s.TokenSecret != ""
+}
+
+// tokenScope returns the scope granted to the token
+func (s *server) tokenScope(token string, now time.Time) (string, error) {
+	if token == "" {
+		return "", errNoToken
+	}
+	if s.TokenSecret != "" && strings.HasPrefix(token, signedTokenPrefix) {
+		claims, err := VerifyToken(s.TokenSecret, token, now)
+		if err != nil {
+			return "", err
+		}
+		return claims.Scope, nil
+	}
+	if containsToken(s.WriteTokens, token) {
+		return ScopeWrite, nil
+	}
+	if containsToken(s.ReadTokens, token) {
+		return ScopeRead, nil
+	}
+	if containsToken(s.RegisterTokens, token) {
+		return ScopeRegister, nil
+	}
+	return "", errInvalidToken
+}
+
+// authorize rejects the requests without a token of the scope, with 401 if the token
+// is missing or invalid, and with 403 if it is of another scope
+func (s *server) authorize(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.authEnabled() {
+			return
+		}
+		granted, err := s.tokenScope(bearerToken(c.GetHeader("Authorization")), time.Now())
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="goc"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if !grants(granted, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("token of scope %s is required", scope)})
+			return
+		}
+		c.Set(scopeKey, granted)
+	}
+}
+
+// canRemove reports whether the request is allowed to remove the addresses,
+// a register token only removes the addresses of the process presenting their key, i.e. a service removing itself
+func (s *server) canRemove(c *gin.Context, addrs []string) bool {
+	if c.GetString(scopeKey) != ScopeRegister {
+		return true
+	}
+	key := c.GetHeader(agentKeyHeader)
+	for _, addr := range addrs {
+		if !s.agentTokens.hasKey(addr, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// agentTokens keeps the tokens the services registered with, and the keys they generated at start.
+// The center presents the key when it calls a service, so that a service only answers the center
+// it registered to. The token built into the services is shared by all the ones built alike,
+// so it is never presented to them. The tokens and keys are not persisted,
+// the services send them again with every heartbeat.
+// The zero value is ready to use.
+type agentTokens struct {
+	mu     sync.Mutex
+	tokens map[string]agentCredential // by address
+}
+
+type agentCredential struct {
+	token string // the service registered with
+	key   string // the center calls the service with
+}
+
+// owns reports whether the address is not registered yet, or registered with the token
+func (a *agentTokens) owns(addr, token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cred, ok := a.tokens[addr]
+	return !ok || containsToken([]string{cred.token}, token)
+}
+
+func (a *agentTokens) remember(addr, token, key string) {
+	if token == "" && key == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.tokens == nil {
+		a.tokens = make(map[string]agentCredential)
+	}
+	a.tokens[addr] = agentCredential{token: token, key: key}
+}
+
+// key returns the key to call the service at the address with
+func (a *agentTokens) key(addr string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.tokens[addr].key
+}
+
+// hasKey reports whether the service at the address generated the key
+func (a *agentTokens) hasKey(addr, key string) bool {
+	k := a.key(addr)
+	return k != "" && containsToken([]string{k}, key)
+}
+
+func (a *agentTokens) forget(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.tokens, addr)
+}
+
+func (a *agentTokens) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens = nil
+}
+
+// setToken authorizes the request with the token, if any
+func setToken(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
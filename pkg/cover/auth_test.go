@@ -0,0 +1,201 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignToken(t *testing.T) {
+	now := time.Now()
+	token, err := SignToken("secret", TokenClaims{Scope: ScopeRead, Subject: "alice", Expires: now.Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, signedTokenPrefix))
+
+	claims, err := VerifyToken("secret", token, now)
+	assert.NoError(t, err)
+	assert.Equal(t, ScopeRead, claims.Scope)
+	assert.Equal(t, "alice", claims.Subject)
+
+	_, err = VerifyToken("secret", token, now.Add(2*time.Hour))
+	assert.Equal(t, errExpiredToken, err)
+	_, err = VerifyToken("other", token, now)
+	assert.Equal(t, errInvalidToken, err)
+	// the scope can not be raised without the secret
+	forged := strings.Replace(token, token[len(signedTokenPrefix):strings.LastIndex(token, ".")], "eyJzY29wZSI6IndyaXRlIn0", 1)
+	_, err = VerifyToken("secret", forged, now)
+	assert.Equal(t, errInvalidToken, err)
+	_, err = VerifyToken("secret", "static", now)
+	assert.Equal(t, errInvalidToken, err)
+
+	_, err = SignToken("secret", TokenClaims{Scope: "admin"})
+	assert.Error(t, err)
+	_, err = SignToken("", TokenClaims{Scope: ScopeRead})
+	assert.Error(t, err)
+}
+
+func requestStatus(t *testing.T, method, url, token string) int {
+	return requestWithKey(t, method, url, token, "", "")
+}
+
+// requestWithKey sends the request of a service with the key it generated at start
+func requestWithKey(t *testing.T, method, url, token, key, body string) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	setToken(req, token)
+	if key != "" {
+		req.Header.Set(agentKeyHeader, key)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAuthorize(t *testing.T) {
+	s := &server{
+		Store:       NewMemoryStore(),
+		ReadTokens:  []string{"r1"},
+		WriteTokens: []string{"w1"},
+		TokenSecret: "secret",
+	}
+	center := httptest.NewServer(s.Route(os.Stdout))
+	defer center.Close()
+	signedRead, err := SignToken("secret", TokenClaims{Scope: ScopeRead})
+	assert.NoError(t, err)
+	signedWrite, err := SignToken("secret", TokenClaims{Scope: ScopeWrite})
+	assert.NoError(t, err)
+
+	list := center.URL + CoverServicesListAPI
+	assert.Equal(t, http.StatusUnauthorized, requestStatus(t, "GET", list, ""))
+	assert.Equal(t, http.StatusUnauthorized, requestStatus(t, "GET", list, "unknown"))
+	assert.Equal(t, http.StatusUnauthorized, requestStatus(t, "GET", center.URL+MetricsAPI, ""))
+	for _, token := range []string{"r1", "w1", signedRead, signedWrite} {
+		assert.Equal(t, http.StatusOK, requestStatus(t, "GET", list, token))
+	}
+
+	// the read tokens can not change the center
+	initAPI := center.URL + CoverInitSystemAPI
+	assert.Equal(t, http.StatusForbidden, requestStatus(t, "POST", initAPI, "r1"))
+	assert.Equal(t, http.StatusForbidden, requestStatus(t, "POST", initAPI, signedRead))
+	assert.Equal(t, http.StatusOK, requestStatus(t, "POST", initAPI, "w1"))
+	assert.Equal(t, http.StatusOK, requestStatus(t, "POST", initAPI, signedWrite))
+
+	_, err = NewWorker(center.URL, WithToken("r1")).RegisterService(ServiceUnderTest{Name: "foo", Address: "http://127.0.0.1:64448"})
+	assert.NoError(t, err)
+	assert.Empty(t, s.Store.Get("foo"))
+	_, err = NewWorker(center.URL, WithToken("w1")).RegisterService(ServiceUnderTest{Name: "foo", Address: "http://127.0.0.1:64448"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://127.0.0.1:64448"}, s.Store.Get("foo"))
+
+	// no token is required if none is configured
+	open := httptest.NewServer((&server{Store: NewMemoryStore()}).Route(os.Stdout))
+	defer open.Close()
+	assert.Equal(t, http.StatusOK, requestStatus(t, "GET", open.URL+CoverServicesListAPI, ""))
+}
+
+func TestRegisterScope(t *testing.T) {
+	s := &server{
+		Store:          NewMemoryStore(),
+		WriteTokens:    []string{"w1"},
+		RegisterTokens: []string{"a1"},
+		TokenSecret:    "secret",
+	}
+	center := httptest.NewServer(s.Route(os.Stdout))
+	defer center.Close()
+	signedRegister, err := SignToken("secret", TokenClaims{Scope: ScopeRegister, Subject: "agent"})
+	assert.NoError(t, err)
+
+	// the register tokens only register the services
+	for i, token := range []string{"a1", signedRegister} {
+		addr := fmt.Sprintf("http://127.0.0.1:6446%d", i)
+		key := fmt.Sprintf("k%d", i)
+		assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", center.URL+CoverRegisterServiceAPI+"?name=foo&address="+addr, token, key, ""))
+		assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", center.URL+CoverHeartbeatAPI+"?name=foo&address="+addr, token, key, ""))
+		assert.Equal(t, http.StatusForbidden, requestStatus(t, "GET", center.URL+CoverServicesListAPI, token))
+		assert.Equal(t, http.StatusForbidden, requestStatus(t, "POST", center.URL+CoverProfileClearAPI, token))
+		assert.Equal(t, http.StatusForbidden, requestStatus(t, "POST", center.URL+CoverInitSystemAPI, token))
+	}
+	assert.Equal(t, []string{"http://127.0.0.1:64460", "http://127.0.0.1:64461"}, s.Store.Get("foo"))
+
+	// the address registered with another token is not taken over while it is healthy
+	register := center.URL + CoverRegisterServiceAPI + "?name=foo&address=http://127.0.0.1:64460"
+	assert.Equal(t, http.StatusForbidden, requestWithKey(t, "POST", register, signedRegister, "evil", ""))
+	assert.Equal(t, "k0", s.agentTokens.key("http://127.0.0.1:64460"))
+	// the process restarted with the same token replaces the key
+	assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", register, "a1", "k2", ""))
+	assert.Equal(t, "k2", s.agentTokens.key("http://127.0.0.1:64460"))
+
+	// and only remove the addresses of the process presenting their key
+	remove := center.URL + CoverServicesRemoveAPI
+	assert.Equal(t, http.StatusForbidden, requestWithKey(t, "POST", remove, "a1", "", `{"address":["http://127.0.0.1:64460"]}`))
+	assert.Equal(t, http.StatusForbidden, requestWithKey(t, "POST", remove, "a1", "k2", `{"address":["http://127.0.0.1:64461"]}`))
+	assert.Equal(t, http.StatusForbidden, requestWithKey(t, "POST", remove, "a1", "k2", `{"service":["foo"]}`))
+	assert.Equal(t, []string{"http://127.0.0.1:64460", "http://127.0.0.1:64461"}, s.Store.Get("foo"))
+	assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", remove, "a1", "k2", `{"address":["http://127.0.0.1:64460"]}`))
+	assert.Equal(t, []string{"http://127.0.0.1:64461"}, s.Store.Get("foo"))
+
+	// the unhealthy address is free to register with another token
+	s.agents.markUnhealthy("http://127.0.0.1:64461")
+	assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", center.URL+CoverRegisterServiceAPI+"?name=foo&address=http://127.0.0.1:64461", "a1", "k3", ""))
+	assert.Equal(t, "k3", s.agentTokens.key("http://127.0.0.1:64461"))
+	_, err = NewWorker(center.URL, WithToken("w1")).Remove(ProfileParam{Address: []string{"http://127.0.0.1:64461"}})
+	assert.NoError(t, err)
+	assert.Empty(t, s.Store.Get("foo"))
+}
+
+func TestCenterPresentsAgentKey(t *testing.T) {
+	// the token built into the service is signed with the secret of the center, and shared by the services built alike
+	agentToken, err := SignToken("secret", TokenClaims{Scope: ScopeRegister, Subject: "agent"})
+	assert.NoError(t, err)
+	const agentKey = "0123456789abcdef"
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+agentKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 1"))
+	}))
+	defer agent.Close()
+	s := &server{Store: NewMemoryStore(), ReadTokens: []string{"r1"}, TokenSecret: "secret"}
+	center := httptest.NewServer(s.Route(os.Stdout))
+	defer center.Close()
+
+	// the service registers with its token and its key, the center presents the key only
+	assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", center.URL+CoverRegisterServiceAPI+"?name=foo&address="+agent.URL, agentToken, agentKey, ""))
+	assert.Equal(t, agentKey, s.agentTokens.key(agent.URL))
+	assert.NoError(t, s.probe(agent.URL))
+	profile, err := NewWorker(center.URL, WithToken("r1")).Profile(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(profile), "mockService/main.go:30.13,48.33 13 1")
+
+	// the key is dropped with the service
+	assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", center.URL+CoverServicesRemoveAPI, agentToken, agentKey, `{"address":["`+agent.URL+`"]}`))
+	assert.Empty(t, s.agentTokens.key(agent.URL))
+	assert.Error(t, s.probe(agent.URL))
+}
@@ -0,0 +1,431 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltSchemaVersion is the version of the on-disk format written by boltStore
+const boltSchemaVersion = 2
+
+var (
+	metaBucket       = []byte("meta")
+	servicesBucket   = []byte("services")
+	tombstonesBucket = []byte("tombstones")
+	sessionsBucket   = []byte("sessions")
+
+	schemaVersionKey = []byte("schema_version")
+)
+
+// boltMigrations upgrade the on-disk format, the i-th one migrates version i+1 to i+2
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// version 2 keeps the sessions
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	},
+}
+
+// boltStore keeps the records of the registered services, the tombstones and the sessions
+// in an embedded transactional key/value database
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore creates a store using the bbolt database at the given path.
+// The services persisted by a file store in legacyFile are migrated into the new database,
+// after which the legacy file is renamed with a '.migrated' suffix.
+func NewBoltStore(path, legacyFile string) (RecordStore, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s, err: %v", path, err)
+	}
+
+	l := &boltStore{db: db}
+	migrated, err := l.upgrade(legacyFile)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade database %s, err: %v", path, err)
+	}
+	if migrated {
+		if err := os.Rename(legacyFile, legacyFile+".migrated"); err != nil {
+			log.Warnf("failed to rename the migrated file %s, err: %v", legacyFile, err)
+		}
+	}
+
+	return l, nil
+}
+
+// upgrade brings the database to the current schema version,
+// it reports whether the services in the legacy file have been migrated
+func (l *boltStore) upgrade(legacyFile string) (migrated bool, err error) {
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := meta.Get(schemaVersionKey); v != nil {
+			version = int(binary.BigEndian.Uint64(v))
+		}
+		if version > boltSchemaVersion {
+			return fmt.Errorf("schema version %d is newer than the supported %d, please upgrade goc", version, boltSchemaVersion)
+		}
+
+		if version == 0 {
+			if err := createBuckets(tx); err != nil {
+				return err
+			}
+			if migrated, err = migrateLegacy(tx, legacyFile); err != nil {
+				return err
+			}
+		} else {
+			for ; version < boltSchemaVersion; version++ {
+				if err := boltMigrations[version-1](tx); err != nil {
+					return fmt.Errorf("failed to migrate schema version %d, err: %v", version, err)
+				}
+			}
+		}
+
+		return meta.Put(schemaVersionKey, encodeVersion(boltSchemaVersion))
+	})
+	return migrated, err
+}
+
+// migrateLegacy imports the services persisted by a file store
+func migrateLegacy(tx *bolt.Tx, legacyFile string) (bool, error) {
+	if legacyFile == "" {
+		return false, nil
+	}
+	f, err := os.Open(legacyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	services, err := parseServices(f)
+	if err != nil {
+		return false, fmt.Errorf("read file failed, file: %s, err: %v", legacyFile, err)
+	}
+	now := time.Now()
+	for name, addrs := range services {
+		for _, addr := range addrs {
+			if err := putRecord(tx, ServiceRecord{Name: name, Address: addr, RegisteredAt: now}); err != nil {
+				return false, err
+			}
+		}
+	}
+	log.Infof("migrated the services from %s", legacyFile)
+	return true, nil
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, b := range [][]byte{servicesBucket, tombstonesBucket, sessionsBucket} {
+		if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeVersion(v int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// recordKey orders the records by name, so those of a service are adjacent
+func recordKey(name, addr string) []byte {
+	return []byte(name + "\x00" + addr)
+}
+
+func putRecord(tx *bolt.Tx, r ServiceRecord) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(servicesBucket).Put(recordKey(r.Name, r.Address), v)
+}
+
+// records returns the records whose key has the given prefix, in the order of registration
+func records(tx *bolt.Tx, prefix []byte) ([]ServiceRecord, error) {
+	res := make([]ServiceRecord, 0)
+	c := tx.Bucket(servicesBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var r ServiceRecord
+		if err := json.Unmarshal(v, &r); err != nil {
+			return nil, fmt.Errorf("invalid record %q, err: %v", k, err)
+		}
+		res = append(res, r)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].RegisteredAt.Before(res[j].RegisteredAt)
+	})
+	return res, nil
+}
+
+func (l *boltStore) view(prefix []byte) []ServiceRecord {
+	var res []ServiceRecord
+	err := l.db.View(func(tx *bolt.Tx) (err error) {
+		res, err = records(tx, prefix)
+		return err
+	})
+	if err != nil {
+		log.Errorf("failed to read the services, err: %v", err)
+	}
+	return res
+}
+
+// Add adds the given service to bolt Store
+func (l *boltStore) Add(s ServiceUnderTest) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(servicesBucket).Get(recordKey(s.Name, s.Address)) != nil {
+			log.Printf("service registered already, name: %s, address: %s", s.Name, s.Address)
+			return ErrServiceAlreadyRegistered
+		}
+		return putRecord(tx, ServiceRecord{Name: s.Name, Address: s.Address, Labels: s.Labels, RegisteredAt: time.Now()})
+	})
+}
+
+// Get returns the registered service information with the given name
+func (l *boltStore) Get(name string) []string {
+	var addrs []string
+	for _, r := range l.view(recordKey(name, "")) {
+		addrs = append(addrs, r.Address)
+	}
+	return addrs
+}
+
+// Get returns all the registered service information
+func (l *boltStore) GetAll() map[string][]string {
+	res := make(map[string][]string)
+	for _, r := range l.view(nil) {
+		res[r.Name] = append(res[r.Name], r.Address)
+	}
+	return res
+}
+
+// Init cleanup all the registered service information, the tombstones and the sessions
+func (l *boltStore) Init() error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{servicesBucket, tombstonesBucket, sessionsBucket} {
+			if err := tx.DeleteBucket(b); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return createBuckets(tx)
+	})
+}
+
+// Set replaces the registered services, the records of the addresses kept are preserved
+func (l *boltStore) Set(services map[string][]string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		existing, err := records(tx, nil)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(servicesBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(servicesBucket); err != nil {
+			return err
+		}
+
+		kept := make(map[string]ServiceRecord, len(existing))
+		for _, r := range existing {
+			kept[string(recordKey(r.Name, r.Address))] = r
+		}
+		now := time.Now()
+		for name, addrs := range services {
+			for _, addr := range addrs {
+				r, ok := kept[string(recordKey(name, addr))]
+				if !ok {
+					r = ServiceRecord{Name: name, Address: addr, RegisteredAt: now}
+				}
+				if err := putRecord(tx, r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Remove the service from the bolt store by address
+// if service is not fount, return "no service found" error
+func (l *boltStore) Remove(removeAddr string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		rs, err := records(tx, nil)
+		if err != nil {
+			return err
+		}
+		flag := false
+		for _, r := range rs {
+			if r.Address != removeAddr {
+				continue
+			}
+			flag = true
+			if err := tx.Bucket(servicesBucket).Delete(recordKey(r.Name, r.Address)); err != nil {
+				return err
+			}
+		}
+		if !flag {
+			return fmt.Errorf("no service found")
+		}
+		return nil
+	})
+}
+
+// Records returns the records of all the registered addresses
+func (l *boltStore) Records() (res []ServiceRecord, err error) {
+	err = l.db.View(func(tx *bolt.Tx) error {
+		res, err = records(tx, nil)
+		return err
+	})
+	return res, err
+}
+
+// UpdateHealth persists the liveness of the given address,
+// nothing is done if the address is not registered anymore
+func (l *boltStore) UpdateHealth(addr, health string, lastHeartbeat time.Time) error {
+	// heartbeats are frequent, coalesce them into fewer transactions
+	return l.db.Batch(func(tx *bolt.Tx) error {
+		rs, err := records(tx, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if r.Address != addr {
+				continue
+			}
+			r.Health = health
+			r.LastHeartbeat = lastHeartbeat
+			if err := putRecord(tx, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateLabels persists the labels registered by the given address,
+// nothing is done if the address is not registered anymore
+func (l *boltStore) UpdateLabels(addr string, labels map[string]string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		rs, err := records(tx, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if r.Address != addr {
+				continue
+			}
+			r.Labels = labels
+			if err := putRecord(tx, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutTombstone persists the tombstone, replacing the one of the same address
+func (l *boltStore) PutTombstone(t Tombstone) error {
+	v, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tombstonesBucket).Put([]byte(t.Address), v)
+	})
+}
+
+// DropTombstone drops the persisted tombstone of the address
+func (l *boltStore) DropTombstone(addr string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tombstonesBucket).Delete([]byte(addr))
+	})
+}
+
+// Tombstones returns all the persisted tombstones
+func (l *boltStore) Tombstones() ([]Tombstone, error) {
+	res := make([]Tombstone, 0)
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tombstonesBucket).ForEach(func(k, v []byte) error {
+			var t Tombstone
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("invalid tombstone %q, err: %v", k, err)
+			}
+			res = append(res, t)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// PutSession persists the session, replacing the one of the same name
+func (l *boltStore) PutSession(s Session) error {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(s.Name), v)
+	})
+}
+
+// Sessions returns all the persisted sessions
+func (l *boltStore) Sessions() ([]Session, error) {
+	res := make([]Session, 0)
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				return fmt.Errorf("invalid session %q, err: %v", k, err)
+			}
+			res = append(res, s)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// Close releases the database
+func (l *boltStore) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,169 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/tools/cover"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "goc.db")
+
+	store, err := NewBoltStore(dbFile, "")
+	assert.NoError(t, err)
+	s1 := ServiceUnderTest{Name: "test", Address: "http://127.0.0.1:8900"}
+	s2 := ServiceUnderTest{Name: "test2", Address: "http://127.0.0.1:8901"}
+	s3 := ServiceUnderTest{Name: "test2", Address: "http://127.0.0.1:8902"}
+	assert.NoError(t, store.Add(s1))
+	assert.Equal(t, ErrServiceAlreadyRegistered, store.Add(s1))
+	assert.NoError(t, store.Add(s2))
+	assert.NoError(t, store.Add(s3))
+
+	assert.Equal(t, []string{"http://127.0.0.1:8901", "http://127.0.0.1:8902"}, store.Get("test2"))
+	assert.Nil(t, store.Get("test3"))
+	assert.Equal(t, map[string][]string{
+		"test":  {"http://127.0.0.1:8900"},
+		"test2": {"http://127.0.0.1:8901", "http://127.0.0.1:8902"},
+	}, store.GetAll())
+
+	now := time.Now().UTC().Truncate(time.Second)
+	assert.NoError(t, store.UpdateHealth("http://127.0.0.1:8901", HealthHealthy, now))
+	assert.NoError(t, store.PutTombstone(Tombstone{Name: "test3", Address: "http://127.0.0.1:8903", Profile: "mode: count\n"}))
+
+	// everything survives reopening the database
+	assert.NoError(t, store.(*boltStore).Close())
+	store, err = NewBoltStore(dbFile, "")
+	assert.NoError(t, err)
+	defer store.(*boltStore).Close()
+	records, err := store.Records()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(records))
+	for _, r := range records {
+		assert.False(t, r.RegisteredAt.IsZero())
+		if r.Address == "http://127.0.0.1:8901" {
+			assert.Equal(t, HealthHealthy, r.Health)
+			assert.True(t, now.Equal(r.LastHeartbeat))
+		}
+	}
+	tombstones, err := store.Tombstones()
+	assert.NoError(t, err)
+	assert.Equal(t, []Tombstone{{Name: "test3", Address: "http://127.0.0.1:8903", Profile: "mode: count\n"}}, tombstones)
+
+	// set keeps the records of the addresses still registered
+	assert.NoError(t, store.Set(map[string][]string{"test2": {"http://127.0.0.1:8901"}}))
+	records, err = store.Records()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, HealthHealthy, records[0].Health)
+
+	assert.NoError(t, store.Remove("http://127.0.0.1:8901"))
+	assert.Error(t, store.Remove("http"), fmt.Errorf("no service found"))
+	assert.Empty(t, store.GetAll())
+
+	assert.NoError(t, store.Add(s1))
+	assert.NoError(t, store.Init())
+	assert.Empty(t, store.GetAll())
+	tombstones, err = store.Tombstones()
+	assert.NoError(t, err)
+	assert.Empty(t, tombstones)
+
+	assert.NoError(t, store.PutTombstone(Tombstone{Name: "test3", Address: "http://127.0.0.1:8903", Profile: "mode: count\n"}))
+	assert.NoError(t, store.DropTombstone("http://127.0.0.1:8903"))
+	tombstones, err = store.Tombstones()
+	assert.NoError(t, err)
+	assert.Empty(t, tombstones)
+}
+
+func TestBoltStoreMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "goc.db")
+	legacyFile := filepath.Join(dir, "_svrs_address.txt")
+
+	legacy, err := NewFileStore(legacyFile)
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.Add(ServiceUnderTest{Name: "a", Address: "http://127.0.0.1:8900"}))
+	assert.NoError(t, legacy.Add(ServiceUnderTest{Name: "b", Address: "http://127.0.0.1:8901"}))
+
+	store, err := NewBoltStore(dbFile, legacyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, legacy.GetAll(), store.GetAll())
+	assert.NoError(t, store.(*boltStore).Close())
+
+	// the legacy file is only migrated once
+	_, err = os.Stat(legacyFile)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(legacyFile + ".migrated")
+	assert.NoError(t, err)
+
+	// the database written by a newer goc is refused
+	db, err := bolt.Open(dbFile, 0600, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(schemaVersionKey, encodeVersion(boltSchemaVersion+1))
+	}))
+	assert.NoError(t, db.Close())
+	_, err = NewBoltStore(dbFile, legacyFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "newer than the supported")
+}
+
+func TestBoltBasedServerRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "goc.db")
+
+	s, err := NewBoltBasedServer(dbFile, "")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: "http://127.0.0.1:8900"}))
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: "http://127.0.0.1:8901"}))
+	now := time.Now()
+	s.agents.heartbeat("http://127.0.0.1:8900", now)
+	s.persistHealth("http://127.0.0.1:8900")
+
+	profile, err := ParseProfile(strings.NewReader("mode: count\nmockService/main.go:30.13,48.33 13 1"))
+	assert.NoError(t, err)
+	s.profiles.update("foo", "http://127.0.0.1:8901", profile, now)
+	assert.NoError(t, s.Store.Remove("http://127.0.0.1:8901"))
+	s.bury("http://127.0.0.1:8901")
+	assert.NoError(t, s.Store.(*boltStore).Close())
+
+	// the restarted center knows the health and keeps the tombstones
+	s, err = NewBoltBasedServer(dbFile, "")
+	assert.NoError(t, err)
+	defer s.Store.(*boltStore).Close()
+	assert.Equal(t, map[string][]string{"foo": {"http://127.0.0.1:8900"}}, s.Store.GetAll())
+	st := s.agents.status("http://127.0.0.1:8900")
+	assert.Equal(t, HealthHealthy, st.health)
+	assert.True(t, now.Equal(st.lastHeartbeat))
+	assert.Equal(t, [][]*cover.Profile{profile}, profilesOf(s.profiles.buried(nil)))
+}
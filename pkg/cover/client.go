@@ -18,6 +18,7 @@ package cover
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -34,10 +35,19 @@ import (
 type Action interface {
 	Profile(param ProfileParam) ([]byte, error)
 	Clear(param ProfileParam) ([]byte, error)
+	Pause(param ProfileParam) ([]byte, error)
+	Resume(param ProfileParam) ([]byte, error)
 	Remove(param ProfileParam) ([]byte, error)
 	InitSystem() ([]byte, error)
-	ListServices() ([]byte, error)
+	ListServices(param ProfileParam) ([]byte, error)
+	ListServiceStatus(param ProfileParam) ([]byte, error)
 	RegisterService(svr ServiceUnderTest) ([]byte, error)
+	HTML(param ProfileParam) ([]byte, error)
+	UploadSource(archive io.Reader) ([]byte, error)
+	StartSession(name string) ([]byte, error)
+	StopSession() ([]byte, error)
+	ListSessions() ([]byte, error)
+	SessionProfile(name string, param ProfileParam) ([]byte, error)
 }
 
 const (
@@ -47,29 +57,89 @@ const (
 	CoverProfileAPI = "/v1/cover/profile"
 	//CoverProfileClearAPI is provided by the covered service to clear profiles
 	CoverProfileClearAPI = "/v1/cover/clear"
+	//CoverPauseAPI is provided by the covered service to exclude the counts from the coverage until resumed
+	CoverPauseAPI = "/v1/cover/pause"
+	//CoverResumeAPI is provided by the covered service to resume the counting
+	CoverResumeAPI = "/v1/cover/resume"
 	//CoverServicesListAPI list all the registered services
 	CoverServicesListAPI = "/v1/cover/list"
 	//CoverRegisterServiceAPI register a service into service center
 	CoverRegisterServiceAPI = "/v1/cover/register"
 	//CoverServicesRemoveAPI remove one services from the service center
 	CoverServicesRemoveAPI = "/v1/cover/remove"
+	//CoverHeartbeatAPI is called by the covered service periodically to keep it alive in the service center
+	CoverHeartbeatAPI = "/v1/cover/heartbeat"
+	//CoverUploadAPI is called by the covered service in push mode to upload its profile
+	CoverUploadAPI = "/v1/cover/upload"
+	//CoverTunnelAPI is long polled by the covered service to receive the requests routed over its tunnel
+	CoverTunnelAPI = "/v1/cover/tunnel"
+	//CoverTunnelReplyAPI is called by the covered service to reply the requests routed over its tunnel
+	CoverTunnelReplyAPI = "/v1/cover/tunnel/reply"
+	//CoverCoverageAPI is provided by the covered service to report the coverage ratio, also used as liveness probe
+	CoverCoverageAPI = "/v1/cover/coverage"
+	//CoverHTMLAPI renders the merged profile as the annotated source
+	CoverHTMLAPI = "/v1/cover/html"
+	//CoverSourceAPI is called at build time to upload the sources for the html report
+	CoverSourceAPI = "/v1/cover/source"
+	//CoverReplicaAPI is called by the peer centers to share the registry
+	CoverReplicaAPI = "/v1/cover/replica"
+	//CoverSummaryAPI reports the coverage of every package and every file in json
+	CoverSummaryAPI = "/v1/cover/summary"
+	//CoverFileAPI reports the blocks of a file in json
+	CoverFileAPI = "/v1/cover/file"
+	//CoverStreamAPI pushes the blocks newly covered as server-sent events
+	CoverStreamAPI = "/v1/cover/stream"
+	//CoverSessionStartAPI records the baseline of a named session
+	CoverSessionStartAPI = "/v1/cover/session/start"
+	//CoverSessionStopAPI computes the profile of the active session since its baseline
+	CoverSessionStopAPI = "/v1/cover/session/stop"
+	//CoverSessionListAPI lists the sessions
+	CoverSessionListAPI = "/v1/cover/session/list"
+	//CoverSessionProfileAPI gets the profile of a stopped session
+	CoverSessionProfileAPI = "/v1/cover/session/profile"
 )
 
 type client struct {
 	Host   string
 	client *http.Client
+	token  string
+}
+
+// WorkerOption configures the worker created by NewWorker
+type WorkerOption func(*client)
+
+// WithToken authorizes the requests of the worker with the token, empty sends none
+func WithToken(token string) WorkerOption {
+	return func(c *client) {
+		c.token = token
+	}
+}
+
+// WithTLSConfig contacts the host over https with the config, e.g. loaded by NewClientTLSConfig
+func WithTLSConfig(config *tls.Config) WorkerOption {
+	return withTransport(newTransport(config))
+}
+
+func withTransport(rt http.RoundTripper) WorkerOption {
+	return func(c *client) {
+		c.client = &http.Client{Transport: rt}
+	}
 }
 
 // NewWorker creates a worker to contact with service
-func NewWorker(host string) Action {
+func NewWorker(host string, opts ...WorkerOption) Action {
 	_, err := url.ParseRequestURI(host)
 	if err != nil {
 		log.Fatalf("Parse url %s failed, err: %v", host, err)
 	}
-	return &client{
+	c := &client{
 		Host:   host,
 		client: http.DefaultClient,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *client) RegisterService(srv ServiceUnderTest) ([]byte, error) {
@@ -80,17 +150,42 @@ func (c *client) RegisterService(srv ServiceUnderTest) ([]byte, error) {
 		return nil, fmt.Errorf("invalid service name")
 	}
 	u := fmt.Sprintf("%s%s?name=%s&address=%s", c.Host, CoverRegisterServiceAPI, srv.Name, srv.Address)
+	for k, v := range srv.Labels {
+		u += "&label=" + url.QueryEscape(k+"="+v)
+	}
 	_, res, err := c.do("POST", u, "", nil)
 	return res, err
 }
 
-func (c *client) ListServices() ([]byte, error) {
-	u := fmt.Sprintf("%s%s", c.Host, CoverServicesListAPI)
-	_, services, err := c.do("GET", u, "", nil)
+func (c *client) ListServices(param ProfileParam) ([]byte, error) {
+	return c.list(param, false)
+}
+
+func (c *client) ListServiceStatus(param ProfileParam) ([]byte, error) {
+	return c.list(param, true)
+}
+
+// list gets the addresses of the services selected by their names and labels, with their health if detail
+func (c *client) list(param ProfileParam, detail bool) ([]byte, error) {
+	query := url.Values{}
+	if detail {
+		query.Set("detail", "true")
+	}
+	if param.Selector != "" {
+		query.Set("selector", param.Selector)
+	}
+	for _, pattern := range param.ServicePatterns {
+		query.Add("servicepattern", pattern)
+	}
+	u := fmt.Sprintf("%s%s?%s", c.Host, CoverServicesListAPI, query.Encode())
+	res, services, err := c.do("GET", u, "", nil)
 	if err != nil && isNetworkError(err) {
-		_, services, err = c.do("GET", u, "", nil)
+		res, services, err = c.do("GET", u, "", nil)
 	}
 
+	if err == nil && res.StatusCode != 200 {
+		err = fmt.Errorf("%s", services)
+	}
 	return services, err
 }
 
@@ -108,6 +203,14 @@ func (c *client) Profile(param ProfileParam) ([]byte, error) {
 	if err != nil && isNetworkError(err) {
 		res, profile, err = c.do("POST", u, "application/json", bytes.NewReader(body))
 	}
+	if res != nil {
+		for _, failure := range res.Header[http.CanonicalHeaderKey(FailedCenterHeader)] {
+			log.Warnf("get profile from upstream center failed, %s", failure)
+		}
+		if summary := res.Header.Get(ProfileReportHeader); summary != "" {
+			log.Infof("profile collected from the services, %s", summary)
+		}
+	}
 
 	if err == nil && res.StatusCode != 200 {
 		err = fmt.Errorf(string(profile))
@@ -115,6 +218,35 @@ func (c *client) Profile(param ProfileParam) ([]byte, error) {
 	return profile, err
 }
 
+func (c *client) HTML(param ProfileParam) ([]byte, error) {
+	u := fmt.Sprintf("%s%s", c.Host, CoverHTMLAPI)
+	if len(param.Service) != 0 && len(param.Address) != 0 {
+		return nil, fmt.Errorf("use 'service' flag and 'address' flag at the same time may cause ambiguity, please use them separately")
+	}
+
+	// the json.Marshal function can return two types of errors: UnsupportedTypeError or UnsupportedValueError
+	// so no need to check here
+	body, _ := json.Marshal(param)
+	res, page, err := c.do("POST", u, "application/json", bytes.NewReader(body))
+	if err != nil && isNetworkError(err) {
+		res, page, err = c.do("POST", u, "application/json", bytes.NewReader(body))
+	}
+
+	if err == nil && res.StatusCode != 200 {
+		err = fmt.Errorf("%s", page)
+	}
+	return page, err
+}
+
+func (c *client) UploadSource(archive io.Reader) ([]byte, error) {
+	u := fmt.Sprintf("%s%s", c.Host, CoverSourceAPI)
+	res, body, err := c.do("POST", u, "application/gzip", archive)
+	if err == nil && res.StatusCode != 200 {
+		err = fmt.Errorf("%s", body)
+	}
+	return body, err
+}
+
 func (c *client) Clear(param ProfileParam) ([]byte, error) {
 	u := fmt.Sprintf("%s%s", c.Host, CoverProfileClearAPI)
 	if len(param.Service) != 0 && len(param.Address) != 0 {
@@ -131,6 +263,32 @@ func (c *client) Clear(param ProfileParam) ([]byte, error) {
 	return resp, err
 }
 
+func (c *client) Pause(param ProfileParam) ([]byte, error) {
+	return c.control(CoverPauseAPI, param)
+}
+
+func (c *client) Resume(param ProfileParam) ([]byte, error) {
+	return c.control(CoverResumeAPI, param)
+}
+
+// control pauses or resumes the counting of the services selected
+func (c *client) control(api string, param ProfileParam) ([]byte, error) {
+	u := fmt.Sprintf("%s%s", c.Host, api)
+	if len(param.Service) != 0 && len(param.Address) != 0 {
+		return nil, fmt.Errorf("use 'service' flag and 'address' flag at the same time may cause ambiguity, please use them separately")
+	}
+
+	body, _ := json.Marshal(param)
+	res, resp, err := c.do("POST", u, "application/json", bytes.NewReader(body))
+	if err != nil && isNetworkError(err) {
+		res, resp, err = c.do("POST", u, "application/json", bytes.NewReader(body))
+	}
+	if err == nil && res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s", resp)
+	}
+	return resp, err
+}
+
 func (c *client) Remove(param ProfileParam) ([]byte, error) {
 	u := fmt.Sprintf("%s%s", c.Host, CoverServicesRemoveAPI)
 	if len(param.Service) != 0 && len(param.Address) != 0 {
@@ -156,6 +314,55 @@ func (c *client) InitSystem() ([]byte, error) {
 	return body, err
 }
 
+func (c *client) StartSession(name string) ([]byte, error) {
+	u := fmt.Sprintf("%s%s?name=%s", c.Host, CoverSessionStartAPI, url.QueryEscape(name))
+	return c.call("POST", u)
+}
+
+func (c *client) StopSession() ([]byte, error) {
+	u := fmt.Sprintf("%s%s", c.Host, CoverSessionStopAPI)
+	return c.call("POST", u)
+}
+
+func (c *client) ListSessions() ([]byte, error) {
+	u := fmt.Sprintf("%s%s", c.Host, CoverSessionListAPI)
+	return c.call("GET", u)
+}
+
+func (c *client) SessionProfile(name string, param ProfileParam) ([]byte, error) {
+	v := url.Values{}
+	v.Set("name", name)
+	if param.Format != "" {
+		v.Set("format", param.Format)
+	}
+	for _, p := range param.CoverFilePatterns {
+		v.Add("coverfile", p)
+	}
+	for _, p := range param.SkipFilePatterns {
+		v.Add("skipfile", p)
+	}
+	for _, p := range param.Packages {
+		v.Add("package", p)
+	}
+	for _, m := range param.PathMappings {
+		v.Add("pathmap", m)
+	}
+	u := fmt.Sprintf("%s%s?%s", c.Host, CoverSessionProfileAPI, v.Encode())
+	return c.call("GET", u)
+}
+
+// call sends the request without body, the response of a status other than 200 is returned as the error
+func (c *client) call(method, u string) ([]byte, error) {
+	res, body, err := c.do(method, u, "", nil)
+	if err != nil && isNetworkError(err) {
+		res, body, err = c.do(method, u, "", nil)
+	}
+	if err == nil && res.StatusCode != 200 {
+		err = fmt.Errorf("%s", body)
+	}
+	return body, err
+}
+
 func (c *client) do(method, url, contentType string, body io.Reader) (*http.Response, []byte, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
@@ -165,6 +372,7 @@ func (c *client) do(method, url, contentType string, body io.Reader) (*http.Resp
 	if contentType != "" {
 		req.Header.Set("Content-Type", contentType)
 	}
+	setToken(req, c.token)
 
 	res, err := c.client.Do(req)
 	if err != nil {
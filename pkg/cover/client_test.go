@@ -58,7 +58,7 @@ func TestClientAction(t *testing.T) {
 	assert.Contains(t, string(res), "success")
 
 	// do list and check server
-	res, err = client.ListServices()
+	res, err = client.ListServices(ProfileParam{})
 	assert.NoError(t, err)
 	assert.Contains(t, string(res), src.Address)
 	assert.Contains(t, string(res), src.Name)
@@ -168,7 +168,7 @@ func TestClientAction(t *testing.T) {
 	// init system and check server again
 	_, err = client.InitSystem()
 	assert.NoError(t, err)
-	res, err = client.ListServices()
+	res, err = client.ListServices(ProfileParam{})
 	assert.NoError(t, err)
 	assert.Equal(t, "{}", string(res))
 }
@@ -198,7 +198,7 @@ func TestClientListServices(t *testing.T) {
 		Host:   "http://127.0.0.1:64445", // a invalid host
 		client: http.DefaultClient,
 	}
-	_, err := c.ListServices()
+	_, err := c.ListServices(ProfileParam{})
 	assert.Contains(t, err.Error(), "connect: connection refused")
 }
 
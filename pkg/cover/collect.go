@@ -0,0 +1,323 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/tools/cover"
+)
+
+const (
+	// DefaultMaxConcurrency is the default number of addresses collected at the same time
+	DefaultMaxConcurrency = 32
+	// DefaultAgentTimeout is the default deadline to collect the profile from an address
+	DefaultAgentTimeout = 30 * time.Second
+	// DefaultProfileTimeout is the default deadline to collect the profiles from all the addresses
+	DefaultProfileTimeout = 2 * time.Minute
+)
+
+// ProfileReportHeader summarizes the collection of a profile request, e.g. "succeeded=3,timeout=1,failed=0"
+const ProfileReportHeader = "X-Goc-Profile-Report"
+
+// The results of collecting the profile from an address
+const (
+	// CollectSucceeded means the profile is collected from the address
+	CollectSucceeded = "succeeded"
+	// CollectPushed means the profile uploaded by the service in push mode is used
+	CollectPushed = "pushed"
+	// CollectCached means the address is unhealthy, the profile collected before is used
+	CollectCached = "cached"
+	// CollectSkipped means the address is unhealthy and no profile was collected before
+	CollectSkipped = "skipped"
+	// CollectTimeout means the address did not answer before the deadline
+	CollectTimeout = "timeout"
+	// CollectFailed means the address answered with an error or an invalid profile
+	CollectFailed = "failed"
+)
+
+// AddressReport is the result of collecting the profile from an address
+type AddressReport struct {
+	Service  string `json:"service"`
+	Address  string `json:"address"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// ProfileReport lists the result of every address and upstream center of a profile request
+type ProfileReport struct {
+	Addresses     []AddressReport `json:"addresses"`
+	FailedCenters []CenterError   `json:"failedCenters,omitempty"`
+	// SkippedTombstones are the addresses whose tombstones mismatch the profiles merged
+	SkippedTombstones []string `json:"skippedTombstones,omitempty"`
+}
+
+// summary counts the addresses succeeded, timed out and failed
+func (r ProfileReport) summary() string {
+	var succeeded, timeout, failed int
+	for _, a := range r.Addresses {
+		switch a.Status {
+		case CollectTimeout:
+			timeout++
+		case CollectFailed:
+			failed++
+		case CollectSkipped:
+		default:
+			succeeded++
+		}
+	}
+	summary := fmt.Sprintf("succeeded=%d,timeout=%d,failed=%d", succeeded, timeout, failed)
+	if len(r.SkippedTombstones) > 0 {
+		summary += fmt.Sprintf(",skippedTombstones=%d", len(r.SkippedTombstones))
+	}
+	return summary
+}
+
+// ProfileEnvelope is the response of a profile request asking for the report
+type ProfileEnvelope struct {
+	Profile string        `json:"profile"`
+	Report  ProfileReport `json:"report"`
+}
+
+// collectTimeouts returns the deadlines of the collection, the ones in the param override the center's
+func (s *server) collectTimeouts(p ProfileParam) (agent, overall time.Duration, err error) {
+	agent, overall = s.AgentTimeout, s.ProfileTimeout
+	if p.AgentTimeout != "" {
+		if agent, err = time.ParseDuration(p.AgentTimeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid agent timeout %s, err: %v", p.AgentTimeout, err)
+		}
+	}
+	if p.Timeout != "" {
+		if overall, err = time.ParseDuration(p.Timeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid timeout %s, err: %v", p.Timeout, err)
+		}
+	}
+	return agent, overall, nil
+}
+
+// withTimeout is context.WithTimeout, except that zero timeout is unlimited
+func withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// agentContext bounds the collection from a single address by AgentTimeout
+func (s *server) agentContext() (context.Context, context.CancelFunc) {
+	return withTimeout(context.Background(), s.AgentTimeout)
+}
+
+// collectProfiles gets the profiles from the addresses in parallel, at most MaxConcurrency at the same time.
+// The profiles are returned in the order of the addresses, nil for the ones not collected.
+// With a query the agents only send the files it selects, see agentQuery.
+func (s *server) collectProfiles(ctx context.Context, addrs []string, names map[string]string, agentTimeout time.Duration, query string) ([][]*cover.Profile, []AddressReport) {
+	concurrency := s.MaxConcurrency
+	if concurrency <= 0 {
+		concurrency = len(addrs)
+	}
+	sem := make(chan struct{}, concurrency)
+
+	type result struct {
+		i       int
+		profile []*cover.Profile
+		report  AddressReport
+	}
+	// buffered so that the collections finishing after the deadline never block
+	results := make(chan result, len(addrs))
+	for i, addr := range addrs {
+		go func(i int, addr string) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+			start := time.Now()
+			profile, status, err := s.collectOne(ctx, names[addr], addr, agentTimeout, query)
+			report := AddressReport{Service: names[addr], Address: addr, Status: status, Duration: time.Since(start).String()}
+			if err != nil {
+				report.Error = err.Error()
+			}
+			results <- result{i: i, profile: profile, report: report}
+		}(i, addr)
+	}
+
+	profiles := make([][]*cover.Profile, len(addrs))
+	reports := make([]AddressReport, len(addrs))
+	for i, addr := range addrs {
+		// the addresses still being collected at the deadline are reported timeout
+		reports[i] = AddressReport{Service: names[addr], Address: addr, Status: CollectTimeout, Error: "collection deadline exceeded"}
+	}
+	for range addrs {
+		select {
+		case r := <-results:
+			profiles[r.i], reports[r.i] = r.profile, r.report
+		case <-ctx.Done():
+			return profiles, reports
+		}
+	}
+	return profiles, reports
+}
+
+// collectOne gets the profile of the address, or the one pushed or cached for it.
+// The pushed and the cached profiles are whole, whatever the query.
+func (s *server) collectOne(ctx context.Context, name, addr string, timeout time.Duration, query string) ([]*cover.Profile, string, error) {
+	if pushed, ok := s.profiles.pushed(addr); ok {
+		return pushed.profile, CollectPushed, nil
+	}
+	if s.agents.isUnhealthy(addr) {
+		if cached, ok := s.profiles.get(addr); ok {
+			log.Warnf("address [%s] is unhealthy, use the profile collected at %v", addr, cached.collected)
+			return cached.profile, CollectCached, nil
+		}
+		log.Warnf("skip unhealthy address [%s]", addr)
+		return nil, CollectSkipped, nil
+	}
+
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	var profile []*cover.Profile
+	var err error
+	if query == "" {
+		profile, err = s.collect(ctx, name, addr, time.Now())
+	} else {
+		// a part of the profile is not cached, the cache keeps the whole ones for the tombstones and the streams
+		profile, err = s.scrape(ctx, addr, query)
+	}
+	if err != nil {
+		if isTimeout(ctx) {
+			return nil, CollectTimeout, err
+		}
+		return nil, CollectFailed, err
+	}
+	return profile, CollectSucceeded, nil
+}
+
+// scrape gets the profile from the address and records it in the metrics
+func (s *server) scrape(ctx context.Context, addr, query string) ([]*cover.Profile, error) {
+	start := time.Now()
+	profile, err := s.scrapeAgent(ctx, addr, query)
+	s.observeScrape(addr, time.Since(start), err)
+	return profile, err
+}
+
+// scrapeAgent gets the profile from the address, over its tunnel if it has one connected to this center or a peer
+func (s *server) scrapeAgent(ctx context.Context, addr, query string) ([]*cover.Profile, error) {
+	if s.tunnels.connected(addr) {
+		timeout := tunnelRoundTripTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		body, err := (&tunnelClient{addr: addr, hub: &s.tunnels, timeout: timeout}).profile(query)
+		if err != nil {
+			return nil, err
+		}
+		return ParseProfile(bytes.NewReader(body))
+	}
+
+	// the requests are bounded by the context
+	client := &http.Client{Transport: s.transport()}
+	if peer, token, ok := s.tunnelPeer(addr); ok {
+		return scrapeOnce(ctx, client, peer+CoverProfileAPI+peerQuery(addr, query), token)
+	}
+	token := s.agentTokens.key(addr)
+	// the whole profile is rebuilt from the counters, the filtered ones are got in the text format
+	if query == "" && !s.blocks.isLegacy(addr) {
+		profile, err := s.scrapeCounters(ctx, client, addr, token)
+		if err != nil && isNetworkError(err) && ctx.Err() == nil {
+			profile, err = s.scrapeCounters(ctx, client, addr, token)
+		}
+		if err != errCountersUnsupported {
+			return profile, err
+		}
+		s.blocks.setLegacy(addr)
+	}
+	profile, err := scrapeOnce(ctx, client, addr+CoverProfileAPI+query, token)
+	if err != nil && isNetworkError(err) && ctx.Err() == nil {
+		profile, err = scrapeOnce(ctx, client, addr+CoverProfileAPI+query, token)
+	}
+	return profile, err
+}
+
+// scrapeOnce parses the profile as it is received from the address
+func scrapeOnce(ctx context.Context, client *http.Client, u, token string) ([]*cover.Profile, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	setToken(req, token)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s", body)
+	}
+	return ParseProfile(resp.Body)
+}
+
+// isTimeout reports whether the deadline of the collection is exceeded
+func isTimeout(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ctx.Err() == context.DeadlineExceeded || ok && !time.Now().Before(deadline)
+}
+
+// peerQuery is the query of the profile API of a peer center selecting the address,
+// and the files of the agent query. The peer neither merges its tombstones nor its upstreams,
+// which this center merges by itself.
+func peerQuery(addr, query string) string {
+	q := "?federated=true&skiptombstones=true&address=" + url.QueryEscape(addr)
+	if query != "" {
+		q += "&" + strings.TrimPrefix(query, "?")
+	}
+	return q
+}
+
+// agentQuery is the query of the profile API of the agents selecting the files of the param,
+// so that the agents only send these files. It is empty if all the files are selected.
+// The agents built before the query was supported send all the files, which the center filters anyway.
+func agentQuery(param ProfileParam) string {
+	v := url.Values{}
+	for _, p := range param.CoverFilePatterns {
+		v.Add("coverfile", p)
+	}
+	for _, p := range param.SkipFilePatterns {
+		v.Add("skipfile", p)
+	}
+	for _, p := range param.Packages {
+		v.Add("package", p)
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return "?" + v.Encode()
+}
@@ -0,0 +1,166 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSlowAgent(delay time.Duration, count string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 " + count))
+	}))
+}
+
+func TestProfileWithAgentTimeout(t *testing.T) {
+	fast := newSlowAgent(0, "1")
+	defer fast.Close()
+	slow := newSlowAgent(2*time.Second, "2")
+	defer slow.Close()
+
+	s := &server{Store: NewMemoryStore()}
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "fast", Address: fast.URL}))
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "slow", Address: slow.URL}))
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+	client := NewWorker(ts.URL)
+
+	// the slow agent fails the request unless forced
+	start := time.Now()
+	_, err := client.Profile(ProfileParam{AgentTimeout: "200ms"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), slow.URL)
+	assert.True(t, time.Since(start) < time.Second)
+
+	res, err := client.Profile(ProfileParam{AgentTimeout: "200ms", Force: true, Report: true})
+	assert.NoError(t, err)
+	var envelope ProfileEnvelope
+	assert.NoError(t, json.Unmarshal(res, &envelope))
+	assert.Contains(t, envelope.Profile, "mockService/main.go:30.13,48.33 13 1")
+	assert.Equal(t, 2, len(envelope.Report.Addresses))
+	statuses := map[string]string{}
+	for _, a := range envelope.Report.Addresses {
+		statuses[a.Service] = a.Status
+	}
+	assert.Equal(t, map[string]string{"fast": CollectSucceeded, "slow": CollectTimeout}, statuses)
+
+	// the overall deadline is set by the center
+	s.ProfileTimeout = 200 * time.Millisecond
+	resp, err := http.Get(ts.URL + CoverProfileAPI + "?force=true")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "succeeded=1,timeout=1,failed=0", resp.Header.Get(ProfileReportHeader))
+
+	_, err = client.Profile(ProfileParam{Timeout: "forever"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid timeout")
+}
+
+func TestCollectProfilesConcurrency(t *testing.T) {
+	var running, peak int32
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 1"))
+	}))
+	defer agent.Close()
+
+	s := &server{Store: NewMemoryStore(), MaxConcurrency: 2}
+	var addrs []string
+	names := map[string]string{}
+	for i := 0; i < 6; i++ {
+		// distinct addresses of the same agent
+		addr := agent.URL + "/" + string(rune('a'+i))
+		addrs = append(addrs, addr)
+		names[addr] = "foo"
+	}
+
+	profiles, reports := s.collectProfiles(context.Background(), addrs, names, time.Second, "")
+	assert.Equal(t, len(addrs), len(profiles))
+	for i, r := range reports {
+		assert.Equal(t, addrs[i], r.Address)
+		assert.Equal(t, CollectSucceeded, r.Status, r.Error)
+		assert.NotNil(t, profiles[i])
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak))
+}
+
+func TestProfileForwardsFilters(t *testing.T) {
+	var queries []url.Values
+	var mu sync.Mutex
+	// the agent sends all the files, as the agents not supporting the query do
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		mu.Unlock()
+		_, _ = w.Write([]byte("mode: count\n" +
+			"github.com/qiniu/goc/cmd/server.go:1.1,2.2 1 1\n" +
+			"github.com/qiniu/goc/pkg/cover/server.go:1.1,2.2 1 1\n" +
+			"github.com/qiniu/goc/pkg/cover/server_test.go:1.1,2.2 1 1\n"))
+	}))
+	defer agent.Close()
+	s := &server{Store: NewMemoryStore()}
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: agent.URL}))
+	router := s.Route(os.Stdout)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", CoverProfileAPI+"?package=github.com/qiniu/goc/pkg&skipfile=_test.go$", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mode: count\ngithub.com/qiniu/goc/pkg/cover/server.go:1.1,2.2 1 1\n", w.Body.String())
+	assert.Equal(t, []url.Values{{"package": {"github.com/qiniu/goc/pkg"}, "skipfile": {"_test.go$"}}}, queries)
+	// a part of the profile is not cached
+	_, ok := s.profiles.get(agent.URL)
+	assert.False(t, ok)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", CoverProfileAPI, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, queries[1])
+	cached, ok := s.profiles.get(agent.URL)
+	assert.True(t, ok)
+	assert.Equal(t, 3, len(cached.profile))
+}
+
+func TestAgentQuery(t *testing.T) {
+	assert.Equal(t, "", agentQuery(ProfileParam{Service: []string{"foo"}}))
+	assert.Equal(t, "?coverfile=%5Ea%2F&package=a%2Fb&skipfile=_test.go%24",
+		agentQuery(ProfileParam{CoverFilePatterns: []string{"^a/"}, SkipFilePatterns: []string{"_test.go$"}, Packages: []string{"a/b"}}))
+}
@@ -0,0 +1,214 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"golang.org/x/tools/cover"
+)
+
+const (
+	// CoverBlocksAPI of the agents lists the blocks of the binary, once for its build hash
+	CoverBlocksAPI = "/v1/cover/blocks"
+	// CoverCountersAPI of the agents sends the counters only, as uvarints in the order of the blocks
+	CoverCountersAPI = "/v1/cover/counters"
+	// BuildHashHeader identifies the blocks the counters are of
+	BuildHashHeader = "X-Goc-Build-Hash"
+
+	// maxBlockMetas is the number of builds whose blocks are kept
+	maxBlockMetas = 64
+)
+
+// errCountersUnsupported is returned for the agents built before the counters API
+var errCountersUnsupported = errors.New("counters API not supported")
+
+// blockMeta lists the blocks of every file of a build, as the agents send it
+type blockMeta struct {
+	Hash  string       `json:"hash"`
+	Mode  string       `json:"mode"`
+	Files []fileBlocks `json:"files"`
+}
+
+// fileBlocks are the start line, start column, end line, end column and statements of the blocks of a file
+type fileBlocks struct {
+	Name   string   `json:"name"`
+	Blocks [][5]int `json:"blocks"`
+}
+
+// blockCache keeps the blocks of the builds by their hashes, and the addresses not supporting
+// the counters API, which are collected in the text format. The zero value is ready to use.
+type blockCache struct {
+	mu     sync.Mutex
+	metas  map[string]*cachedBlocks
+	legacy map[string]bool // by address
+	// clock orders the uses of the blocks
+	clock uint64
+}
+
+type cachedBlocks struct {
+	meta *blockMeta
+	used uint64
+}
+
+func (bc *blockCache) get(hash string) (*blockMeta, bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	c, ok := bc.metas[hash]
+	if !ok {
+		return nil, false
+	}
+	bc.clock++
+	c.used = bc.clock
+	return c.meta, true
+}
+
+// put keeps the blocks of the build, dropping the ones least recently used beyond maxBlockMetas
+func (bc *blockCache) put(meta *blockMeta) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.metas == nil {
+		bc.metas = make(map[string]*cachedBlocks)
+	}
+	bc.clock++
+	bc.metas[meta.Hash] = &cachedBlocks{meta: meta, used: bc.clock}
+	for len(bc.metas) > maxBlockMetas {
+		var oldest string
+		for hash, c := range bc.metas {
+			if oldest == "" || c.used < bc.metas[oldest].used {
+				oldest = hash
+			}
+		}
+		delete(bc.metas, oldest)
+	}
+}
+
+func (bc *blockCache) isLegacy(addr string) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.legacy[addr]
+}
+
+func (bc *blockCache) setLegacy(addr string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.legacy == nil {
+		bc.legacy = make(map[string]bool)
+	}
+	bc.legacy[addr] = true
+}
+
+// forget is called when the address registers, as it may run another binary
+func (bc *blockCache) forget(addr string) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	delete(bc.legacy, addr)
+}
+
+func (bc *blockCache) reset() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.metas = nil
+	bc.legacy = nil
+}
+
+// scrapeCounters gets the counters from the address, and the blocks too if the build is new to the center
+func (s *server) scrapeCounters(ctx context.Context, client *http.Client, addr, token string) ([]*cover.Profile, error) {
+	hash, counters, err := getAgent(ctx, client, addr+CoverCountersAPI, token)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := s.blocks.get(hash)
+	if !ok {
+		metaHash, body, err := getAgent(ctx, client, addr+CoverBlocksAPI, token)
+		if err != nil {
+			return nil, err
+		}
+		meta = &blockMeta{}
+		if err := json.Unmarshal(body, meta); err != nil {
+			return nil, fmt.Errorf("invalid blocks of %s, err: %v", addr, err)
+		}
+		// the service restarted with another binary in between
+		if metaHash != hash || meta.Hash != hash {
+			return nil, fmt.Errorf("the build of %s changed while collecting, %s vs %s", addr, hash, meta.Hash)
+		}
+		s.blocks.put(meta)
+	}
+	return decodeCounters(meta, counters)
+}
+
+// getAgent gets the API of the agent, with the build hash of the response
+func getAgent(ctx context.Context, client *http.Client, u, token string) (string, []byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	setToken(req, token)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil, errCountersUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("%s", body)
+	}
+	hash := resp.Header.Get(BuildHashHeader)
+	if hash == "" {
+		return "", nil, errCountersUnsupported
+	}
+	return hash, body, nil
+}
+
+// decodeCounters rebuilds the profile from the blocks of the build and the counters in their order
+func decodeCounters(meta *blockMeta, counters []byte) ([]*cover.Profile, error) {
+	r := bytes.NewReader(counters)
+	profiles := make([]*cover.Profile, 0, len(meta.Files))
+	for _, f := range meta.Files {
+		p := &cover.Profile{FileName: f.Name, Mode: meta.Mode, Blocks: make([]cover.ProfileBlock, 0, len(f.Blocks))}
+		for _, b := range f.Blocks {
+			count, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, fmt.Errorf("fewer counters than the blocks of build %s", meta.Hash)
+			}
+			p.Blocks = append(p.Blocks, cover.ProfileBlock{
+				StartLine: b[0], StartCol: b[1], EndLine: b[2], EndCol: b[3], NumStmt: b[4], Count: int(count),
+			})
+		}
+		profiles = append(profiles, p)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("more counters than the blocks of build %s", meta.Hash)
+	}
+	// sorted as the profiles parsed from the text format
+	return mergeProfiles([][]*cover.Profile{profiles})
+}
@@ -0,0 +1,148 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testBlocks = &blockMeta{
+	Hash: "h1",
+	Mode: "count",
+	Files: []fileBlocks{
+		{Name: "b.go", Blocks: [][5]int{{3, 1, 4, 2, 1}, {1, 1, 2, 2, 2}}},
+		{Name: "a.go", Blocks: [][5]int{{1, 1, 2, 2, 3}}},
+	},
+}
+
+func uvarints(values ...uint64) []byte {
+	var res []byte
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, v := range values {
+		n := binary.PutUvarint(buf, v)
+		res = append(res, buf[:n]...)
+	}
+	return res
+}
+
+func TestDecodeCounters(t *testing.T) {
+	profiles, err := decodeCounters(testBlocks, uvarints(1, 300, 0))
+	assert.NoError(t, err)
+	expected, err := ParseProfile(strings.NewReader("mode: count\n" +
+		"b.go:3.1,4.2 1 1\nb.go:1.1,2.2 2 300\n" +
+		"a.go:1.1,2.2 3 0\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, profiles)
+
+	_, err = decodeCounters(testBlocks, uvarints(1, 300))
+	assert.Error(t, err)
+	_, err = decodeCounters(testBlocks, uvarints(1, 300, 0, 4))
+	assert.Error(t, err)
+}
+
+func TestBlockCache(t *testing.T) {
+	var bc blockCache
+	for i := 0; i <= maxBlockMetas; i++ {
+		bc.put(&blockMeta{Hash: strconv.Itoa(i)})
+		// the first one is kept in use
+		_, ok := bc.get("0")
+		assert.True(t, ok)
+	}
+	_, ok := bc.get("1")
+	assert.False(t, ok)
+	_, ok = bc.get(strconv.Itoa(maxBlockMetas))
+	assert.True(t, ok)
+
+	bc.setLegacy("http://127.0.0.1:8000")
+	assert.True(t, bc.isLegacy("http://127.0.0.1:8000"))
+	bc.forget("http://127.0.0.1:8000")
+	assert.False(t, bc.isLegacy("http://127.0.0.1:8000"))
+}
+
+func TestScrapeCounters(t *testing.T) {
+	var blocksCalls, countersCalls int32
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(BuildHashHeader, testBlocks.Hash)
+		switch r.URL.Path {
+		case CoverBlocksAPI:
+			atomic.AddInt32(&blocksCalls, 1)
+			_ = json.NewEncoder(w).Encode(testBlocks)
+		case CoverCountersAPI:
+			n := atomic.AddInt32(&countersCalls, 1)
+			// the center accepts the compressed counters
+			assert.Contains(t, r.Header.Get("Accept-Encoding"), "gzip")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write(uvarints(uint64(n), 0, 1))
+			_ = gz.Close()
+		default:
+			t.Errorf("unexpected request of %s", r.URL.Path)
+		}
+	}))
+	defer agent.Close()
+
+	s := &server{Store: NewMemoryStore()}
+	for i := 1; i <= 2; i++ {
+		profiles, err := s.scrape(context.Background(), agent.URL, "")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(profiles))
+		assert.Equal(t, "b.go", profiles[1].FileName)
+		assert.Equal(t, 0, profiles[1].Blocks[0].Count)
+		assert.Equal(t, i, profiles[1].Blocks[1].Count)
+	}
+	// the blocks are only got once for the build
+	assert.Equal(t, int32(1), atomic.LoadInt32(&blocksCalls))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&countersCalls))
+	assert.False(t, s.blocks.isLegacy(agent.URL))
+}
+
+func TestScrapeLegacyAgent(t *testing.T) {
+	var countersCalls int32
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != CoverProfileAPI {
+			atomic.AddInt32(&countersCalls, 1)
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("mode: count\na.go:1.1,2.2 3 1\n"))
+	}))
+	defer agent.Close()
+
+	s := &server{Store: NewMemoryStore()}
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		profiles, err := s.scrape(ctx, agent.URL, "")
+		cancel()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, profiles[0].Blocks[0].Count)
+	}
+	// the counters API is only tried once for the address
+	assert.Equal(t, int32(1), atomic.LoadInt32(&countersCalls))
+	assert.True(t, s.blocks.isLegacy(agent.URL))
+}
@@ -24,7 +24,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
@@ -38,6 +37,7 @@ import (
 
 	"github.com/qiniu/goc/pkg/cover/internal/tool"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/tools/cover"
 )
 
 var (
@@ -53,6 +53,19 @@ type TestCover struct {
 	AgentPort                string
 	Center                   string // cover profile host center
 	Singleton                bool
+	PushInterval             string // interval to push profile to the center, empty or 0 disables push mode
+	CoverDir                 string // directory the profile is written into, empty disables the offline mode
+	CoverDirInterval         string // interval to write the profile into CoverDir, empty or 0 only writes it on exit
+	AgentDisabled            bool   // the kill switch, the service starts without listening and registering
+	StartPaused              bool   // the counts are excluded from the coverage until the counting is resumed
+	Tunnel                   bool   // keep an outbound tunnel to the center for it to reach the service
+	Labels                   string // labels registered to the center, in the form of k1=v1,k2=v2
+	AgentToken               string // sent to the center, required by the service in singleton mode, empty requires none
+	AgentReadToken           string // only allowed to get the coverage and the profile of the service
+	TLSCert                  string // PEM of the certificate to serve over https, plain http if empty
+	TLSKey                   string // PEM of the key of TLSCert
+	TLSClientCA              string // PEM of the CA the clients are required to present a certificate signed by
+	CenterCA                 string // PEM of the CA pinned to contact the center over https
 	MainPkgCover             *PackageCover
 	DepsCover                []*PackageCover
 	CacheCover               map[string]*PackageCover
@@ -141,6 +154,20 @@ type CoverInfo struct {
 	AgentPort                string
 	Center                   string
 	Singleton                bool
+	PushInterval             string
+	CoverDir                 string
+	CoverDirInterval         string
+	CountersDir              string // directory of the memory-mapped counters file, empty keeps the counters in memory
+	AgentDisabled            bool
+	StartPaused              bool
+	Tunnel                   bool
+	Labels                   string
+	AgentToken               string
+	AgentReadToken           string
+	TLSCert                  string
+	TLSKey                   string
+	TLSClientCA              string
+	CenterCA                 string
 }
 
 //Execute inject cover variables for all the .go files in the target folder
@@ -153,7 +180,23 @@ func Execute(coverInfo *CoverInfo) error {
 	agentPort := coverInfo.AgentPort
 	center := coverInfo.Center
 	singleton := coverInfo.Singleton
+	pushInterval := coverInfo.PushInterval
+	coverDir := coverInfo.CoverDir
+	coverDirInterval := coverInfo.CoverDirInterval
+	agentDisabled := coverInfo.AgentDisabled
+	startPaused := coverInfo.StartPaused
+	tunnel := coverInfo.Tunnel
+	labels := coverInfo.Labels
+	agentToken := coverInfo.AgentToken
+	agentReadToken := coverInfo.AgentReadToken
+	tlsCert := coverInfo.TLSCert
+	tlsKey := coverInfo.TLSKey
+	tlsClientCA := coverInfo.TLSClientCA
+	centerCA := coverInfo.CenterCA
 	globalCoverVarImportPath := coverInfo.GlobalCoverVarImportPath
+	mmap := coverInfo.CountersDir != ""
+	// the profile is only written when main returns into the directory set at build time
+	mainHook := coverDir != ""
 
 	if coverInfo.IsMod {
 		globalCoverVarImportPath = filepath.Join(coverInfo.ModRootPath, globalCoverVarImportPath)
@@ -183,7 +226,7 @@ func Execute(coverInfo *CoverInfo) error {
 		if pkg.Name == "main" {
 			log.Printf("handle package: %v", pkg.ImportPath)
 			// inject the main package
-			mainCover, mainDecl := AddCounters(pkg, mode, globalCoverVarImportPath)
+			mainCover, mainDecl := AddCounters(pkg, mode, globalCoverVarImportPath, mmap, mainHook)
 			allDecl += mainDecl
 			// new a testcover for this service
 			tc := TestCover{
@@ -191,6 +234,19 @@ func Execute(coverInfo *CoverInfo) error {
 				AgentPort:                agentPort,
 				Center:                   center,
 				Singleton:                singleton,
+				PushInterval:             pushInterval,
+				CoverDir:                 coverDir,
+				CoverDirInterval:         coverDirInterval,
+				AgentDisabled:            agentDisabled,
+				StartPaused:              startPaused,
+				Tunnel:                   tunnel,
+				Labels:                   labels,
+				AgentToken:               agentToken,
+				AgentReadToken:           agentReadToken,
+				TLSCert:                  tlsCert,
+				TLSKey:                   tlsKey,
+				TLSClientCA:              tlsClientCA,
+				CenterCA:                 centerCA,
 				MainPkgCover:             mainCover,
 				GlobalCoverVarImportPath: globalCoverVarImportPath,
 			}
@@ -206,7 +262,7 @@ func Execute(coverInfo *CoverInfo) error {
 
 				//only focus package neither standard Go library nor dependency library
 				if depPkg, ok := pkgs[dep]; ok {
-					packageCover, depDecl := AddCounters(depPkg, mode, globalCoverVarImportPath)
+					packageCover, depDecl := AddCounters(depPkg, mode, globalCoverVarImportPath, mmap, false)
 					allDecl += depDecl
 					tc.DepsCover = append(tc.DepsCover, packageCover)
 					seen[dep] = packageCover
@@ -271,12 +327,18 @@ func ListPackages(dir string, args string, newgopath string) (map[string]*Packag
 // 1. only inject covervar++ into source file
 // 2. no declarartions for these covervars
 // 3. return the declarations as string
-func AddCounters(pkg *Package, mode string, globalCoverVarImportPath string) (*PackageCover, string) {
+// 4. if mmap, register the counters to be placed in the memory-mapped file
+// 5. if mainHook, defer the hook of goc in the function main
+func AddCounters(pkg *Package, mode string, globalCoverVarImportPath string, mmap bool, mainHook bool) (*PackageCover, string) {
 	coverVarMap := declareCoverVars(pkg)
 
 	decl := ""
 	for file, coverVar := range coverVarMap {
-		decl += "\n" + tool.Annotate(path.Join(pkg.Dir, file), mode, coverVar.Var, globalCoverVarImportPath) + "\n"
+		decl += "\n" + tool.Annotate(path.Join(pkg.Dir, file), mode, coverVar.Var, globalCoverVarImportPath, mmap, mainHook) + "\n"
+		if mmap {
+			decl += fmt.Sprintf("var _ = registerCounters(%q, unsafe.Pointer(&%s.Count), %s.Pos[:], %s.NumStmt[:])\n",
+				coverVar.File, coverVar.Var, coverVar.Var, coverVar.Var)
+		}
 	}
 
 	return &PackageCover{
@@ -449,14 +511,38 @@ func CovList(f io.Reader) (g CoverageList, err error) {
 	return
 }
 
+// PackageCovList summarizes the profiles by package, the Coverage is named by the import path
+func PackageCovList(profiles []*cover.Profile) (g CoverageList) {
+	g = NewCoverageList()
+	index := make(map[string]int)
+	for _, p := range profiles {
+		name := path.Dir(p.FileName)
+		i, ok := index[name]
+		if !ok {
+			i = len(g)
+			index[name] = i
+			g.append(newCoverage(name))
+		}
+		for _, b := range p.Blocks {
+			g[i].NAllStmts += b.NumStmt
+			if b.Count > 0 {
+				g[i].NCoveredStmts += b.NumStmt
+			}
+		}
+	}
+	g.Sort()
+	return
+}
+
 // ReadFileToCoverList coverts profile file to CoverageList struct
 func ReadFileToCoverList(path string) (g CoverageList, err error) {
-	f, err := ioutil.ReadFile(path)
+	f, err := os.Open(path)
 	if err != nil {
 		logrus.Errorf("Open file %s failed!", path)
 		return nil, err
 	}
-	g, err = CovList(bytes.NewReader(f))
+	defer f.Close()
+	g, err = CovList(f)
 	return
 }
 
@@ -0,0 +1,253 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DashboardPath serves the web UI of the center
+const DashboardPath = "/dashboard"
+
+// dashboard serves the web UI, which only calls the APIs of the center from the browser.
+// The page itself holds no data, so it is served without a token, and the token entered
+// in the page is sent with the API calls.
+// GET /dashboard
+func (s *server) dashboard(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(dashboardPage))
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>goc center</title>
+<style>
+body { margin: 0; font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 14px; color: #24292e; }
+header { display: flex; align-items: center; gap: 16px; padding: 10px 20px; background: #24292e; color: #fff; }
+header h1 { font-size: 18px; margin: 0; flex: 1; }
+header input[type=password] { width: 220px; }
+main { padding: 10px 20px; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 20px; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #e1e4e8; vertical-align: top; }
+th { background: #f6f8fa; }
+tr.service td { background: #fafbfc; font-weight: bold; }
+button { cursor: pointer; }
+.healthy { color: #22863a; }
+.unhealthy, .dead { color: #cb2431; }
+.pct { font-family: Menlo, monospace; }
+.bar { display: inline-block; width: 80px; height: 8px; background: #cb2431; vertical-align: middle; margin-right: 6px; }
+.bar span { display: block; height: 100%; background: #2cbe4e; }
+#error { color: #cb2431; white-space: pre-wrap; }
+#detail h2 { font-size: 16px; }
+a { color: #0366d6; text-decoration: none; cursor: pointer; }
+</style>
+</head>
+<body>
+<header>
+<h1>goc center <span id="total" class="pct"></span></h1>
+<label><input type="checkbox" id="auto" checked> refresh every 10s</label>
+<button id="refresh">refresh</button>
+<input type="password" id="token" placeholder="token">
+</header>
+<main>
+<div id="error"></div>
+<table>
+<thead><tr><th>Service</th><th>Address</th><th>Health</th><th>Last Heartbeat</th><th>Labels</th><th>Coverage</th><th></th></tr></thead>
+<tbody id="services"></tbody>
+</table>
+<div id="detail"></div>
+</main>
+<script>
+(function () {
+  var tokenInput = document.getElementById('token');
+  tokenInput.value = sessionStorage.getItem('goc-token') || '';
+  tokenInput.onchange = function () {
+    sessionStorage.setItem('goc-token', tokenInput.value);
+    refresh();
+  };
+
+  function esc(s) {
+    return String(s).replace(/[&<>"']/g, function (c) {
+      return { '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c];
+    });
+  }
+
+  function call(method, url, body) {
+    var headers = {};
+    if (tokenInput.value) {
+      headers['Authorization'] = 'Bearer ' + tokenInput.value;
+    }
+    if (body) {
+      headers['Content-Type'] = 'application/json';
+    }
+    return fetch(url, { method: method, headers: headers, body: body ? JSON.stringify(body) : undefined }).then(function (res) {
+      return res.text().then(function (text) {
+        if (!res.ok) {
+          var msg = text;
+          try { msg = JSON.parse(text).error || text; } catch (e) {}
+          throw new Error(method + ' ' + url + ': ' + res.status + ' ' + msg);
+        }
+        return text;
+      });
+    });
+  }
+
+  function showError(err) {
+    document.getElementById('error').textContent = err ? err.message : '';
+  }
+
+  function query(params) {
+    return Object.keys(params).map(function (k) {
+      return encodeURIComponent(k) + '=' + encodeURIComponent(params[k]);
+    }).join('&');
+  }
+
+  function coverage(params) {
+    params.format = 'json';
+    params.force = 'true';
+    return call('GET', '/v1/cover/profile?' + query(params)).then(JSON.parse);
+  }
+
+  function pct(covered, statements) {
+    if (!statements) {
+      return '<span class="pct">-</span>';
+    }
+    var p = 100 * covered / statements;
+    return '<span class="bar"><span style="width:' + p.toFixed(1) + '%"></span></span><span class="pct">' + p.toFixed(1) + '%</span>';
+  }
+
+  function refresh() {
+    showError(null);
+    call('GET', '/v1/cover/list?detail=true').then(JSON.parse).then(function (statuses) {
+      var byName = {};
+      statuses.forEach(function (st) {
+        (byName[st.name] = byName[st.name] || []).push(st);
+      });
+      var rows = [];
+      Object.keys(byName).sort().forEach(function (name) {
+        rows.push('<tr class="service"><td><a data-detail="' + esc(name) + '">' + esc(name) + '</a></td><td></td><td></td><td></td><td></td>' +
+          '<td data-coverage="' + esc(name) + '">...</td>' +
+          '<td><button data-clear-service="' + esc(name) + '">clear</button></td></tr>');
+        byName[name].forEach(function (st) {
+          var labels = Object.keys(st.labels || {}).sort().map(function (k) { return k + '=' + st.labels[k]; }).join(',');
+          var last = st.lastHeartbeat && st.lastHeartbeat.indexOf('0001-') !== 0 ? new Date(st.lastHeartbeat).toLocaleString() : '-';
+          rows.push('<tr><td></td><td>' + esc(st.address) + '</td><td class="' + esc(st.health) + '">' + esc(st.health) + '</td>' +
+            '<td>' + esc(last) + '</td><td>' + esc(labels) + '</td><td></td>' +
+            '<td><button data-clear-address="' + esc(st.address) + '">clear</button> ' +
+            '<button data-remove-address="' + esc(st.address) + '">remove</button></td></tr>');
+        });
+      });
+      document.getElementById('services').innerHTML = rows.join('') || '<tr><td colspan="7">no services registered</td></tr>';
+      Object.keys(byName).forEach(function (name) {
+        var cell = document.querySelector('[data-coverage="' + CSS.escape(name) + '"]');
+        coverage({ service: name }).then(function (p) {
+          cell.innerHTML = pct(p.covered, p.statements);
+        }, function () {
+          cell.innerHTML = '<span class="pct">-</span>';
+        });
+      });
+    }).catch(showError);
+    coverage({}).then(function (p) {
+      document.getElementById('total').innerHTML = pct(p.covered, p.statements);
+    }, function () {
+      document.getElementById('total').innerHTML = '';
+    });
+    if (current) {
+      detail(current);
+    }
+  }
+
+  // the drill-down into the packages and the files of a service
+  var current = null;
+  function detail(name) {
+    current = name;
+    coverage({ service: name }).then(function (p) {
+      var pkgs = {};
+      p.files.forEach(function (f) {
+        var pkg = pkgs[f.package] = pkgs[f.package] || { statements: 0, covered: 0, files: [] };
+        pkg.statements += f.statements;
+        pkg.covered += f.covered;
+        pkg.files.push(f);
+      });
+      var html = ['<h2>' + esc(name) + ' ' + pct(p.covered, p.statements) + ' <a data-source="">annotated source</a> <a data-close="">close</a></h2>',
+        '<table><thead><tr><th>Package / File</th><th>Statements</th><th>Coverage</th></tr></thead><tbody>'];
+      Object.keys(pkgs).sort().forEach(function (pkgName) {
+        var pkg = pkgs[pkgName];
+        html.push('<tr class="service"><td>' + esc(pkgName) + '</td><td>' + pkg.statements + '</td><td>' + pct(pkg.covered, pkg.statements) + '</td></tr>');
+        pkg.files.forEach(function (f) {
+          html.push('<tr><td>&nbsp;&nbsp;<a data-source="' + esc(f.importPath) + '">' + esc(f.importPath) + '</a></td><td>' + f.statements + '</td><td>' + pct(f.covered, f.statements) + '</td></tr>');
+        });
+      });
+      html.push('</tbody></table>');
+      document.getElementById('detail').innerHTML = html.join('');
+    }).catch(showError);
+  }
+
+  // source opens the source of the service annotated with the coverage, of the file if given
+  function source(file) {
+    var params = { service: current, force: 'true' };
+    if (file) {
+      params.coverfile = '^' + file.replace(/[.*+?^${}()|[\]\\]/g, '\\$&') + '$';
+    }
+    var win = window.open('', '_blank');
+    call('GET', '/v1/cover/html?' + query(params)).then(function (page) {
+      win.location = URL.createObjectURL(new Blob([page], { type: 'text/html' }));
+    }).catch(function (err) {
+      win.close();
+      showError(err);
+    });
+  }
+
+  function confirmed(action, body, message) {
+    if (!confirm(message)) {
+      return;
+    }
+    call('POST', action, body).then(refresh).catch(showError);
+  }
+
+  document.body.addEventListener('click', function (e) {
+    var t = e.target, d = t.dataset;
+    if (d.detail !== undefined) {
+      detail(d.detail);
+    } else if (d.source !== undefined) {
+      source(d.source);
+    } else if (d.close !== undefined) {
+      current = null;
+      document.getElementById('detail').innerHTML = '';
+    } else if (d.clearService !== undefined) {
+      confirmed('/v1/cover/clear', { service: [d.clearService] }, 'Clear the coverage counters of all the addresses of ' + d.clearService + '?');
+    } else if (d.clearAddress !== undefined) {
+      confirmed('/v1/cover/clear', { address: [d.clearAddress] }, 'Clear the coverage counters of ' + d.clearAddress + '?');
+    } else if (d.removeAddress !== undefined) {
+      confirmed('/v1/cover/remove', { address: [d.removeAddress] }, 'Remove ' + d.removeAddress + ' from the center?');
+    }
+  });
+  document.getElementById('refresh').onclick = refresh;
+  setInterval(function () {
+    if (document.getElementById('auto').checked) {
+      refresh();
+    }
+  }, 10000);
+  refresh();
+})();
+</script>
+</body>
+</html>
+`
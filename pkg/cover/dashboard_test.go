@@ -0,0 +1,48 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboard(t *testing.T) {
+	s := &server{Store: NewMemoryStore(), ReadTokens: []string{"r"}}
+	router := s.Route(os.Stdout)
+
+	// the page is served without a token, but the apis it calls are not
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", DashboardPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/html")
+	for _, api := range []string{CoverServicesListAPI, CoverProfileAPI, CoverHTMLAPI, CoverProfileClearAPI, CoverServicesRemoveAPI} {
+		assert.Contains(t, w.Body.String(), "'"+api)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", CoverServicesListAPI, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, DashboardPath, w.Header().Get("Location"))
+}
@@ -0,0 +1,405 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/cover"
+	"k8s.io/test-infra/gopherage/pkg/cov"
+)
+
+// The formats a profile can be exported in
+const (
+	// FormatText is the text format of go test -coverprofile
+	FormatText = "text"
+	// FormatCobertura is the Cobertura XML read by Jenkins and GitLab
+	FormatCobertura = "cobertura"
+	// FormatLCOV is the LCOV tracefile
+	FormatLCOV = "lcov"
+	// FormatSonar is the generic test coverage XML of SonarQube
+	FormatSonar = "sonar"
+	// FormatJSON is the structured JSON described by JSONProfile
+	FormatJSON = "json"
+)
+
+// formatContentTypes are the media types of the formats, the first of a format is the one responded
+var formatContentTypes = []struct {
+	format      string
+	contentType string
+}{
+	{FormatText, "text/plain"},
+	{FormatCobertura, "application/vnd.cobertura+xml"},
+	{FormatCobertura, "application/xml"},
+	{FormatCobertura, "text/xml"},
+	{FormatLCOV, "text/x-lcov"},
+	{FormatLCOV, "application/x-lcov"},
+	{FormatSonar, "application/vnd.sonar.generic-coverage+xml"},
+	{FormatJSON, "application/json"},
+}
+
+// FormatFromAccept returns the format of the first media type in the Accept header
+// that a profile can be exported in, the empty string if there is none
+func FormatFromAccept(accept string) string {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		for _, ct := range formatContentTypes {
+			if strings.EqualFold(mediaType, ct.contentType) {
+				return ct.format
+			}
+		}
+	}
+	return ""
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case "", FormatText, FormatCobertura, FormatLCOV, FormatSonar, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, should be one of text, cobertura, lcov, sonar and json", format)
+}
+
+// ContentType returns the media type responded for the format
+func ContentType(format string) string {
+	for _, ct := range formatContentTypes {
+		if ct.format == format {
+			return ct.contentType + "; charset=utf-8"
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// PathMapping maps the files under an import path to a path relative to the repository root,
+// e.g. "github.com/qiniu/goc=." maps github.com/qiniu/goc/pkg/cover/cover.go to pkg/cover/cover.go
+type PathMapping struct {
+	ImportPath string
+	Path       string
+}
+
+// ParsePathMappings parses the mappings in the form of "importpath=path"
+func ParsePathMappings(mappings []string) ([]PathMapping, error) {
+	res := make([]PathMapping, 0, len(mappings))
+	for _, m := range mappings {
+		kv := strings.SplitN(m, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid path mapping %q, should be importpath=path", m)
+		}
+		res = append(res, PathMapping{ImportPath: strings.Trim(strings.TrimSpace(kv[0]), "/"), Path: strings.TrimSpace(kv[1])})
+	}
+	// the longest import path takes precedence
+	sort.SliceStable(res, func(i, j int) bool { return len(res[i].ImportPath) > len(res[j].ImportPath) })
+	return res, nil
+}
+
+// mapPath returns the path of the file in the repository, the file itself if no mapping matches
+func mapPath(file string, mappings []PathMapping) string {
+	for _, m := range mappings {
+		if file == m.ImportPath || strings.HasPrefix(file, m.ImportPath+"/") {
+			return path.Join(m.Path, strings.TrimPrefix(file, m.ImportPath))
+		}
+	}
+	return file
+}
+
+// Export writes the profiles in the format, the files are mapped by the mappings except in the text format
+func Export(w io.Writer, format string, profiles []*cover.Profile, mappings []PathMapping) error {
+	bw := bufio.NewWriter(w)
+	var err error
+	switch format {
+	case "", FormatText:
+		err = cov.DumpProfile(profiles, bw)
+	case FormatCobertura:
+		err = exportCobertura(bw, profiles, mappings, time.Now())
+	case FormatLCOV:
+		err = exportLCOV(bw, profiles, mappings)
+	case FormatSonar:
+		err = exportSonar(bw, profiles, mappings)
+	case FormatJSON:
+		err = exportJSON(bw, profiles, mappings)
+	default:
+		return checkFormat(format)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// lineHits is the number of times a line of source is executed
+type lineHits struct {
+	line  int
+	count int
+}
+
+// fileLines returns the lines covered by the blocks of the profile in order,
+// a line shared by several blocks is counted by the one executed most
+func fileLines(p *cover.Profile) []lineHits {
+	counts := make(map[int]int)
+	for _, b := range p.Blocks {
+		for line := b.StartLine; line <= b.EndLine; line++ {
+			if c, ok := counts[line]; !ok || b.Count > c {
+				counts[line] = b.Count
+			}
+		}
+	}
+	res := make([]lineHits, 0, len(counts))
+	for line, count := range counts {
+		res = append(res, lineHits{line: line, count: count})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].line < res[j].line })
+	return res
+}
+
+// statements counts the statements and the covered ones of the profile
+func statements(p *cover.Profile) (total, covered int) {
+	for _, b := range p.Blocks {
+		total += b.NumStmt
+		if b.Count > 0 {
+			covered += b.NumStmt
+		}
+	}
+	return
+}
+
+func ratio(covered, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(covered) / float64(total)
+}
+
+func exportLCOV(w io.Writer, profiles []*cover.Profile, mappings []PathMapping) error {
+	for _, p := range profiles {
+		if _, err := fmt.Fprintf(w, "TN:\nSF:%s\n", mapPath(p.FileName, mappings)); err != nil {
+			return err
+		}
+		lines := fileLines(p)
+		hit := 0
+		for _, l := range lines {
+			if l.count > 0 {
+				hit++
+			}
+			if _, err := fmt.Fprintf(w, "DA:%d,%d\n", l.line, l.count); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sonarCoverage struct {
+	XMLName xml.Name    `xml:"coverage"`
+	Version int         `xml:"version,attr"`
+	Files   []sonarFile `xml:"file"`
+}
+
+type sonarFile struct {
+	Path  string      `xml:"path,attr"`
+	Lines []sonarLine `xml:"lineToCover"`
+}
+
+type sonarLine struct {
+	LineNumber int  `xml:"lineNumber,attr"`
+	Covered    bool `xml:"covered,attr"`
+}
+
+func exportSonar(w io.Writer, profiles []*cover.Profile, mappings []PathMapping) error {
+	c := sonarCoverage{Version: 1}
+	for _, p := range profiles {
+		f := sonarFile{Path: mapPath(p.FileName, mappings)}
+		for _, l := range fileLines(p) {
+			f.Lines = append(f.Lines, sonarLine{LineNumber: l.line, Covered: l.count > 0})
+		}
+		c.Files = append(c.Files, f)
+	}
+	return writeXML(w, "", c)
+}
+
+type coberturaCoverage struct {
+	XMLName         xml.Name           `xml:"coverage"`
+	LineRate        float64            `xml:"line-rate,attr"`
+	BranchRate      float64            `xml:"branch-rate,attr"`
+	LinesCovered    int                `xml:"lines-covered,attr"`
+	LinesValid      int                `xml:"lines-valid,attr"`
+	BranchesCovered int                `xml:"branches-covered,attr"`
+	BranchesValid   int                `xml:"branches-valid,attr"`
+	Complexity      float64            `xml:"complexity,attr"`
+	Version         string             `xml:"version,attr"`
+	Timestamp       int64              `xml:"timestamp,attr"`
+	Sources         []string           `xml:"sources>source"`
+	Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   float64          `xml:"line-rate,attr"`
+	BranchRate float64          `xml:"branch-rate,attr"`
+	Complexity float64          `xml:"complexity,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+	Name       string          `xml:"name,attr"`
+	Filename   string          `xml:"filename,attr"`
+	LineRate   float64         `xml:"line-rate,attr"`
+	BranchRate float64         `xml:"branch-rate,attr"`
+	Complexity float64         `xml:"complexity,attr"`
+	Methods    struct{}        `xml:"methods"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number int `xml:"number,attr"`
+	Hits   int `xml:"hits,attr"`
+}
+
+const coberturaDoctype = `<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">`
+
+func exportCobertura(w io.Writer, profiles []*cover.Profile, mappings []PathMapping, now time.Time) error {
+	c := coberturaCoverage{Timestamp: now.UnixNano() / int64(time.Millisecond), Sources: []string{"."}}
+	// the packages are named by their import paths, in order as the profiles are sorted by file
+	pkgs := make(map[string]int)
+	pkgLines := make(map[string][2]int)
+	for _, p := range profiles {
+		pkg := path.Dir(p.FileName)
+		i, ok := pkgs[pkg]
+		if !ok {
+			i = len(c.Packages)
+			pkgs[pkg] = i
+			c.Packages = append(c.Packages, coberturaPackage{Name: pkg})
+		}
+
+		class := coberturaClass{Name: path.Base(p.FileName), Filename: mapPath(p.FileName, mappings)}
+		hit := 0
+		lines := fileLines(p)
+		for _, l := range lines {
+			if l.count > 0 {
+				hit++
+			}
+			class.Lines = append(class.Lines, coberturaLine{Number: l.line, Hits: l.count})
+		}
+		class.LineRate = ratio(hit, len(lines))
+		c.Packages[i].Classes = append(c.Packages[i].Classes, class)
+
+		counts := pkgLines[pkg]
+		pkgLines[pkg] = [2]int{counts[0] + hit, counts[1] + len(lines)}
+		c.LinesCovered += hit
+		c.LinesValid += len(lines)
+	}
+	for i := range c.Packages {
+		counts := pkgLines[c.Packages[i].Name]
+		c.Packages[i].LineRate = ratio(counts[0], counts[1])
+	}
+	c.LineRate = ratio(c.LinesCovered, c.LinesValid)
+	return writeXML(w, coberturaDoctype, c)
+}
+
+func writeXML(w io.Writer, doctype string, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	if doctype != "" {
+		if _, err := io.WriteString(w, doctype+"\n"); err != nil {
+			return err
+		}
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// JSONProfile is the profile exported in the json format
+type JSONProfile struct {
+	Mode string `json:"mode"`
+	// Statements and Covered count the statements of all the files
+	Statements int        `json:"statements"`
+	Covered    int        `json:"covered"`
+	Coverage   float64    `json:"coverage"`
+	Files      []JSONFile `json:"files"`
+}
+
+// JSONFile is the coverage of a source file
+type JSONFile struct {
+	// ImportPath is the file as in the text format, Path is where it is in the repository
+	ImportPath string      `json:"importPath"`
+	Path       string      `json:"path"`
+	Package    string      `json:"package"`
+	Statements int         `json:"statements"`
+	Covered    int         `json:"covered"`
+	Coverage   float64     `json:"coverage"`
+	Blocks     []JSONBlock `json:"blocks"`
+}
+
+// JSONBlock is a code block and the number of times it is executed
+type JSONBlock struct {
+	StartLine int `json:"startLine"`
+	StartCol  int `json:"startCol"`
+	EndLine   int `json:"endLine"`
+	EndCol    int `json:"endCol"`
+	NumStmt   int `json:"numStmt"`
+	Count     int `json:"count"`
+}
+
+func exportJSON(w io.Writer, profiles []*cover.Profile, mappings []PathMapping) error {
+	res := JSONProfile{Files: make([]JSONFile, 0, len(profiles))}
+	for _, p := range profiles {
+		res.Mode = p.Mode
+		f := newJSONFile(p, mappings)
+		res.Files = append(res.Files, f)
+		res.Statements += f.Statements
+		res.Covered += f.Covered
+	}
+	res.Coverage = ratio(res.Covered, res.Statements)
+	return json.NewEncoder(w).Encode(res)
+}
+
+func newJSONFile(p *cover.Profile, mappings []PathMapping) JSONFile {
+	total, covered := statements(p)
+	f := JSONFile{
+		ImportPath: p.FileName,
+		Path:       mapPath(p.FileName, mappings),
+		Package:    path.Dir(p.FileName),
+		Statements: total,
+		Covered:    covered,
+		Coverage:   ratio(covered, total),
+		Blocks:     make([]JSONBlock, 0, len(p.Blocks)),
+	}
+	for _, b := range p.Blocks {
+		f.Blocks = append(f.Blocks, JSONBlock{
+			StartLine: b.StartLine, StartCol: b.StartCol,
+			EndLine: b.EndLine, EndCol: b.EndCol,
+			NumStmt: b.NumStmt, Count: b.Count,
+		})
+	}
+	return f
+}
@@ -0,0 +1,137 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const exportProfile = `mode: count
+github.com/qiniu/goc/pkg/cover/a.go:3.10,5.2 2 1
+github.com/qiniu/goc/pkg/cover/a.go:5.2,7.3 1 0
+github.com/qiniu/goc/pkg/cover/a.go:9.1,9.20 1 4
+github.com/qiniu/goc/cmd/b.go:1.1,2.2 3 0
+`
+
+func TestExportFormats(t *testing.T) {
+	profiles, err := ParseProfile(strings.NewReader(exportProfile))
+	assert.NoError(t, err)
+	mappings, err := ParsePathMappings([]string{"github.com/qiniu/goc=.", "github.com/qiniu/goc/cmd=tools/cmd"})
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, Export(&buf, FormatLCOV, profiles, mappings))
+	assert.Equal(t, `TN:
+SF:tools/cmd/b.go
+DA:1,0
+DA:2,0
+LF:2
+LH:0
+end_of_record
+TN:
+SF:pkg/cover/a.go
+DA:3,1
+DA:4,1
+DA:5,1
+DA:6,0
+DA:7,0
+DA:9,4
+LF:6
+LH:4
+end_of_record
+`, buf.String())
+
+	buf.Reset()
+	assert.NoError(t, Export(&buf, FormatSonar, profiles, mappings))
+	assert.Contains(t, buf.String(), `<file path="pkg/cover/a.go">`)
+	assert.Contains(t, buf.String(), `<lineToCover lineNumber="6" covered="false"></lineToCover>`)
+	assert.Contains(t, buf.String(), `<lineToCover lineNumber="9" covered="true"></lineToCover>`)
+
+	buf.Reset()
+	assert.NoError(t, exportCobertura(&buf, profiles, mappings, time.Unix(1, 0)))
+	var cobertura coberturaCoverage
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &cobertura))
+	assert.Equal(t, 4, cobertura.LinesCovered)
+	assert.Equal(t, 8, cobertura.LinesValid)
+	assert.Equal(t, int64(1000), cobertura.Timestamp)
+	assert.Equal(t, 2, len(cobertura.Packages))
+	assert.Equal(t, "github.com/qiniu/goc/cmd", cobertura.Packages[0].Name)
+	assert.Equal(t, "tools/cmd/b.go", cobertura.Packages[0].Classes[0].Filename)
+	assert.Equal(t, float64(4)/6, cobertura.Packages[1].LineRate)
+
+	buf.Reset()
+	assert.NoError(t, Export(&buf, FormatJSON, profiles, nil))
+	var res JSONProfile
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &res))
+	assert.Equal(t, "count", res.Mode)
+	assert.Equal(t, 7, res.Statements)
+	assert.Equal(t, 3, res.Covered)
+	assert.Equal(t, "github.com/qiniu/goc/pkg/cover/a.go", res.Files[1].Path)
+	assert.Equal(t, "github.com/qiniu/goc/pkg/cover", res.Files[1].Package)
+	assert.Equal(t, 3, len(res.Files[1].Blocks))
+
+	buf.Reset()
+	assert.NoError(t, Export(&buf, FormatText, profiles, mappings))
+	assert.Contains(t, buf.String(), "github.com/qiniu/goc/cmd/b.go:1.1,2.2 3 0")
+
+	assert.Error(t, Export(&buf, "html", profiles, nil))
+	_, err = ParsePathMappings([]string{"github.com/qiniu/goc"})
+	assert.Error(t, err)
+}
+
+func TestFormatFromAccept(t *testing.T) {
+	assert.Equal(t, FormatJSON, FormatFromAccept("application/json"))
+	assert.Equal(t, FormatCobertura, FormatFromAccept("text/html, application/xml;q=0.9"))
+	assert.Equal(t, FormatLCOV, FormatFromAccept("text/x-lcov"))
+	assert.Equal(t, FormatSonar, FormatFromAccept("application/vnd.sonar.generic-coverage+xml"))
+	assert.Equal(t, "", FormatFromAccept("*/*"))
+	assert.Equal(t, "application/json; charset=utf-8", ContentType(FormatJSON))
+}
+
+func TestProfileFormat(t *testing.T) {
+	_, center, closeCenter := newCenterWithAgent(t, "foo", exportProfile)
+	defer closeCenter()
+
+	res, err := NewWorker(center.URL).Profile(ProfileParam{Format: FormatLCOV, PathMappings: []string{"github.com/qiniu/goc=."}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "SF:pkg/cover/a.go\n")
+
+	_, err = NewWorker(center.URL).Profile(ProfileParam{Format: "html"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown format")
+
+	req, err := http.NewRequest("GET", center.URL+CoverProfileAPI, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "application/xml")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/vnd.cobertura+xml; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), `filename="github.com/qiniu/goc/pkg/cover/a.go"`)
+}
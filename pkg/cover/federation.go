@@ -0,0 +1,108 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/cover"
+)
+
+// FailedCenterHeader is set on the profile response once for every upstream center failed
+const FailedCenterHeader = "X-Goc-Failed-Center"
+
+// CenterError is the failure of a center in a federated query
+type CenterError struct {
+	Center string `json:"center"`
+	Error  string `json:"error"`
+}
+
+func (e CenterError) String() string {
+	return fmt.Sprintf("%s: %s", e.Center, e.Error)
+}
+
+// FederatedProfile gets the profiles from all the centers concurrently and merges them.
+// The centers failing are reported, and skipped if param.Force is set, otherwise the query fails.
+// A center having no service matching the param is not a failure, nil is returned if none has.
+// The options configure the workers querying the centers, e.g. WithToken and WithTLSConfig.
+func FederatedProfile(centers []string, param ProfileParam, opts ...WorkerOption) ([]*cover.Profile, []CenterError, error) {
+	// the centers queried only answer with their own services
+	param.Federated = true
+	param.Report = false
+	// the profiles are merged in the text format, and exported by the caller
+	param.Format, param.PathMappings = "", nil
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		profiles = make([][]*cover.Profile, 0, len(centers))
+		failures []CenterError
+	)
+	for _, center := range centers {
+		wg.Add(1)
+		go func(center string) {
+			defer wg.Done()
+			profile, err := centerProfile(center, param, opts)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, CenterError{Center: center, Error: err.Error()})
+				return
+			}
+			if len(profile) > 0 {
+				profiles = append(profiles, profile)
+			}
+		}(center)
+	}
+	wg.Wait()
+
+	if len(failures) > 0 && !param.Force {
+		msgs := make([]string, 0, len(failures))
+		for _, f := range failures {
+			msgs = append(msgs, f.String())
+		}
+		return nil, failures, fmt.Errorf("failed to get profile from centers: %s", strings.Join(msgs, "; "))
+	}
+	if len(profiles) == 0 {
+		return nil, failures, nil
+	}
+
+	merged, err := mergeProfiles(profiles)
+	if err != nil {
+		return nil, failures, err
+	}
+	return merged, failures, nil
+}
+
+func centerProfile(center string, param ProfileParam, opts []WorkerOption) ([]*cover.Profile, error) {
+	// NewWorker exits on invalid address
+	if _, err := url.ParseRequestURI(center); err != nil {
+		return nil, err
+	}
+	res, err := NewWorker(center, opts...).Profile(param)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return ParseProfile(bytes.NewReader(res))
+}
@@ -0,0 +1,108 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/test-infra/gopherage/pkg/cov"
+)
+
+func newCenterWithAgent(t *testing.T, name, profile string) (*server, *httptest.Server, func()) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(profile))
+	}))
+	s := &server{Store: NewMemoryStore()}
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: name, Address: agent.URL}))
+	center := httptest.NewServer(s.Route(os.Stdout))
+	return s, center, func() {
+		center.Close()
+		agent.Close()
+	}
+}
+
+func TestFederatedProfile(t *testing.T) {
+	_, staging, closeStaging := newCenterWithAgent(t, "foo", "mode: count\nmockService/main.go:30.13,48.33 13 1")
+	defer closeStaging()
+	_, perf, closePerf := newCenterWithAgent(t, "bar", "mode: count\nmockService/main.go:30.13,48.33 13 2")
+	defer closePerf()
+	deadCenter := "http://127.0.0.1:64447"
+
+	merged, failures, err := FederatedProfile([]string{staging.URL, perf.URL}, ProfileParam{})
+	assert.NoError(t, err)
+	assert.Empty(t, failures)
+	var buf bytes.Buffer
+	assert.NoError(t, cov.DumpProfile(merged, &buf))
+	assert.Contains(t, buf.String(), "mockService/main.go:30.13,48.33 13 3")
+
+	// the service is only registered in one center
+	merged, _, err = FederatedProfile([]string{staging.URL, perf.URL}, ProfileParam{Service: []string{"bar"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, merged[0].Blocks[0].Count)
+
+	merged, _, err = FederatedProfile([]string{staging.URL}, ProfileParam{Service: []string{"bar"}})
+	assert.NoError(t, err)
+	assert.Nil(t, merged)
+
+	// the centers failed are reported
+	_, failures, err = FederatedProfile([]string{staging.URL, deadCenter}, ProfileParam{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(failures))
+	assert.Equal(t, deadCenter, failures[0].Center)
+
+	merged, failures, err = FederatedProfile([]string{staging.URL, deadCenter}, ProfileParam{Force: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(failures))
+	assert.Equal(t, 1, merged[0].Blocks[0].Count)
+}
+
+func TestProfileWithUpstreams(t *testing.T) {
+	_, staging, closeStaging := newCenterWithAgent(t, "foo", "mode: count\nmockService/main.go:30.13,48.33 13 1")
+	defer closeStaging()
+	org, center, closeOrg := newCenterWithAgent(t, "bar", "mode: count\nmockService/main.go:30.13,48.33 13 2")
+	defer closeOrg()
+	org.Upstreams = []string{staging.URL}
+
+	res, err := NewWorker(center.URL).Profile(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 3")
+
+	// the service only registered upstream
+	res, err = NewWorker(center.URL).Profile(ProfileParam{Service: []string{"foo"}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 1")
+
+	// the upstream failed is reported in the header
+	org.Upstreams = []string{staging.URL, "http://127.0.0.1:64447"}
+	body, _ := json.Marshal(ProfileParam{Force: true})
+	resp, err := http.Post(center.URL+CoverProfileAPI, "application/json", bytes.NewReader(body))
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, len(resp.Header[FailedCenterHeader]))
+
+	_, err = NewWorker(center.URL).Profile(ProfileParam{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "http://127.0.0.1:64447")
+}
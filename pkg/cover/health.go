@@ -0,0 +1,317 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HealthUnknown means the center has not heard from the address since it started
+	HealthUnknown = "unknown"
+	// HealthHealthy means the address sent a heartbeat or answered a probe within the TTL
+	HealthHealthy = "healthy"
+	// HealthUnhealthy means the address missed its heartbeats and failed the probe
+	HealthUnhealthy = "unhealthy"
+)
+
+// probeTimeout bounds a single liveness probe against a registered address
+const probeTimeout = 5 * time.Second
+
+// ServiceStatus describes the liveness of a registered address
+type ServiceStatus struct {
+	Name          string            `json:"name"`
+	Address       string            `json:"address"`
+	Health        string            `json:"health"`
+	LastHeartbeat time.Time         `json:"lastHeartbeat"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+type agentStatus struct {
+	health        string
+	lastSeen      time.Time // last heartbeat or successful probe
+	lastHeartbeat time.Time // last heartbeat sent by the agent itself
+}
+
+// agentTracker records when each registered address was last seen alive.
+// The zero value is ready to use.
+type agentTracker struct {
+	mu     sync.Mutex
+	agents map[string]*agentStatus
+}
+
+// observe returns the status of the address, starting to track it from now if unknown
+func (t *agentTracker) observe(addr string, now time.Time) agentStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.agents == nil {
+		t.agents = make(map[string]*agentStatus)
+	}
+	st, ok := t.agents[addr]
+	if !ok {
+		st = &agentStatus{health: HealthUnknown, lastSeen: now}
+		t.agents[addr] = st
+	}
+	return *st
+}
+
+// status returns the status of the address without tracking it
+func (t *agentTracker) status(addr string) agentStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if st, ok := t.agents[addr]; ok {
+		return *st
+	}
+	return agentStatus{health: HealthUnknown}
+}
+
+// heartbeat records a heartbeat sent by the agent at the given address
+func (t *agentTracker) heartbeat(addr string, now time.Time) {
+	t.alive(addr, now)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.agents[addr].lastHeartbeat = now
+}
+
+// alive marks the address healthy
+func (t *agentTracker) alive(addr string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.agents == nil {
+		t.agents = make(map[string]*agentStatus)
+	}
+	st, ok := t.agents[addr]
+	if !ok {
+		st = &agentStatus{}
+		t.agents[addr] = st
+	}
+	st.health = HealthHealthy
+	st.lastSeen = now
+}
+
+func (t *agentTracker) markUnhealthy(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if st, ok := t.agents[addr]; ok {
+		st.health = HealthUnhealthy
+	}
+}
+
+func (t *agentTracker) isUnhealthy(addr string) bool {
+	return t.status(addr).health == HealthUnhealthy
+}
+
+func (t *agentTracker) forget(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.agents, addr)
+}
+
+// retain drops the addresses which are not registered anymore
+func (t *agentTracker) retain(registered map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr := range t.agents {
+		if !registered[addr] {
+			delete(t.agents, addr)
+		}
+	}
+}
+
+func (t *agentTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.agents = nil
+}
+
+// watchLiveness checks the registered addresses periodically until the process exits
+func (s *server) watchLiveness() {
+	interval := s.HeartbeatTTL / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		s.checkLiveness(now)
+	}
+}
+
+// checkLiveness probes every address which has been silent for longer than the TTL,
+// the ones failing the probe are marked unhealthy or evicted from the store
+func (s *server) checkLiveness(now time.Time) {
+	registered := make(map[string]bool)
+	for name, addrs := range s.Store.GetAll() {
+		for _, addr := range addrs {
+			registered[addr] = true
+			st := s.agents.observe(addr, now)
+			if now.Sub(st.lastSeen) < s.HeartbeatTTL {
+				continue
+			}
+
+			// a service polling its tunnel is alive
+			if s.tunnels.connected(addr) {
+				s.agents.alive(addr, now)
+				s.persistHealth(addr)
+				continue
+			}
+			err := s.probe(addr)
+			if err == nil {
+				s.agents.alive(addr, now)
+				s.persistHealth(addr)
+				continue
+			}
+
+			log.Warnf("service %s at %s missed its heartbeats and failed the probe, err: %v", name, addr, err)
+			s.agents.markUnhealthy(addr)
+			s.persistHealth(addr)
+			if !s.EvictUnhealthy {
+				continue
+			}
+			if err := s.Store.Remove(addr); err != nil {
+				log.Errorf("failed to evict %s from the store, err: %v", addr, err)
+				continue
+			}
+			log.Infof("service %s at %s evicted from the center", name, addr)
+			s.metrics.forget(addr)
+			s.agentTokens.forget(addr)
+			s.tunnels.forget(addr)
+			s.bury(addr)
+			delete(registered, addr)
+		}
+	}
+	s.agents.retain(registered)
+}
+
+// persistHealth saves the liveness of the address if the store keeps records
+func (s *server) persistHealth(addr string) {
+	rs, ok := s.Store.(RecordStore)
+	if !ok {
+		return
+	}
+	st := s.agents.status(addr)
+	if err := rs.UpdateHealth(addr, st.health, st.lastHeartbeat); err != nil {
+		log.Warnf("failed to persist the health of %s, err: %v", addr, err)
+	}
+}
+
+// restore loads the liveness and the tombstones persisted before the center restarted,
+// the TTL of every address starts over from now
+func (s *server) restore(rs RecordStore, now time.Time) error {
+	records, err := rs.Records()
+	if err != nil {
+		return err
+	}
+	s.agents.mu.Lock()
+	s.agents.agents = make(map[string]*agentStatus)
+	for _, r := range records {
+		health := r.Health
+		if health == "" {
+			health = HealthUnknown
+		}
+		s.agents.agents[r.Address] = &agentStatus{health: health, lastSeen: now, lastHeartbeat: r.LastHeartbeat}
+	}
+	s.agents.mu.Unlock()
+	for _, r := range records {
+		if r.Labels != nil {
+			s.labels.set(r.Address, r.Labels)
+		}
+	}
+
+	tombstones, err := rs.Tombstones()
+	if err != nil {
+		return err
+	}
+	for _, t := range tombstones {
+		s.entomb(t)
+	}
+
+	if ss, ok := rs.(SessionStore); ok {
+		sessions, err := ss.Sessions()
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if err := s.sessions.restore(session); err != nil {
+				log.Warnf("drop the invalid session %s, err: %v", session.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// entomb restores the persisted or replicated tombstone
+func (s *server) entomb(t Tombstone) {
+	if t.Dropped {
+		s.profiles.unbury(t.Address)
+		return
+	}
+	profile, err := ParseProfile(strings.NewReader(t.Profile))
+	if err != nil {
+		log.Warnf("drop the invalid tombstone of %s, err: %v", t.Address, err)
+		return
+	}
+	s.profiles.entomb(&cachedProfile{name: t.Name, address: t.Address, profile: profile, collected: t.Collected})
+}
+
+// probe checks whether the agent at the given address still answers
+func (s *server) probe(addr string) error {
+	req, err := http.NewRequest("GET", addr+CoverCoverageAPI, nil)
+	if err != nil {
+		return err
+	}
+	setToken(req, s.agentTokens.key(addr))
+	client := &http.Client{Timeout: probeTimeout, Transport: s.transport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// serviceStatuses returns the liveness of all the registered addresses, ordered by name and address
+func (s *server) serviceStatuses() []ServiceStatus {
+	statuses := make([]ServiceStatus, 0)
+	for name, addrs := range s.Store.GetAll() {
+		for _, addr := range addrs {
+			st := s.agents.status(addr)
+			statuses = append(statuses, ServiceStatus{
+				Name:          name,
+				Address:       addr,
+				Health:        st.health,
+				LastHeartbeat: st.lastHeartbeat,
+				Labels:        s.labels.get(addr),
+			})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Name != statuses[j].Name {
+			return statuses[i].Name < statuses[j].Name
+		}
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
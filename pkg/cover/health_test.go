@@ -0,0 +1,144 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentTracker(t *testing.T) {
+	var tracker agentTracker
+	now := time.Now()
+
+	assert.Equal(t, HealthUnknown, tracker.status("http://127.0.0.1:8000").health)
+	st := tracker.observe("http://127.0.0.1:8000", now)
+	assert.Equal(t, HealthUnknown, st.health)
+	assert.Equal(t, now, st.lastSeen)
+	assert.True(t, st.lastHeartbeat.IsZero())
+
+	later := now.Add(time.Minute)
+	tracker.heartbeat("http://127.0.0.1:8000", later)
+	st = tracker.status("http://127.0.0.1:8000")
+	assert.Equal(t, HealthHealthy, st.health)
+	assert.Equal(t, later, st.lastHeartbeat)
+
+	tracker.markUnhealthy("http://127.0.0.1:8000")
+	assert.True(t, tracker.isUnhealthy("http://127.0.0.1:8000"))
+
+	tracker.alive("http://127.0.0.1:8001", now)
+	tracker.retain(map[string]bool{"http://127.0.0.1:8001": true})
+	assert.Equal(t, HealthUnknown, tracker.status("http://127.0.0.1:8000").health)
+	assert.Equal(t, HealthHealthy, tracker.status("http://127.0.0.1:8001").health)
+
+	tracker.reset()
+	assert.Equal(t, HealthUnknown, tracker.status("http://127.0.0.1:8001").health)
+}
+
+func TestCheckLiveness(t *testing.T) {
+	aliveSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, CoverCoverageAPI, r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer aliveSvr.Close()
+	deadAddr := "http://127.0.0.1:64446"
+
+	tcs := []struct {
+		name       string
+		evict      bool
+		registered map[string][]string
+	}{
+		{
+			name:       "mark unhealthy",
+			evict:      false,
+			registered: map[string][]string{"foo": {aliveSvr.URL, deadAddr}},
+		},
+		{
+			name:       "evict unhealthy",
+			evict:      true,
+			registered: map[string][]string{"foo": {aliveSvr.URL}},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &server{
+				Store:          NewMemoryStore(),
+				HeartbeatTTL:   time.Minute,
+				EvictUnhealthy: tc.evict,
+			}
+			assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: aliveSvr.URL}))
+			assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: deadAddr}))
+
+			// within the ttl, nothing is probed
+			now := time.Now()
+			s.checkLiveness(now)
+			assert.Equal(t, HealthUnknown, s.agents.status(deadAddr).health)
+
+			s.checkLiveness(now.Add(2 * time.Minute))
+			assert.Equal(t, tc.registered, s.Store.GetAll())
+			assert.Equal(t, HealthHealthy, s.agents.status(aliveSvr.URL).health)
+			assert.Equal(t, !tc.evict, s.agents.isUnhealthy(deadAddr))
+		})
+	}
+}
+
+func TestHeartbeatService(t *testing.T) {
+	s := &server{
+		Store: NewMemoryStore(),
+	}
+	router := s.Route(os.Stdout)
+
+	// heartbeat with invalid address
+	data := url.Values{}
+	data.Set("name", "foo")
+	data.Set("address", "http://127.0.0.1")
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/cover/heartbeat", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// heartbeat from a service unknown to the center registers it again
+	data.Set("address", "http://:64444") // the real IP is empty in unittest
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/cover/heartbeat", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"http://:64444"}, s.Store.Get("foo"))
+
+	// list the liveness of services
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v1/cover/list?detail=true", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var statuses []ServiceStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+	assert.Equal(t, 1, len(statuses))
+	assert.Equal(t, "foo", statuses[0].Name)
+	assert.Equal(t, HealthHealthy, statuses[0].Health)
+	assert.False(t, statuses[0].LastHeartbeat.IsZero())
+}
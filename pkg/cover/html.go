@@ -0,0 +1,230 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/tools/cover"
+)
+
+// htmlFile is a source file in the html report
+type htmlFile struct {
+	ID       string
+	Coverage Coverage
+	// Body is the annotated source, Error tells why the source is not found
+	Body  template.HTML
+	Error string
+}
+
+// htmlPackage is a package in the html report, named by its import path
+type htmlPackage struct {
+	Coverage Coverage
+	Files    []*htmlFile
+}
+
+type htmlReport struct {
+	Mode     string
+	Total    Coverage
+	Packages []*htmlPackage
+}
+
+// RenderHTML renders the profiles as a single html page, in which the files are grouped by
+// package and annotated like 'go tool cover -html', the hit count of a block is shown on
+// hover unless in set mode. The files whose source is not found are still listed.
+func RenderHTML(w io.Writer, profiles []*cover.Profile, source SourceFunc) error {
+	report := &htmlReport{Total: Coverage{FileName: "total"}}
+	pkgs := make(map[string]*htmlPackage)
+	for i, p := range profiles {
+		report.Mode = p.Mode
+		f := &htmlFile{ID: fmt.Sprintf("file%d", i), Coverage: fileCoverage(p)}
+		if src, err := source(p.FileName); err != nil {
+			f.Error = err.Error()
+		} else {
+			f.Body = annotate(src, p)
+		}
+
+		name := path.Dir(p.FileName)
+		pkg := pkgs[name]
+		if pkg == nil {
+			pkg = &htmlPackage{Coverage: Coverage{FileName: name}}
+			pkgs[name] = pkg
+			report.Packages = append(report.Packages, pkg)
+		}
+		pkg.Files = append(pkg.Files, f)
+		pkg.Coverage.NAllStmts += f.Coverage.NAllStmts
+		pkg.Coverage.NCoveredStmts += f.Coverage.NCoveredStmts
+		report.Total.NAllStmts += f.Coverage.NAllStmts
+		report.Total.NCoveredStmts += f.Coverage.NCoveredStmts
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		return report.Packages[i].Coverage.FileName < report.Packages[j].Coverage.FileName
+	})
+	return htmlTemplate.Execute(w, report)
+}
+
+// fileCoverage counts the statements of a file
+func fileCoverage(p *cover.Profile) Coverage {
+	c := Coverage{FileName: p.FileName}
+	for _, b := range p.Blocks {
+		c.NAllStmts += b.NumStmt
+		if b.Count > 0 {
+			c.NCoveredStmts += b.NumStmt
+		}
+	}
+	return c
+}
+
+// annotate escapes the source and wraps every block in a span colored by its hit count,
+// the blocks beyond the source, which is not the one built, are ignored
+func annotate(src []byte, p *cover.Profile) template.HTML {
+	var buf bytes.Buffer
+	boundaries := p.Boundaries(src)
+	open := 0
+	for i := 0; i <= len(src); i++ {
+		for len(boundaries) > 0 && boundaries[0].Offset == i {
+			b := boundaries[0]
+			boundaries = boundaries[1:]
+			if !b.Start {
+				if open > 0 {
+					buf.WriteString("</span>")
+					open--
+				}
+				continue
+			}
+			n := 0
+			if b.Count > 0 {
+				n = int(math.Floor(b.Norm*9)) + 1
+			}
+			if p.Mode == "set" {
+				fmt.Fprintf(&buf, `<span class="cov%d">`, n)
+			} else {
+				fmt.Fprintf(&buf, `<span class="cov%d" title="%d">`, n, b.Count)
+			}
+			open++
+		}
+		if i == len(src) {
+			break
+		}
+		switch c := src[i]; c {
+		case '>':
+			buf.WriteString("&gt;")
+		case '<':
+			buf.WriteString("&lt;")
+		case '&':
+			buf.WriteString("&amp;")
+		case '"':
+			buf.WriteString("&#34;")
+		case '\'':
+			buf.WriteString("&#39;")
+		case '\t':
+			buf.WriteString("        ")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	for ; open > 0; open-- {
+		buf.WriteString("</span>")
+	}
+	return template.HTML(buf.String())
+}
+
+// covColor is the color of a block, red for not covered and from gray to green as
+// the hit count grows, the same as 'go tool cover -html'
+func covColor(n int) string {
+	if n == 0 {
+		return "rgb(192, 0, 0)"
+	}
+	return fmt.Sprintf("rgb(%d, %d, %d)", 128-12*(n-1), 128+12*(n-1), 128+3*(n-1))
+}
+
+// html renders the merged profile as the annotated source.
+// GET /v1/cover/html?service=xxx
+func (s *server) html(c *gin.Context) {
+	var body ProfileParam
+	if err := c.ShouldBind(&body); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	merged, _, ok := s.mergedProfile(c, body)
+	if !ok {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := RenderHTML(&buf, merged, SourceLookup(s.SourceRoot, s.SourceDir)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
+
+var htmlTemplate = template.Must(template.New("html").Funcs(template.FuncMap{
+	"colors": func() []int { return []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10} },
+	"color":  func(n int) template.CSS { return template.CSS(covColor(n)) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>goc coverage {{.Total.Percentage}}</title>
+<style>
+body { margin: 0; background: black; color: rgb(80, 80, 80); font-family: Menlo, monospace; font-size: 13px; }
+a { color: rgb(200, 200, 200); text-decoration: none; }
+#nav { position: fixed; top: 0; bottom: 0; left: 0; width: 360px; overflow: auto; padding: 10px; border-right: 1px solid rgb(60, 60, 60); }
+#nav summary { color: rgb(200, 200, 200); cursor: pointer; white-space: nowrap; }
+#nav ul { margin: 4px 0; padding-left: 16px; list-style: none; }
+#nav li { white-space: nowrap; }
+#content { margin-left: 390px; padding: 10px; }
+.pct { color: rgb(128, 128, 128); }
+.file h2 { color: rgb(200, 200, 200); font-size: 14px; border-bottom: 1px solid rgb(60, 60, 60); }
+.missing { color: rgb(192, 0, 0); }
+pre { margin: 0; }
+{{range colors}}.cov{{.}} { color: {{color .}}; }
+{{end}}
+</style>
+</head>
+<body>
+<div id="nav">
+<div>total: {{.Total.Percentage}} of {{.Total.NAllStmts}} statements, mode: {{.Mode}}</div>
+{{range .Packages}}<details>
+<summary>{{.Coverage.FileName}} <span class="pct">{{.Coverage.Percentage}}</span></summary>
+<ul>
+{{range .Files}}<li><a href="#{{.ID}}">{{.Coverage.FileName}}</a> <span class="pct">{{.Coverage.Percentage}}</span></li>
+{{end}}</ul>
+</details>
+{{end}}<div>
+<span class="cov0">not covered</span>
+{{if ne .Mode "set"}}<span class="cov1">low hits</span> <span class="cov10">high hits</span>{{else}}<span class="cov10">covered</span>{{end}}
+</div>
+</div>
+<div id="content">
+{{range .Packages}}{{range .Files}}<div class="file" id="{{.ID}}">
+<h2>{{.Coverage.FileName}} <span class="pct">{{.Coverage.Percentage}}</span></h2>
+{{if .Error}}<p class="missing">source not found: {{.Error}}</p>{{else}}<pre>{{.Body}}</pre>{{end}}
+</div>
+{{end}}{{end}}</div>
+</body>
+</html>
+`))
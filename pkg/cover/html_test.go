@@ -0,0 +1,80 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const htmlSource = `package main
+
+func main() {
+	if 1 < 2 {
+		println("a")
+	}
+}
+`
+
+const htmlProfile = `mode: count
+example.com/foo/main.go:3.13,4.11 1 5
+example.com/foo/main.go:4.11,6.3 1 0
+example.com/foo/pkg/b.go:1.1,2.2 2 1
+`
+
+func TestRenderHTML(t *testing.T) {
+	profiles, err := ParseProfile(strings.NewReader(htmlProfile))
+	assert.NoError(t, err)
+	source := func(file string) ([]byte, error) {
+		if file == "example.com/foo/main.go" {
+			return []byte(htmlSource), nil
+		}
+		return nil, fmt.Errorf("no source of %s", file)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, RenderHTML(&buf, profiles, source))
+	page := buf.String()
+	// the packages with their coverage in the navigation
+	assert.Contains(t, page, `<summary>example.com/foo <span class="pct">50.0%</span></summary>`)
+	assert.Contains(t, page, `<summary>example.com/foo/pkg <span class="pct">100.0%</span></summary>`)
+	assert.Contains(t, page, `total: 75.0% of 4 statements, mode: count`)
+	// the blocks with the hit counts, and the source escaped
+	assert.Contains(t, page, `<span class="cov10" title="5">{`+"\n        if 1 &lt; 2 </span>")
+	assert.Contains(t, page, `<span class="cov0" title="0">{`)
+	assert.Contains(t, page, `source not found: no source of example.com/foo/pkg/b.go`)
+
+	// no hit counts in set mode
+	profiles, err = ParseProfile(strings.NewReader(strings.Replace(htmlProfile, "count", "set", 1)))
+	assert.NoError(t, err)
+	buf.Reset()
+	assert.NoError(t, RenderHTML(&buf, profiles, source))
+	assert.NotContains(t, buf.String(), `title="`)
+}
+
+func TestAnnotateStaleSource(t *testing.T) {
+	profiles, err := ParseProfile(strings.NewReader("mode: count\nmain.go:3.10,3.12 1 1\nmain.go:5.1,9.2 1 0\n"))
+	assert.NoError(t, err)
+	// the source changed since built, the blocks beyond it are ignored
+	body := string(annotate([]byte("package main\n\nfunc a() {}\n"), profiles[0]))
+	assert.Equal(t, 1, strings.Count(body, "<span"))
+	assert.Equal(t, 1, strings.Count(body, "</span>"))
+}
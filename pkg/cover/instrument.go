@@ -46,6 +46,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -53,23 +61,59 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	_cover {{.GlobalCoverVarImportPath | printf "%q"}}
 
 )
 
 func init() {
+	// the kill switch turns the agent off: no listener, no registration and no dump,
+	// the counters are still counted but never sent
+	disabled := {{.AgentDisabled}}
+	if v := os.Getenv("GOC_DISABLE_AGENT"); v != "" {
+		disabled = v == "true"
+	}
+	if disabled {
+		return
+	}
+	startPaused := {{.StartPaused}}
+	if v := os.Getenv("GOC_START_PAUSED"); v != "" {
+		startPaused = v == "true"
+	}
+	if startPaused {
+		pauseCounting()
+	}
+	// the offline dump starts first, as no center may be reachable at all
+	startCoverDir()
 	go registerHandlers()
 }
 
+// loadValues returns the counters as they were paused if the counting is paused
 func loadValues() (map[string][]uint32, map[string][]testing.CoverBlock) {
+	counters, blocks := liveValues()
+	paused.Lock()
+	defer paused.Unlock()
+	if paused.counters != nil {
+		for name := range counters {
+			counters[name] = paused.counters[name]
+		}
+	}
+	return counters, blocks
+}
+
+func liveValues() (map[string][]uint32, map[string][]testing.CoverBlock) {
 	var (
 		coverCounters = make(map[string][]uint32)
 		coverBlocks   = make(map[string][]testing.CoverBlock)
@@ -111,6 +155,12 @@ func loadFileCover(coverCounters map[string][]uint32, coverBlocks map[string][]t
 }
 
 func clearValues() {
+	// the counters cleared while paused stay cleared on resume
+	paused.Lock()
+	for _, counter := range paused.counters {
+		clearFileCover(counter)
+	}
+	paused.Unlock()
 
 	{{range $i, $pkgCover := .DepsCover}}
 	{{range $file, $cover := $pkgCover.Vars}}
@@ -130,6 +180,46 @@ func clearFileCover(counter []uint32) {
 	}
 }
 
+// paused holds the counters as they were when the counting was paused, nil while counting.
+// The counting can not stop, so the counts made while paused are taken back on resume.
+var paused struct {
+	sync.Mutex
+	counters map[string][]uint32
+}
+
+// pauseCounting returns false if the counting is already paused
+func pauseCounting() bool {
+	paused.Lock()
+	defer paused.Unlock()
+	if paused.counters != nil {
+		return false
+	}
+	counters, _ := liveValues()
+	paused.counters = copyCounters(counters)
+	return true
+}
+
+// resumeCounting takes back the counts made since the pause, it returns false if the counting is not paused
+func resumeCounting() bool {
+	paused.Lock()
+	defer paused.Unlock()
+	if paused.counters == nil {
+		return false
+	}
+	counters, _ := liveValues()
+	for name, counter := range counters {
+		before := paused.counters[name]
+		for i := range counter {
+			// subtracted rather than stored, not to lose the counts made meanwhile
+			if d := atomic.LoadUint32(&counter[i]) - before[i]; d != 0 {
+				atomic.AddUint32(&counter[i], -d)
+			}
+		}
+	}
+	paused.counters = nil
+	return true
+}
+
 func registerHandlers() {
 	{{if .Singleton}}
 	ln, _, err := listen()
@@ -139,13 +229,43 @@ func registerHandlers() {
 	if err != nil {
 		log.Fatalf("listen failed, err:%v", err)
 	}
+	serverTLS := agentTLS()
+	if serverTLS != nil {
+		ln = tls.NewListener(ln, serverTLS)
+	}
+	centerClient = newCenterClient(serverTLS)
 	{{if not .Singleton}}
-	profileAddr := "http://" + host
-	if resp, err := registerSelf(profileAddr); err != nil {
-		log.Fatalf("register address %v failed, err: %v, response: %v", profileAddr, err, string(resp))
+	scheme := "http://"
+	if serverTLS != nil {
+		scheme = "https://"
+	}
+	profileAddr := scheme + host
+	if resp, err := registerSelf("/v1/cover/register", profileAddr); err != nil {
+		if coverDirFile == "" {
+			log.Fatalf("register address %v failed, err: %v, response: %v", profileAddr, err, string(resp))
+		}
+		// the heartbeats register the service once the center is reachable
+		log.Printf("[goc][WARN]register address %v failed, the profile is written into %s, err: %v, response: %v", profileAddr, coverDirFile, err, string(resp))
+	}
+	go heartbeat(profileAddr)
+
+	// in push mode the profile is uploaded to the center periodically and on exit,
+	// for the services the center can not reach
+	pushInterval, _ := time.ParseDuration({{.PushInterval | printf "%q"}})
+	if v := os.Getenv("GOC_PUSH_INTERVAL"); v != "" {
+		pushInterval, _ = time.ParseDuration(v)
+	}
+	if pushInterval > 0 {
+		go pushPeriodically(profileAddr, pushInterval)
 	}
 
 	fn := func() {
+		if pushInterval > 0 {
+			if resp, err := pushProfile(profileAddr); err != nil {
+				log.Printf("[goc][WARN]push profile on exit failed, err: %v, response: %v", err, string(resp))
+			}
+		}
+
 		var (
 			err          error
 			profileAddrs []string
@@ -156,7 +276,7 @@ func registerHandlers() {
 				return
 		}
 		for _, addr := range addresses {
-				profileAddrs = append(profileAddrs, "http://"+addr)
+				profileAddrs = append(profileAddrs, scheme+addr)
 		}
 		deregisterSelf(profileAddrs)
 	}
@@ -184,55 +304,737 @@ func registerHandlers() {
 		fmt.Fprintf(w, "%f", float64(n)/float64(d))
 	})
 
-	// coverprofile reports a coverage profile with the coverage percentage
+	// coverprofile reports a coverage profile with the coverage percentage,
+	// of the files selected by the coverfile and skipfile patterns and the package prefixes if given
 	mux.HandleFunc("/v1/cover/profile", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, "mode: {{.Mode}}\n")
-		counters, blocks := loadValues()
-		var active, total int64
-		var count uint32
-		for name, counts := range counters {
-			block := blocks[name]
-			for i := range counts {
-				stmts := int64(block[i].Stmts)
-				total += stmts
-				count = atomic.LoadUint32(&counts[i]) // For -mode=atomic.
-				if count > 0 {
-					active += stmts
-				}
-				_, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n", name,
-					block[i].Line0, block[i].Col0,
-					block[i].Line1, block[i].Col1,
-					stmts,
-					count)
-				if err != nil {
-					fmt.Fprintf(w, "invalid block format, err: %v", err)
-					return
-				}
-			}
+		match, err := fileFilter(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		if err := writeProfile(w, match); err != nil {
+			fmt.Fprintf(w, "invalid block format, err: %v", err)
+			return
 		}
 	})
 
+	// the blocks never change for a binary, so the center gets them once for the build hash,
+	// and then only the counters in the order of the blocks
+	mux.HandleFunc("/v1/cover/blocks", func(w http.ResponseWriter, r *http.Request) {
+		meta, _ := blockMetadata()
+		w.Header().Set("X-Goc-Build-Hash", meta.Hash)
+		w.Header().Set("Content-Type", "application/json")
+		writeCompressed(w, r, func(out io.Writer) error {
+			return json.NewEncoder(out).Encode(meta)
+		})
+	})
+	mux.HandleFunc("/v1/cover/counters", func(w http.ResponseWriter, r *http.Request) {
+		meta, counters := blockMetadata()
+		w.Header().Set("X-Goc-Build-Hash", meta.Hash)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		writeCompressed(w, r, func(out io.Writer) error {
+			return writeCounterValues(out, counters)
+		})
+	})
+
 	mux.HandleFunc("/v1/cover/clear", func(w http.ResponseWriter, r *http.Request) {
 		clearValues()
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "clear call successfully")
 	})
 
-	log.Fatal(http.Serve(ln, mux))
+	// the counts made while paused are excluded from the coverage, e.g. of warm-up traffic or load tests
+	mux.HandleFunc("/v1/cover/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !pauseCounting() {
+			fmt.Fprintln(w, "counting already paused")
+			return
+		}
+		fmt.Fprintln(w, "counting paused")
+	})
+	mux.HandleFunc("/v1/cover/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !resumeCounting() {
+			fmt.Fprintln(w, "counting not paused")
+			return
+		}
+		fmt.Fprintln(w, "counting resumed")
+	})
+
+	// a trace window attributes the coverage to a single request, see openTrace
+	mux.HandleFunc("/v1/cover/trace/start", startTrace)
+	mux.HandleFunc("/v1/cover/trace/stop", stopTrace)
+	mux.HandleFunc("/v1/cover/trace/", getTrace)
+
+	{{if not .Singleton}}
+	// in tunnel mode the service keeps an outbound connection to the center,
+	// over which the center routes its requests, for the services only allowing outbound connections
+	tunnelEnabled := {{.Tunnel}}
+	if v := os.Getenv("GOC_TUNNEL"); v != "" {
+		tunnelEnabled = v == "true"
+	}
+	if tunnelEnabled {
+		go openTunnel(profileAddr, mux)
+	}
+	{{end}}
+
+	log.Fatal(http.Serve(ln, authorized(mux)))
+}
+
+// centerClient contacts the center
+var centerClient = http.DefaultClient
+
+// readPEM returns the file given by the environment variable, or the PEM built in
+func readPEM(env, builtin string) []byte {
+	if file := os.Getenv(env); file != "" {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatalf("read %s failed, err: %v", file, err)
+		}
+		return pem
+	}
+	return []byte(builtin)
+}
+
+func certPool(pem []byte) *x509.CertPool {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Fatalf("no certificate found in the CA")
+	}
+	return pool
+}
+
+// agentTLS returns the config to serve over https, nil to serve plain http. The certificate, the key and
+// the CA of the clients allowed, e.g. the center, can be overridden by the files given by the
+// GOC_TLS_CERT, GOC_TLS_KEY and GOC_TLS_CLIENT_CA environment variables
+func agentTLS() *tls.Config {
+	cert, key := readPEM("GOC_TLS_CERT", {{.TLSCert | printf "%q"}}), readPEM("GOC_TLS_KEY", {{.TLSKey | printf "%q"}})
+	if len(cert) == 0 && len(key) == 0 {
+		return nil
+	}
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		log.Fatalf("invalid tls certificate, err: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{pair}}
+	if ca := readPEM("GOC_TLS_CLIENT_CA", {{.TLSClientCA | printf "%q"}}); len(ca) > 0 {
+		config.ClientCAs = certPool(ca)
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// newCenterClient returns the client to contact the center over https with the CA pinned, which
+// can be overridden by the file given by the GOC_CENTER_CA environment variable.
+// The certificate of the service is presented to the center requiring the client certificates.
+func newCenterClient(serverTLS *tls.Config) *http.Client {
+	ca := readPEM("GOC_CENTER_CA", {{.CenterCA | printf "%q"}})
+	if len(ca) == 0 && serverTLS == nil {
+		return http.DefaultClient
+	}
+	config := &tls.Config{}
+	if len(ca) > 0 {
+		config.RootCAs = certPool(ca)
+	}
+	if serverTLS != nil {
+		config.Certificates = serverTLS.Certificates
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config}}
+}
+
+// agentToken is sent to the center to register this service with,
+// it can be overridden by the GOC_AGENT_TOKEN environment variable
+func agentToken() string {
+	if v := os.Getenv("GOC_AGENT_TOKEN"); v != "" {
+		return v
+	}
+	return {{.AgentToken | printf "%q"}}
+}
+
+// agentReadToken only allows to get the coverage and the profile of this service,
+// it can be overridden by the GOC_AGENT_READ_TOKEN environment variable
+func agentReadToken() string {
+	if v := os.Getenv("GOC_AGENT_READ_TOKEN"); v != "" {
+		return v
+	}
+	return {{.AgentReadToken | printf "%q"}}
 }
 
-func registerSelf(address string) ([]byte, error) {
+// agentKey is generated at start and sent to the center, which presents it when calling this service,
+// the token built into the service is shared with the others built alike so it is not accepted instead
+var agentKey = newAgentKey()
+
+func newAgentKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("generate the agent key failed, err: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// setToken authorizes the request to the center with the token of this service, and sends its key
+func setToken(req *http.Request) {
+	if token := agentToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("X-Goc-Agent-Key", agentKey)
+}
+
+// authorized rejects the requests without the key of this service,
+// the read token is accepted by the coverage, profile and trace getting handlers only
+func authorized(handler http.Handler) http.Handler {
+	token, readToken := agentToken(), agentReadToken()
+	if token == "" && readToken == "" {
+		return handler
+	}
+	{{if not .Singleton}}
+	// the key is only known to this service and the center it registered to
+	token = agentKey
+	{{end}}
+	matches := func(got, want string) bool {
+		return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+want)) == 1
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("Authorization")
+		if matches(got, token) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if matches(got, readToken) {
+			if r.URL.Path == "/v1/cover/coverage" || r.URL.Path == "/v1/cover/profile" ||
+				r.URL.Path == "/v1/cover/blocks" || r.URL.Path == "/v1/cover/counters" ||
+				r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/cover/trace/") {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, "token of scope write is required", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", ` + "`" + `Bearer realm="goc"` + "`" + `)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+	})
+}
+
+type tunnelRequest struct {
+	ID     string ` + "`" + `json:"id"` + "`" + `
+	Method string ` + "`" + `json:"method"` + "`" + `
+	Path   string ` + "`" + `json:"path"` + "`" + `
+	Body   []byte ` + "`" + `json:"body,omitempty"` + "`" + `
+}
+
+type tunnelResponse struct {
+	ID         string ` + "`" + `json:"id"` + "`" + `
+	StatusCode int    ` + "`" + `json:"statusCode"` + "`" + `
+	Body       []byte ` + "`" + `json:"body,omitempty"` + "`" + `
+}
+
+// tunnelResponseWriter records the response of a request routed over the tunnel
+type tunnelResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *tunnelResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *tunnelResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *tunnelResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+// openTunnel long polls the center for the requests routed to this service,
+// serves them with the handler and replies the results
+func openTunnel(address string, handler http.Handler) {
 	selfName := filepath.Base(os.Args[0])
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/cover/register?name=%s&address=%s", {{.Center | printf "%q"}}, selfName, address), nil)
+	query := fmt.Sprintf("name=%s&address=%s%s", selfName, address, labelsQuery())
+	pollURL := fmt.Sprintf("%s/v1/cover/tunnel?%s", {{.Center | printf "%q"}}, query)
+	// the center only accepts the replies from the service the requests are routed to
+	replyURL := fmt.Sprintf("%s/v1/cover/tunnel/reply?%s", {{.Center | printf "%q"}}, query)
+	client := &http.Client{Timeout: time.Minute, Transport: centerClient.Transport}
+	for {
+		req, err := http.NewRequest("GET", pollURL, nil)
+		if err != nil {
+			log.Fatalf("http.NewRequest failed: %v", err)
+		}
+		setToken(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("[goc][WARN]poll tunnel failed, err: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if resp.StatusCode == http.StatusNoContent {
+			resp.Body.Close()
+			continue
+		}
+
+		var treq tunnelRequest
+		err = json.NewDecoder(resp.Body).Decode(&treq)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			log.Printf("[goc][WARN]poll tunnel failed, response code: %d, err: %v", resp.StatusCode, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go serveTunnelRequest(client, handler, replyURL, treq)
+	}
+}
+
+func serveTunnelRequest(client *http.Client, handler http.Handler, replyURL string, treq tunnelRequest) {
+	req, err := http.NewRequest(treq.Method, treq.Path, bytes.NewReader(treq.Body))
+	if err != nil {
+		log.Printf("[goc][WARN]invalid tunnel request, err: %v", err)
+		return
+	}
+	w := &tunnelResponseWriter{header: make(http.Header)}
+	handler.ServeHTTP(w, req)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	jsonBody, err := json.Marshal(tunnelResponse{ID: treq.ID, StatusCode: w.code, Body: w.body.Bytes()})
+	if err != nil {
+		return
+	}
+	reply, err := http.NewRequest("POST", replyURL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return
+	}
+	reply.Header.Set("Content-Type", "application/json")
+	setToken(reply)
+	resp, err := client.Do(reply)
+	if err != nil {
+		log.Printf("[goc][WARN]reply tunnel request failed, err: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// blockMeta lists the blocks of every file, the counters are sent in the same order.
+// Hash identifies the blocks, so that the center keeps them for all the services of the same build.
+type blockMeta struct {
+	Hash  string       ` + "`" + `json:"hash"` + "`" + `
+	Mode  string       ` + "`" + `json:"mode"` + "`" + `
+	Files []fileBlocks ` + "`" + `json:"files"` + "`" + `
+}
+
+// fileBlocks are the start line, start column, end line, end column and statements of the blocks of a file
+type fileBlocks struct {
+	Name   string      ` + "`" + `json:"name"` + "`" + `
+	Blocks [][5]uint32 ` + "`" + `json:"blocks"` + "`" + `
+}
+
+var (
+	blockMetaOnce sync.Once
+	blockMetaData blockMeta
+	// blockCounters are the counters of the files in the order of blockMetaData
+	blockCounters [][]uint32
+)
+
+// blockMetadata returns the blocks of the binary with their counters, which are computed once,
+// or the counters as they were paused if the counting is paused
+func blockMetadata() (blockMeta, [][]uint32) {
+	blockMetaOnce.Do(func() {
+		counters, blocks := liveValues()
+		names := make([]string, 0, len(counters))
+		for name := range counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		h := sha256.New()
+		fmt.Fprint(h, "mode: {{.Mode}}\n")
+		blockMetaData = blockMeta{Mode: "{{.Mode}}", Files: make([]fileBlocks, 0, len(names))}
+		for _, name := range names {
+			file := fileBlocks{Name: name, Blocks: make([][5]uint32, 0, len(blocks[name]))}
+			for _, b := range blocks[name] {
+				file.Blocks = append(file.Blocks, [5]uint32{b.Line0, uint32(b.Col0), b.Line1, uint32(b.Col1), uint32(b.Stmts)})
+				fmt.Fprintf(h, "%s:%d.%d,%d.%d %d\n", name, b.Line0, b.Col0, b.Line1, b.Col1, b.Stmts)
+			}
+			blockMetaData.Files = append(blockMetaData.Files, file)
+			blockCounters = append(blockCounters, counters[name])
+		}
+		blockMetaData.Hash = hex.EncodeToString(h.Sum(nil))
+	})
+	paused.Lock()
+	defer paused.Unlock()
+	if paused.counters != nil {
+		counters := make([][]uint32, 0, len(blockMetaData.Files))
+		for _, file := range blockMetaData.Files {
+			counters = append(counters, paused.counters[file.Name])
+		}
+		return blockMetaData, counters
+	}
+	return blockMetaData, blockCounters
+}
+
+// writeCounterValues writes the counters as uvarints, nothing else
+func writeCounterValues(w io.Writer, counters [][]uint32) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen32)
+	for _, counts := range counters {
+		for i := range counts {
+			n := binary.PutUvarint(buf, uint64(atomic.LoadUint32(&counts[i])))
+			if _, err := bw.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// writeCompressed writes the response in gzip if the client accepts it
+func writeCompressed(w http.ResponseWriter, r *http.Request, write func(w io.Writer) error) {
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	if err := write(out); err != nil {
+		log.Printf("[goc][WARN]write %s failed, err: %v", r.URL.Path, err)
+	}
+}
+
+// fileFilter selects the files by the coverfile and skipfile patterns and the package prefixes of the query,
+// it is nil if the query selects all the files
+func fileFilter(query url.Values) (func(name string) bool, error) {
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		var res []*regexp.Regexp
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid file pattern %s, err: %v", pattern, err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	covers, err := compile(query["coverfile"])
+	if err != nil {
+		return nil, err
+	}
+	skips, err := compile(query["skipfile"])
+	if err != nil {
+		return nil, err
+	}
+	var packages []string
+	for _, pkg := range query["package"] {
+		packages = append(packages, strings.TrimSuffix(pkg, "/")+"/")
+	}
+	if len(covers) == 0 && len(skips) == 0 && len(packages) == 0 {
+		return nil, nil
+	}
+
+	return func(name string) bool {
+		for _, re := range skips {
+			if re.MatchString(name) {
+				return false
+			}
+		}
+		if len(packages) > 0 {
+			under := false
+			for _, pkg := range packages {
+				if strings.HasPrefix(name, pkg) {
+					under = true
+					break
+				}
+			}
+			if !under {
+				return false
+			}
+		}
+		if len(covers) == 0 {
+			return true
+		}
+		for _, re := range covers {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// writeProfile writes the profile of the files selected by match, all the files if match is nil
+func writeProfile(w io.Writer, match func(name string) bool) error {
+	counters, blocks := loadValues()
+	if match != nil {
+		for name := range counters {
+			if !match(name) {
+				delete(counters, name)
+			}
+		}
+	}
+	return writeCounters(w, counters, blocks)
+}
+
+func writeCounters(w io.Writer, counters map[string][]uint32, blocks map[string][]testing.CoverBlock) error {
+	fmt.Fprint(w, "mode: {{.Mode}}\n")
+	var active, total int64
+	var count uint32
+	for name, counts := range counters {
+		block := blocks[name]
+		for i := range counts {
+			stmts := int64(block[i].Stmts)
+			total += stmts
+			count = atomic.LoadUint32(&counts[i]) // For -mode=atomic.
+			if count > 0 {
+				active += stmts
+			}
+			_, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n", name,
+				block[i].Line0, block[i].Col0,
+				block[i].Line1, block[i].Col1,
+				stmts,
+				count)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A trace window records what a single request covered: the caller starts a window with an id,
+// sends the request to the service, and stops the window, whose profile is kept under the id.
+// The counters are global to the process, so at most one window is open at a time, and the
+// starts wait for the open one to stop. Everything the service runs while the window is open,
+// e.g. the concurrent requests and the background goroutines, is attributed to it, so the trace
+// is only accurate when the traced request is the only traffic. A window not stopped is closed
+// after GOC_TRACE_TIMEOUT, one minute by default. The last maxTraces traces are kept in memory.
+// In set mode a trace only has the blocks not covered before the window.
+const maxTraces = 100
+
+type traceWindow struct {
+	id    string
+	base  map[string][]uint32
+	timer *time.Timer
+}
+
+var (
+	// traceSlot is held by the open window
+	traceSlot  = make(chan struct{}, 1)
+	traceMu    sync.Mutex
+	openTrace  *traceWindow
+	traces     = make(map[string][]byte)
+	traceOrder []string
+)
+
+func traceTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("GOC_TRACE_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return time.Minute
+}
+
+// snapshotCounters copies the counters
+func snapshotCounters() map[string][]uint32 {
+	counters, _ := loadValues()
+	return copyCounters(counters)
+}
+
+func copyCounters(counters map[string][]uint32) map[string][]uint32 {
+	snapshot := make(map[string][]uint32, len(counters))
+	for name, counts := range counters {
+		copied := make([]uint32, len(counts))
+		for i := range counts {
+			copied[i] = atomic.LoadUint32(&counts[i])
+		}
+		snapshot[name] = copied
+	}
+	return snapshot
+}
+
+// startTrace opens a window, waiting for the open one to stop until the wait parameter, the trace
+// timeout by default, elapses.
+// POST /v1/cover/trace/start?id=xxx&wait=10s
+func startTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, "invalid trace id", http.StatusBadRequest)
+		return
+	}
+	wait := traceTimeout()
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid wait %s", v), http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+	select {
+	case traceSlot <- struct{}{}:
+	case <-r.Context().Done():
+		return
+	case <-time.After(wait):
+		http.Error(w, "another trace window is open", http.StatusConflict)
+		return
+	}
+	window := &traceWindow{id: id, base: snapshotCounters()}
+	traceMu.Lock()
+	if _, ok := traces[id]; ok {
+		traceMu.Unlock()
+		<-traceSlot
+		http.Error(w, fmt.Sprintf("trace %s exists", id), http.StatusConflict)
+		return
+	}
+	openTrace = window
+	window.timer = time.AfterFunc(traceTimeout(), func() {
+		if closeTrace(window) {
+			log.Printf("[goc][WARN]trace %s is not stopped in time, dropped", window.id)
+		}
+	})
+	traceMu.Unlock()
+	fmt.Fprintf(w, "trace %s started\n", id)
+}
+
+// closeTrace closes the window if it is still open
+func closeTrace(window *traceWindow) bool {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	if openTrace != window {
+		return false
+	}
+	openTrace = nil
+	<-traceSlot
+	return true
+}
+
+// stopTrace closes the open window and keeps what was covered since its start.
+// POST /v1/cover/trace/stop?id=xxx
+func stopTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	counters := snapshotCounters()
+	traceMu.Lock()
+	window := openTrace
+	traceMu.Unlock()
+	if window == nil || window.id != id {
+		http.Error(w, fmt.Sprintf("trace %s is not open", id), http.StatusConflict)
+		return
+	}
+	if !closeTrace(window) {
+		http.Error(w, fmt.Sprintf("trace %s is not open", id), http.StatusConflict)
+		return
+	}
+	window.timer.Stop()
+
+	// a counter less than at start was cleared in between, so it is counted from zero
+	for name, counts := range counters {
+		base := window.base[name]
+		for i := range counts {
+			if i < len(base) && counts[i] >= base[i] {
+				counts[i] -= base[i]
+			}
+		}
+	}
+	_, blocks := loadValues()
+	var buf bytes.Buffer
+	if err := writeCounters(&buf, counters, blocks); err != nil {
+		http.Error(w, fmt.Sprintf("invalid block format, err: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	traceMu.Lock()
+	traces[id] = buf.Bytes()
+	traceOrder = append(traceOrder, id)
+	if len(traceOrder) > maxTraces {
+		delete(traces, traceOrder[0])
+		traceOrder = traceOrder[1:]
+	}
+	traceMu.Unlock()
+	w.Write(buf.Bytes())
+}
+
+// getTrace returns the profile of the stopped trace.
+// GET /v1/cover/trace/<id>
+func getTrace(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/cover/trace/")
+	traceMu.Lock()
+	profile, ok := traces[id]
+	traceMu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no trace %s", id), http.StatusNotFound)
+		return
+	}
+	w.Write(profile)
+}
+
+// heartbeat keeps the service alive in the coverage center,
+// the interval can be changed by the GOC_HEARTBEAT_INTERVAL environment variable
+func heartbeat(address string) {
+	interval := 10 * time.Second
+	if v := os.Getenv("GOC_HEARTBEAT_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		}
+	}
+	for range time.Tick(interval) {
+		if resp, err := registerSelf("/v1/cover/heartbeat", address); err != nil {
+			log.Printf("[goc][WARN]heartbeat failed, err: %v, response: %v", err, string(resp))
+		}
+	}
+}
+
+// labelsQuery returns the labels of the service as query parameters, the labels set at
+// build time are extended or overridden by the GOC_LABELS environment variable, e.g. env=staging,version=v1
+func labelsQuery() string {
+	labels := make(map[string]string)
+	for _, s := range []string{ {{.Labels | printf "%q"}}, os.Getenv("GOC_LABELS")} {
+		for _, kv := range strings.Split(s, ",") {
+			if i := strings.Index(kv, "="); i > 0 {
+				labels[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+			}
+		}
+	}
+	query := url.Values{}
+	for k, v := range labels {
+		query.Add("label", k+"="+v)
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "&" + query.Encode()
+}
+
+// registerSelf calls the given register api of the coverage center
+func registerSelf(api, address string) ([]byte, error) {
+	selfName := filepath.Base(os.Args[0])
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s%s?name=%s&address=%s%s", {{.Center | printf "%q"}}, api, selfName, address, labelsQuery()), nil)
 	if err != nil {
 		log.Fatalf("http.NewRequest failed: %v", err)
 		return nil, err
 	}
+	setToken(req)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := centerClient.Do(req)
 	if err != nil && isNetworkError(err) {
 		log.Printf("[goc][WARN]error occurred:%v, try again", err)
-		resp, err = http.DefaultClient.Do(req)
+		resp, err = centerClient.Do(req)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to register into coverage center, err:%v", err)
@@ -251,6 +1053,123 @@ func registerSelf(address string) ([]byte, error) {
 	return body, err
 }
 
+// in offline mode the profile is written into a local directory periodically, on exit and when main returns,
+// for the services no center can reach. Every process writes its own file, which goc merge combines.
+var (
+	coverDirMu   sync.Mutex
+	coverDirFile string
+)
+
+// startCoverDir enables the offline mode with the directory set at build time or by GOC_COVERDIR
+func startCoverDir() {
+	dir := {{.CoverDir | printf "%q"}}
+	if v, ok := os.LookupEnv("GOC_COVERDIR"); ok {
+		dir = v
+	}
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("[goc][WARN]create coverage directory %s failed, err: %v", dir, err)
+		return
+	}
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%s_%s_%d_%d.cov", filepath.Base(os.Args[0]), host, os.Getpid(), time.Now().UnixNano())
+	coverDirFile = filepath.Join(dir, name)
+
+	interval, _ := time.ParseDuration({{.CoverDirInterval | printf "%q"}})
+	if v := os.Getenv("GOC_COVERDIR_INTERVAL"); v != "" {
+		interval, _ = time.ParseDuration(v)
+	}
+	if interval > 0 {
+		go dumpPeriodically(interval)
+	}
+	{{if .Singleton}}
+	// in singleton mode the signals are only watched to dump on exit
+	go watchSignal(func() {})
+	{{end}}
+}
+
+func dumpPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		dumpCoverDir()
+	}
+}
+
+// dumpCoverDir writes the profile into the file of the process in offline mode,
+// through a temp file so that the file is never seen half written
+func dumpCoverDir() {
+	if coverDirFile == "" {
+		return
+	}
+	coverDirMu.Lock()
+	defer coverDirMu.Unlock()
+	tmp := coverDirFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Printf("[goc][WARN]write profile into %s failed, err: %v", tmp, err)
+		return
+	}
+	err = writeProfile(f, nil)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, coverDirFile)
+	}
+	if err != nil {
+		log.Printf("[goc][WARN]write profile into %s failed, err: %v", coverDirFile, err)
+		os.Remove(tmp)
+	}
+}
+
+// gocMainReturned is deferred by the function main of the services built with a coverage directory,
+// so that the profile is written when main returns
+func gocMainReturned() {
+	dumpCoverDir()
+}
+
+func pushPeriodically(address string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if resp, err := pushProfile(address); err != nil {
+			log.Printf("[goc][WARN]push profile failed, err: %v, response: %v", err, string(resp))
+		}
+	}
+}
+
+// pushProfile uploads the profile to the coverage center
+func pushProfile(address string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeProfile(&buf, nil); err != nil {
+		return nil, err
+	}
+
+	selfName := filepath.Base(os.Args[0])
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/cover/upload?name=%s&address=%s%s", {{.Center | printf "%q"}}, selfName, address, labelsQuery()), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	setToken(req)
+
+	resp, err := centerClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to push profile to coverage center, err:%v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body, err:%v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("failed to push profile to coverage center, response code %d", resp.StatusCode)
+	}
+
+	return body, err
+}
+
 func deregisterSelf(address []string) ([]byte, error) {
         param := map[string]interface{}{
                 "address": address,
@@ -265,11 +1184,12 @@ func deregisterSelf(address []string) ([]byte, error) {
                 return nil, err
         }
         req.Header.Set("Content-Type", "application/json")
+        setToken(req)
 
-        resp, err := http.DefaultClient.Do(req)
+        resp, err := centerClient.Do(req)
         if err != nil && isNetworkError(err) {
                 log.Printf("[goc][WARN]error occurred:%v, try again", err)
-                resp, err = http.DefaultClient.Do(req)
+                resp, err = centerClient.Do(req)
         }
         if err != nil {
                 return nil, fmt.Errorf("failed to deregister into coverage center, err:%v", err)
@@ -299,6 +1219,7 @@ func watchSignal(fn CallbackFunc) {
                 log.Printf("get a signal %s", si.String())
                 switch si {
                 case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+                        dumpCoverDir()
                         fn()
                         os.Exit(0) // Exit successfully.
                 case syscall.SIGHUP:
@@ -499,6 +1420,13 @@ func injectGlobalCoverVarFile(ci *CoverInfo, content string) error {
 	defer coverFile.Close()
 
 	packageName := "package " + filepath.Base(ci.GlobalCoverVarImportPath) + "\n\n"
+	if ci.CountersDir != "" {
+		// the counters are registered to be placed in the memory-mapped file
+		packageName += "import \"unsafe\"\n\n"
+		if err := injectCountersFiles(ci); err != nil {
+			return err
+		}
+	}
 
 	_, err = coverFile.WriteString(packageName)
 	if err != nil {
@@ -163,6 +163,7 @@ type File struct {
 	edit    *Buffer // QINIU
 	varVar  string  // QINIU
 	mode    string  // QINIU
+	mmap    bool    // QINIU, the counters are pointed to, as they live in a memory-mapped file
 }
 
 // findText finds text in the original source, starting at pos.
@@ -303,8 +304,10 @@ func (f *File) Visit(node ast.Node) ast.Visitor {
 // Annotate do following
 // 1. add cover variables into the original file
 // 2. return the cover variables declarations as plain string
+// 3. declare Count as a pointer to the counters if mmap, set when the memory-mapped file is created
+// 4. defer the hook of goc in the function main if mainHook, i.e. the profile is written into a directory
 // original dec: func annotate(name string) {
-func Annotate(name string, mode string, varVar string, globalCoverVarImportPath string) string {
+func Annotate(name string, mode string, varVar string, globalCoverVarImportPath string, mmap bool, mainHook bool) string {
 	// QINIU
 	switch mode {
 	case "set":
@@ -335,12 +338,19 @@ func Annotate(name string, mode string, varVar string, globalCoverVarImportPath
 		astFile: parsedFile,
 		varVar:  varVar,
 		mode:    mode,
+		mmap:    mmap,
 	}
 
 	ast.Walk(file, file.astFile)
+	covered := !bytes.Equal(content, file.edit.Bytes())
+	// QINIU
+	// the function main defers the hook of goc, which dumps the profile when main returns
+	if mainHook {
+		injectMainHook(file)
+	}
 	newContent := file.edit.Bytes()
 
-	if bytes.Equal(content, newContent) {
+	if !covered {
 		log.Info("no cover var injected for: ", name)
 	} else {
 		// reback to the beginning
@@ -394,6 +404,24 @@ func Annotate(name string, mode string, varVar string, globalCoverVarImportPath
 	return declBuf.String()
 }
 
+// QINIU
+// mainHookFunc is defined by goc in the main package along with the cover APIs
+const mainHookFunc = "gocMainReturned"
+
+// injectMainHook defers mainHookFunc at the beginning of the function main of the package main
+func injectMainHook(f *File) {
+	if f.astFile.Name.Name != "main" {
+		return
+	}
+	for _, decl := range f.astFile.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Name.Name != "main" || fn.Body == nil {
+			continue
+		}
+		f.edit.Insert(f.offset(fn.Body.Lbrace)+1, fmt.Sprintf("defer %s();", mainHookFunc))
+	}
+}
+
 // setCounterStmt returns the expression: __count[23] = 1.
 func setCounterStmt(f *File, counter string) string {
 	return fmt.Sprintf("%s = 1", counter)
@@ -686,7 +714,12 @@ func (f *File) addVariables(w io.Writer) {
 
 	// Declare the coverage struct as a package-level variable.
 	fmt.Fprintf(w, "\nvar %s = struct {\n", f.varVar) // QINIU
-	fmt.Fprintf(w, "\tCount     [%d]uint32\n", len(f.blocks))
+	if f.mmap {
+		// QINIU, indexed and sliced as the array
+		fmt.Fprintf(w, "\tCount     *[%d]uint32\n", len(f.blocks))
+	} else {
+		fmt.Fprintf(w, "\tCount     [%d]uint32\n", len(f.blocks))
+	}
 	fmt.Fprintf(w, "\tPos       [3 * %d]uint32\n", len(f.blocks))
 	fmt.Fprintf(w, "\tNumStmt   [%d]uint16\n", len(f.blocks))
 	fmt.Fprintf(w, "} {\n")
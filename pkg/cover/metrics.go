@@ -0,0 +1,225 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/tools/cover"
+)
+
+// MetricsAPI is scraped by Prometheus
+const MetricsAPI = "/metrics"
+
+var (
+	serviceStatementsDesc = prometheus.NewDesc("goc_service_statements",
+		"Number of statements of the service.", []string{"service"}, nil)
+	serviceCoveredDesc = prometheus.NewDesc("goc_service_covered_statements",
+		"Number of covered statements of the service.", []string{"service"}, nil)
+	packageStatementsDesc = prometheus.NewDesc("goc_package_statements",
+		"Number of statements of the package in all the services.", []string{"package"}, nil)
+	packageCoveredDesc = prometheus.NewDesc("goc_package_covered_statements",
+		"Number of covered statements of the package in all the services.", []string{"package"}, nil)
+	statementsDesc = prometheus.NewDesc("goc_statements",
+		"Number of statements of all the services.", nil, nil)
+	coveredDesc = prometheus.NewDesc("goc_covered_statements",
+		"Number of covered statements of all the services.", nil, nil)
+	coverageRatioDesc = prometheus.NewDesc("goc_coverage_ratio",
+		"Ratio of the covered statements of all the services.", nil, nil)
+	registeredDesc = prometheus.NewDesc("goc_registered_addresses",
+		"Number of addresses registered to the center.", []string{"service"}, nil)
+	healthyDesc = prometheus.NewDesc("goc_healthy_addresses",
+		"Number of registered addresses which are healthy.", []string{"service"}, nil)
+)
+
+// centerMetrics exposes the coverage and the state of the center to Prometheus.
+// The coverage is computed from the latest profiles collected from the services,
+// by the profile requests or the snapshots, including the tombstones.
+// The zero value is ready to use.
+type centerMetrics struct {
+	once     sync.Once
+	scrapes  *prometheus.CounterVec
+	failures *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+
+	handlerOnce sync.Once
+	handler     http.Handler
+
+	// the summary is recomputed only after the profile cache changes
+	mu      sync.Mutex
+	gen     uint64
+	summary *coverageSummary
+}
+
+// coverageSummary is the coverage of every service and package, each named by its
+// service name or import path
+type coverageSummary struct {
+	services CoverageList
+	packages CoverageList
+	// merged is false if the profiles of the services can not be merged
+	merged bool
+}
+
+func (m *centerMetrics) init() {
+	m.once.Do(func() {
+		m.scrapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "goc_agent_scrapes_total",
+			Help: "Number of profiles collected from the address.",
+		}, []string{"address"})
+		m.failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "goc_agent_scrape_failures_total",
+			Help: "Number of failures collecting the profile from the address.",
+		}, []string{"address"})
+		m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "goc_agent_scrape_duration_seconds",
+			Help:    "Time taken to collect the profile from the address.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}, []string{"address"})
+	})
+}
+
+// forget drops the metrics of an address removed from the center
+func (m *centerMetrics) forget(addr string) {
+	m.init()
+	m.scrapes.DeleteLabelValues(addr)
+	m.failures.DeleteLabelValues(addr)
+	m.latency.DeleteLabelValues(addr)
+}
+
+func (m *centerMetrics) reset() {
+	m.init()
+	m.scrapes.Reset()
+	m.failures.Reset()
+	m.latency.Reset()
+}
+
+// coverage returns the summary of the profiles, which are of the generation gen of the cache
+func (m *centerMetrics) coverage(profiles map[string][][]*cover.Profile, gen uint64) *coverageSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.summary != nil && m.gen == gen {
+		return m.summary
+	}
+
+	summary := &coverageSummary{services: NewCoverageList()}
+	var all [][]*cover.Profile
+	for name, p := range profiles {
+		all = append(all, p...)
+		merged, err := mergeProfiles(p)
+		if err != nil {
+			log.Warnf("failed to merge the profiles of service %s for the metrics, err: %v", name, err)
+			continue
+		}
+		c := total(PackageCovList(merged))
+		c.FileName = name
+		summary.services = append(summary.services, c)
+	}
+	summary.services.Sort()
+
+	if merged, err := mergeProfiles(all); err != nil {
+		log.Warnf("failed to merge the profiles of all the services for the metrics, err: %v", err)
+	} else {
+		summary.packages = PackageCovList(merged)
+		summary.merged = true
+	}
+	m.summary, m.gen = summary, gen
+	return summary
+}
+
+// total sums up the coverage of the list
+func total(g CoverageList) Coverage {
+	var c Coverage
+	for _, e := range g {
+		c.NCoveredStmts += e.NCoveredStmts
+		c.NAllStmts += e.NAllStmts
+	}
+	return c
+}
+
+// centerCollector computes the gauges from the state of the center when Prometheus scrapes
+type centerCollector struct {
+	s *server
+}
+
+func (c *centerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{serviceStatementsDesc, serviceCoveredDesc, packageStatementsDesc, packageCoveredDesc,
+		statementsDesc, coveredDesc, coverageRatioDesc, registeredDesc, healthyDesc} {
+		ch <- d
+	}
+}
+
+func (c *centerCollector) Collect(ch chan<- prometheus.Metric) {
+	summary := c.s.metrics.coverage(c.s.profiles.byService())
+	for _, svc := range summary.services {
+		ch <- prometheus.MustNewConstMetric(serviceStatementsDesc, prometheus.GaugeValue, float64(svc.NAllStmts), svc.FileName)
+		ch <- prometheus.MustNewConstMetric(serviceCoveredDesc, prometheus.GaugeValue, float64(svc.NCoveredStmts), svc.FileName)
+	}
+	if summary.merged {
+		for _, pkg := range summary.packages {
+			ch <- prometheus.MustNewConstMetric(packageStatementsDesc, prometheus.GaugeValue, float64(pkg.NAllStmts), pkg.FileName)
+			ch <- prometheus.MustNewConstMetric(packageCoveredDesc, prometheus.GaugeValue, float64(pkg.NCoveredStmts), pkg.FileName)
+		}
+		all := total(summary.packages)
+		ch <- prometheus.MustNewConstMetric(statementsDesc, prometheus.GaugeValue, float64(all.NAllStmts))
+		ch <- prometheus.MustNewConstMetric(coveredDesc, prometheus.GaugeValue, float64(all.NCoveredStmts))
+		if ratio, err := summary.packages.TotalRatio(); err == nil {
+			ch <- prometheus.MustNewConstMetric(coverageRatioDesc, prometheus.GaugeValue, float64(ratio))
+		}
+	}
+
+	registered := make(map[string]int)
+	healthy := make(map[string]int)
+	for _, st := range c.s.serviceStatuses() {
+		registered[st.Name]++
+		if st.Health == HealthHealthy {
+			healthy[st.Name]++
+		}
+	}
+	for name, n := range registered {
+		ch <- prometheus.MustNewConstMetric(registeredDesc, prometheus.GaugeValue, float64(n), name)
+		ch <- prometheus.MustNewConstMetric(healthyDesc, prometheus.GaugeValue, float64(healthy[name]), name)
+	}
+}
+
+// observeScrape records the collection of the profile from the address
+func (s *server) observeScrape(addr string, d time.Duration, err error) {
+	s.metrics.init()
+	s.metrics.scrapes.WithLabelValues(addr).Inc()
+	s.metrics.latency.WithLabelValues(addr).Observe(d.Seconds())
+	if err != nil {
+		s.metrics.failures.WithLabelValues(addr).Inc()
+	}
+}
+
+// serveMetrics exposes the metrics in the Prometheus text format.
+// GET /metrics
+func (s *server) serveMetrics(c *gin.Context) {
+	m := &s.metrics
+	m.init()
+	m.handlerOnce.Do(func() {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(m.scrapes, m.failures, m.latency, &centerCollector{s: s})
+		m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: log.StandardLogger()})
+	})
+	m.handler.ServeHTTP(c.Writer, c.Request)
+}
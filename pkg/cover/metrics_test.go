@@ -0,0 +1,89 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/tools/cover"
+)
+
+func getMetrics(t *testing.T, center string) string {
+	resp, err := http.Get(center + MetricsAPI)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	s, center, closeCenter := newCenterWithAgent(t, "foo", exportProfile)
+	defer closeCenter()
+	deadAgent := "http://127.0.0.1:64446"
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "bar", Address: deadAgent}))
+	fooAgent := s.Store.Get("foo")[0]
+	s.agents.alive(fooAgent, time.Now())
+
+	// no coverage before any profile is collected
+	metrics := getMetrics(t, center.URL)
+	assert.Contains(t, metrics, `goc_registered_addresses{service="foo"} 1`)
+	assert.Contains(t, metrics, `goc_healthy_addresses{service="foo"} 1`)
+	assert.Contains(t, metrics, `goc_healthy_addresses{service="bar"} 0`)
+	assert.NotContains(t, metrics, "goc_service_statements")
+
+	_, err := NewWorker(center.URL).Profile(ProfileParam{Force: true})
+	assert.NoError(t, err)
+	metrics = getMetrics(t, center.URL)
+	assert.Contains(t, metrics, `goc_service_statements{service="foo"} 7`)
+	assert.Contains(t, metrics, `goc_service_covered_statements{service="foo"} 3`)
+	assert.Contains(t, metrics, `goc_package_statements{package="github.com/qiniu/goc/pkg/cover"} 4`)
+	assert.Contains(t, metrics, `goc_package_covered_statements{package="github.com/qiniu/goc/cmd"} 0`)
+	assert.Contains(t, metrics, "goc_statements 7")
+	assert.Contains(t, metrics, "goc_covered_statements 3")
+	assert.Contains(t, metrics, fmt.Sprintf("goc_coverage_ratio %v", float64(float32(3)/7)))
+	assert.Contains(t, metrics, fmt.Sprintf(`goc_agent_scrapes_total{address="%s"} 1`, fooAgent))
+	assert.Contains(t, metrics, fmt.Sprintf(`goc_agent_scrape_failures_total{address="%s"} 1`, deadAgent))
+	assert.Contains(t, metrics, fmt.Sprintf(`goc_agent_scrape_duration_seconds_count{address="%s"} 1`, fooAgent))
+
+	// the metrics of the addresses removed are dropped
+	_, err = NewWorker(center.URL).Remove(ProfileParam{Address: []string{deadAgent}})
+	assert.NoError(t, err)
+	metrics = getMetrics(t, center.URL)
+	assert.NotContains(t, metrics, deadAgent)
+	assert.NotContains(t, metrics, `goc_registered_addresses{service="bar"}`)
+}
+
+func TestMetricsCoverageCache(t *testing.T) {
+	var m centerMetrics
+	profiles, err := ParseProfile(strings.NewReader(exportProfile))
+	assert.NoError(t, err)
+	summary := m.coverage(map[string][][]*cover.Profile{"foo": {profiles}}, 1)
+	assert.Equal(t, 7, total(summary.packages).NAllStmts)
+	// recomputed only if the cache changes
+	assert.True(t, summary == m.coverage(nil, 1))
+	summary = m.coverage(nil, 2)
+	assert.Empty(t, summary.services)
+	assert.Equal(t, 0, total(summary.packages).NAllStmts)
+}
@@ -0,0 +1,278 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"golang.org/x/tools/cover"
+)
+
+// The services built with --counters-dir keep their counters in a file memory-mapped,
+// which outlives the process. The file is laid out as:
+//
+//	the magic, 8 bytes
+//	the byte order mark, the length of the blocks and the number of the counters, 4 bytes each in the native order
+//	4 bytes reserved
+//	the blocks as json, in the format of the blocks API, padded to 8 bytes
+//	the counters, 4 bytes each in the native order and the order of the blocks
+const (
+	// CountersFileExt is the extension of the counters files
+	CountersFileExt = ".counters"
+
+	countersMagic  = "GOCCNTR1"
+	countersHeader = 24
+)
+
+// ReadCountersFile reads the profile from the counters file of a running or dead service
+func ReadCountersFile(name string) ([]*cover.Profile, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < countersHeader || string(data[:len(countersMagic)]) != countersMagic {
+		return nil, fmt.Errorf("%s is not a counters file", name)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(data[8:]) != 1 {
+		order = binary.BigEndian
+		if order.Uint32(data[8:]) != 1 {
+			return nil, fmt.Errorf("invalid byte order mark of %s", name)
+		}
+	}
+	metaLen := int(order.Uint32(data[12:]))
+	total := int(order.Uint32(data[16:]))
+	offset := countersHeader + (metaLen+7)/8*8
+	if len(data) < offset+4*total {
+		return nil, fmt.Errorf("%s is truncated", name)
+	}
+	var meta blockMeta
+	if err := json.Unmarshal(data[countersHeader:countersHeader+metaLen], &meta); err != nil {
+		return nil, fmt.Errorf("invalid blocks of %s, err: %v", name, err)
+	}
+
+	profiles := make([]*cover.Profile, 0, len(meta.Files))
+	for _, f := range meta.Files {
+		p := &cover.Profile{FileName: f.Name, Mode: meta.Mode, Blocks: make([]cover.ProfileBlock, 0, len(f.Blocks))}
+		for _, b := range f.Blocks {
+			if total == 0 {
+				return nil, fmt.Errorf("fewer counters than the blocks in %s", name)
+			}
+			p.Blocks = append(p.Blocks, cover.ProfileBlock{
+				StartLine: b[0], StartCol: b[1], EndLine: b[2], EndCol: b[3], NumStmt: b[4], Count: int(order.Uint32(data[offset:])),
+			})
+			offset += 4
+			total--
+		}
+		profiles = append(profiles, p)
+	}
+	if total != 0 {
+		return nil, fmt.Errorf("more counters than the blocks in %s", name)
+	}
+	return mergeProfiles([][]*cover.Profile{profiles})
+}
+
+// injectCountersFiles generates the files placing the counters of the global cover variables
+// in the memory-mapped file, besides the file of the variables
+func injectCountersFiles(ci *CoverInfo) error {
+	dir := filepath.Join(ci.Target, ci.GlobalCoverVarImportPath)
+	data := struct {
+		Package     string
+		Mode        string
+		CountersDir string
+		Magic       string
+		Header      int
+		Ext         string
+	}{filepath.Base(ci.GlobalCoverVarImportPath), ci.Mode, ci.CountersDir, countersMagic, countersHeader, CountersFileExt}
+	for name, tmpl := range map[string]*template.Template{
+		"counters.go":        countersTmpl,
+		"counters_mmap.go":   countersMmapTmpl,
+		"counters_nommap.go": countersNoMmapTmpl,
+	} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		err = tmpl.Execute(f, data)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var countersTmpl = template.Must(template.New("counters").Parse(countersSource))
+
+const countersSource = `// Code generated by goc system. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+)
+
+// gocCounterVar is a cover variable, count is the address of its field Count
+type gocCounterVar struct {
+	name    string
+	count   unsafe.Pointer
+	pos     []uint32
+	numStmt []uint16
+}
+
+var (
+	gocCounterVars []gocCounterVar
+	// the variables without blocks point to it
+	gocNoCounters [1]uint32
+)
+
+// registerCounters is called as the cover variables are initialized, before the init below
+func registerCounters(name string, count unsafe.Pointer, pos []uint32, numStmt []uint16) bool {
+	gocCounterVars = append(gocCounterVars, gocCounterVar{name: name, count: count, pos: pos, numStmt: numStmt})
+	return true
+}
+
+func init() {
+	total := 0
+	for _, v := range gocCounterVars {
+		total += len(v.numStmt)
+	}
+	counters, err := mapCounters(total)
+	if err != nil {
+		log.Printf("[goc][WARN] failed to map the counters into a file, they are kept in memory, err: %v", err)
+		counters = make([]uint32, total)
+	}
+	offset := 0
+	for _, v := range gocCounterVars {
+		p := unsafe.Pointer(&gocNoCounters)
+		if n := len(v.numStmt); n > 0 {
+			p = unsafe.Pointer(&counters[offset])
+			offset += n
+		}
+		*(*unsafe.Pointer)(v.count) = p
+	}
+}
+
+// mapCounters returns the counters in the file created in the directory set at build time or by GOC_COUNTERS_DIR,
+// or in memory if the directory is empty
+func mapCounters(total int) ([]uint32, error) {
+	dir := {{.CountersDir | printf "%q"}}
+	if v, ok := os.LookupEnv("GOC_COUNTERS_DIR"); ok {
+		dir = v
+	}
+	if dir == "" {
+		return make([]uint32, total), nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	meta, err := json.Marshal(countersMeta())
+	if err != nil {
+		return nil, err
+	}
+	offset := {{.Header}} + (len(meta)+7)/8*8
+	header := make([]byte, offset)
+	copy(header, {{.Magic | printf "%q"}})
+	fields := [3]uint32{1, uint32(len(meta)), uint32(total)}
+	copy(header[8:], (*[12]byte)(unsafe.Pointer(&fields))[:])
+	copy(header[{{.Header}}:], meta)
+
+	host, _ := os.Hostname()
+	name := filepath.Join(dir, fmt.Sprintf("%s_%s_%d_%d{{.Ext}}", filepath.Base(os.Args[0]), host, os.Getpid(), time.Now().UnixNano()))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// the mapping outlives the file
+	defer f.Close()
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(offset + 4*total)); err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, nil
+	}
+	data, err := mmapFile(f, offset+4*total)
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return (*[1 << 28]uint32)(unsafe.Pointer(&data[offset]))[:total:total], nil
+}
+
+// countersMeta lists the blocks of the counters in the format of the blocks API of goc
+func countersMeta() interface{} {
+	files := make([]interface{}, 0, len(gocCounterVars))
+	for _, v := range gocCounterVars {
+		blocks := make([][5]uint32, len(v.numStmt))
+		for i := range blocks {
+			blocks[i] = [5]uint32{v.pos[3*i], v.pos[3*i+2] & 0xFFFF, v.pos[3*i+1], v.pos[3*i+2] >> 16, uint32(v.numStmt[i])}
+		}
+		files = append(files, map[string]interface{}{"name": v.name, "blocks": blocks})
+	}
+	return map[string]interface{}{"mode": {{.Mode | printf "%q"}}, "files": files}
+}
+`
+
+var countersMmapTmpl = template.Must(template.New("countersMmap").Parse(`// Code generated by goc system. DO NOT EDIT.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package {{.Package}}
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+`))
+
+var countersNoMmapTmpl = template.Must(template.New("countersNoMmap").Parse(`// Code generated by goc system. DO NOT EDIT.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package {{.Package}}
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, fmt.Errorf("memory-mapped counters not supported on %s", runtime.GOOS)
+}
+`))
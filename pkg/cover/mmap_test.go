@@ -0,0 +1,76 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countersFile lays out the counters file as the services built with --counters-dir do
+func countersFile(t *testing.T, order binary.ByteOrder, meta *blockMeta, counters ...uint32) []byte {
+	blocks, err := json.Marshal(meta)
+	assert.NoError(t, err)
+	offset := countersHeader + (len(blocks)+7)/8*8
+	data := make([]byte, offset+4*len(counters))
+	copy(data, countersMagic)
+	order.PutUint32(data[8:], 1)
+	order.PutUint32(data[12:], uint32(len(blocks)))
+	order.PutUint32(data[16:], uint32(len(counters)))
+	copy(data[countersHeader:], blocks)
+	for i, c := range counters {
+		order.PutUint32(data[offset+4*i:], c)
+	}
+	return data
+}
+
+func TestReadCountersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-counters")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	expected, err := ParseProfile(strings.NewReader("mode: count\n" +
+		"b.go:3.1,4.2 1 1\nb.go:1.1,2.2 2 300\n" +
+		"a.go:1.1,2.2 3 0\n"))
+	assert.NoError(t, err)
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		name := filepath.Join(dir, "app"+CountersFileExt)
+		assert.NoError(t, ioutil.WriteFile(name, countersFile(t, order, testBlocks, 1, 300, 0), 0644))
+		profiles, err := ReadCountersFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, profiles)
+	}
+
+	for _, data := range [][]byte{
+		[]byte("mode: count\n"),
+		countersFile(t, binary.LittleEndian, testBlocks, 1, 300),
+		countersFile(t, binary.LittleEndian, testBlocks, 1, 300, 0, 4),
+		countersFile(t, binary.LittleEndian, testBlocks, 1, 300, 0)[:countersHeader+8],
+	} {
+		name := filepath.Join(dir, "invalid"+CountersFileExt)
+		assert.NoError(t, ioutil.WriteFile(name, data, 0644))
+		_, err := ReadCountersFile(name)
+		assert.Error(t, err)
+	}
+}
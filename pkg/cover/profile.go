@@ -0,0 +1,365 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/tools/cover"
+)
+
+// maxProfileLine is the longest line accepted in a profile, a block line is
+// the file path followed by five numbers
+const maxProfileLine = 1 << 20
+
+var modePrefix = []byte("mode: ")
+
+// blockPos is the position of a code block in its file
+type blockPos struct {
+	startLine, startCol, endLine, endCol int
+}
+
+func (p blockPos) before(q blockPos) bool {
+	if p.startLine != q.startLine {
+		return p.startLine < q.startLine
+	}
+	if p.startCol != q.startCol {
+		return p.startCol < q.startCol
+	}
+	if p.endLine != q.endLine {
+		return p.endLine < q.endLine
+	}
+	return p.endCol < q.endCol
+}
+
+func posOf(b *cover.ProfileBlock) blockPos {
+	return blockPos{startLine: b.StartLine, startCol: b.StartCol, endLine: b.EndLine, endCol: b.EndCol}
+}
+
+// mergedFile is the merged profile of a source file
+type mergedFile struct {
+	profile *cover.Profile
+	// sorted is whether profile.Blocks are in the order of position
+	sorted bool
+	// index maps the position of a block to its index in profile.Blocks,
+	// it is only built when a block can not be found in the fast ways
+	index map[blockPos]int
+	// next is the index of the block expected next in the profile being merged,
+	// as the profiles of the same binary list the blocks in the same order
+	next int
+	// gen is the profile being merged, fresh is whether the file first appears in it,
+	// and seen counts the blocks of the file found in it
+	gen   int
+	fresh bool
+	seen  int
+	// gens are the last profiles each block is found in, in the order of profile.Blocks,
+	// so that a block listed several times in a profile is only seen once
+	gens []int
+}
+
+// ProfileMerger merges the profiles in the text format line by line as they are read,
+// so that neither the whole response nor a temp file is needed. Like cov.MergeProfiles,
+// the profiles must be coherent: a file in several profiles has the same blocks and mode
+// in all of them. The counts of a block are summed, or or-ed in set mode.
+type ProfileMerger struct {
+	files map[string]*mergedFile
+	// gen is increased for every profile merged, mode is its mode
+	gen  int
+	mode string
+	// touched are the files of former profiles found in the one being merged
+	touched []*mergedFile
+}
+
+// NewProfileMerger creates an empty ProfileMerger
+func NewProfileMerger() *ProfileMerger {
+	return &ProfileMerger{files: make(map[string]*mergedFile)}
+}
+
+// Parse reads the profile in the text format from r and merges it
+func (m *ProfileMerger) Parse(r io.Reader) error {
+	m.begin("")
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxProfileLine)
+	first := true
+	for s.Scan() {
+		line := s.Bytes()
+		if first {
+			first = false
+			if !bytes.HasPrefix(line, modePrefix) || len(line) == len(modePrefix) {
+				return fmt.Errorf("bad mode line: %s", line)
+			}
+			m.mode = string(line[len(modePrefix):])
+			continue
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		fn, pos, numStmt, count, err := parseBlock(line)
+		if err != nil {
+			return fmt.Errorf("line %q doesn't match expected format: %v", line, err)
+		}
+		// the file name is only copied when the file is seen for the first time
+		f := m.files[string(fn)]
+		if f == nil {
+			f = m.file(string(fn))
+		}
+		if err := m.addBlock(f, pos, numStmt, count); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return m.end()
+}
+
+// Add merges the parsed profiles, which are not modified
+func (m *ProfileMerger) Add(profiles []*cover.Profile) error {
+	m.begin("")
+	for _, p := range profiles {
+		m.mode = p.Mode
+		f := m.files[p.FileName]
+		if f == nil {
+			f = m.file(p.FileName)
+		}
+		for i := range p.Blocks {
+			b := &p.Blocks[i]
+			if err := m.addBlock(f, posOf(b), b.NumStmt, b.Count); err != nil {
+				return err
+			}
+		}
+	}
+	return m.end()
+}
+
+// Profiles returns the merged profiles sorted by file name, with the blocks sorted by position.
+// They are owned by the merger, which must not be used after.
+func (m *ProfileMerger) Profiles() []*cover.Profile {
+	profiles := make([]*cover.Profile, 0, len(m.files))
+	for _, f := range m.files {
+		if !f.sorted {
+			blocks := f.profile.Blocks
+			sort.Slice(blocks, func(i, j int) bool { return posOf(&blocks[i]).before(posOf(&blocks[j])) })
+			f.sorted, f.index = true, nil
+		}
+		profiles = append(profiles, f.profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].FileName < profiles[j].FileName })
+	return profiles
+}
+
+// fits checks that the profiles can be merged, i.e. the files merged before have the same mode
+// and blocks in them. Unlike Add, the merger is not modified when they mismatch.
+func (m *ProfileMerger) fits(profiles []*cover.Profile) error {
+	for _, p := range profiles {
+		f := m.files[p.FileName]
+		if f == nil {
+			continue
+		}
+		if f.profile.Mode != p.Mode {
+			return fmt.Errorf("mode for %s mismatches (%s vs %s)", p.FileName, f.profile.Mode, p.Mode)
+		}
+		if len(f.profile.Blocks) != len(p.Blocks) {
+			return fmt.Errorf("file block count for %s mismatches (%d vs %d)", p.FileName, len(f.profile.Blocks), len(p.Blocks))
+		}
+		for i := range p.Blocks {
+			b := &p.Blocks[i]
+			if j, ok := f.lookup(posOf(b)); !ok || f.profile.Blocks[j].NumStmt != b.NumStmt {
+				return fmt.Errorf("coverage block mismatch in %s at %d.%d,%d.%d", p.FileName, b.StartLine, b.StartCol, b.EndLine, b.EndCol)
+			}
+		}
+	}
+	return nil
+}
+
+// begin starts merging a profile
+func (m *ProfileMerger) begin(mode string) {
+	m.gen++
+	m.mode = mode
+	m.touched = m.touched[:0]
+}
+
+// end checks that all the blocks of the files merged before are found in the profile merged
+func (m *ProfileMerger) end() error {
+	for _, f := range m.touched {
+		if f.seen != len(f.profile.Blocks) {
+			return fmt.Errorf("error merging %s: file block count for %s mismatches (%d vs %d)",
+				f.profile.FileName, f.profile.FileName, len(f.profile.Blocks), f.seen)
+		}
+	}
+	return nil
+}
+
+func (m *ProfileMerger) file(name string) *mergedFile {
+	f := &mergedFile{
+		profile: &cover.Profile{FileName: name, Mode: m.mode},
+		sorted:  true,
+		gen:     m.gen,
+		fresh:   true,
+	}
+	m.files[name] = f
+	return f
+}
+
+func (m *ProfileMerger) addBlock(f *mergedFile, pos blockPos, numStmt, count int) error {
+	if f.gen != m.gen {
+		if f.profile.Mode != m.mode {
+			return fmt.Errorf("error merging %s: mode for %s mismatches (%s vs %s)", f.profile.FileName, f.profile.FileName, f.profile.Mode, m.mode)
+		}
+		f.gen, f.fresh, f.next, f.seen = m.gen, false, 0, 0
+		m.touched = append(m.touched, f)
+	}
+	blocks := f.profile.Blocks
+	n := len(blocks)
+
+	i := -1
+	switch {
+	case f.next < n && posOf(&blocks[f.next]) == pos:
+		i = f.next
+	case n == 0 || f.sorted && posOf(&blocks[n-1]).before(pos):
+		// a block after all the known ones
+	default:
+		if j, ok := f.lookup(pos); ok {
+			i = j
+		}
+	}
+
+	if i < 0 {
+		if !f.fresh {
+			return fmt.Errorf("error merging %s: coverage block mismatch: block %d.%d,%d.%d is not found",
+				f.profile.FileName, pos.startLine, pos.startCol, pos.endLine, pos.endCol)
+		}
+		if n > 0 && !posOf(&blocks[n-1]).before(pos) {
+			f.sorted = false
+		}
+		if f.index != nil {
+			f.index[pos] = n
+		}
+		f.profile.Blocks = append(blocks, cover.ProfileBlock{
+			StartLine: pos.startLine, StartCol: pos.startCol,
+			EndLine: pos.endLine, EndCol: pos.endCol,
+			NumStmt: numStmt, Count: count,
+		})
+		f.gens = append(f.gens, m.gen)
+		f.next = n + 1
+		return nil
+	}
+
+	b := &blocks[i]
+	if b.NumStmt != numStmt {
+		return fmt.Errorf("error merging %s: coverage block mismatch: inconsistent NumStmt at %d.%d,%d.%d: changed from %d to %d",
+			f.profile.FileName, pos.startLine, pos.startCol, pos.endLine, pos.endCol, b.NumStmt, numStmt)
+	}
+	if m.mode == "set" {
+		b.Count |= count
+	} else {
+		b.Count += count
+	}
+	if f.gens[i] != m.gen {
+		f.gens[i] = m.gen
+		f.seen++
+	}
+	f.next = i + 1
+	return nil
+}
+
+// lookup finds the block at the position, building the index on first use
+func (f *mergedFile) lookup(pos blockPos) (int, bool) {
+	if f.index == nil {
+		f.index = make(map[blockPos]int, len(f.profile.Blocks))
+		for i := range f.profile.Blocks {
+			f.index[posOf(&f.profile.Blocks[i])] = i
+		}
+	}
+	i, ok := f.index[pos]
+	return i, ok
+}
+
+// parseBlock parses a line in the form of "name.go:line.column,line.column numberOfStatements count"
+// from the end, as the file name may contain any of the separators
+func parseBlock(l []byte) (fileName []byte, pos blockPos, numStmt, count int, err error) {
+	end := len(l)
+	if count, end, err = seekBackInt(l, ' ', end, "Count"); err != nil {
+		return
+	}
+	if numStmt, end, err = seekBackInt(l, ' ', end, "NumStmt"); err != nil {
+		return
+	}
+	if pos.endCol, end, err = seekBackInt(l, '.', end, "EndCol"); err != nil {
+		return
+	}
+	if pos.endLine, end, err = seekBackInt(l, ',', end, "EndLine"); err != nil {
+		return
+	}
+	if pos.startCol, end, err = seekBackInt(l, '.', end, "StartCol"); err != nil {
+		return
+	}
+	if pos.startLine, end, err = seekBackInt(l, ':', end, "StartLine"); err != nil {
+		return
+	}
+	if end == 0 {
+		err = fmt.Errorf("a FileName cannot be blank")
+		return
+	}
+	return l[:end], pos, numStmt, count, nil
+}
+
+// seekBackInt parses the non-negative number between the last sep before end and end
+func seekBackInt(l []byte, sep byte, end int, what string) (value int, nextSep int, err error) {
+	start := bytes.LastIndexByte(l[:end], sep)
+	if start < 0 {
+		return 0, 0, fmt.Errorf("couldn't find a %s before %s", string(sep), what)
+	}
+	digits := l[start+1 : end]
+	if len(digits) == 0 {
+		return 0, 0, fmt.Errorf("couldn't parse %q: empty", what)
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, 0, fmt.Errorf("couldn't parse %q: invalid number %q", what, digits)
+		}
+		value = value*10 + int(c-'0')
+		if value < 0 {
+			return 0, 0, fmt.Errorf("couldn't parse %q: %q out of range", what, digits)
+		}
+	}
+	return value, start, nil
+}
+
+// ParseProfile reads the profile in the text format from r
+func ParseProfile(r io.Reader) ([]*cover.Profile, error) {
+	m := NewProfileMerger()
+	if err := m.Parse(r); err != nil {
+		return nil, err
+	}
+	return m.Profiles(), nil
+}
+
+// mergeProfiles merges the parsed profiles into a new one
+func mergeProfiles(profiles [][]*cover.Profile) ([]*cover.Profile, error) {
+	m := NewProfileMerger()
+	for _, p := range profiles {
+		if err := m.Add(p); err != nil {
+			return nil, err
+		}
+	}
+	return m.Profiles(), nil
+}
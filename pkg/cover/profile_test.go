@@ -0,0 +1,230 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/tools/cover"
+	"k8s.io/test-infra/gopherage/pkg/cov"
+)
+
+// tempFileProfile is how the profiles were parsed before ProfileMerger,
+// kept as the baseline of the benchmarks
+func tempFileProfile(p []byte) ([]*cover.Profile, error) {
+	tf, err := ioutil.TempFile("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer tf.Close()
+	defer os.Remove(tf.Name())
+	if _, err := io.Copy(tf, bytes.NewReader(p)); err != nil {
+		return nil, err
+	}
+	return cover.ParseProfiles(tf.Name())
+}
+
+// genProfile generates a profile of the given number of files and blocks in every file
+func genProfile(files, blocks, count int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("mode: count\n")
+	for f := 0; f < files; f++ {
+		for b := 0; b < blocks; b++ {
+			fmt.Fprintf(&buf, "github.com/qiniu/goc/mock/pkg%d/file.go:%d.2,%d.16 %d %d\n", f, b*3+1, b*3+2, b%5+1, (b+count)%3)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestParseProfile(t *testing.T) {
+	tcs := []struct {
+		name    string
+		profile string
+	}{
+		{name: "single", profile: "mode: count\nmockService/main.go:30.13,48.33 13 1\n"},
+		{name: "unsorted", profile: "mode: count\nb.go:5.1,6.2 1 1\na.go:9.1,10.2 2 0\na.go:1.1,2.2 3 4\n"},
+		{name: "duplicate blocks", profile: "mode: count\na.go:1.1,2.2 3 4\na.go:1.1,2.2 3 5\n"},
+		{name: "set mode", profile: "mode: set\na.go:1.1,2.2 3 1\na.go:1.1,2.2 3 1\n"},
+		{name: "file name with separators", profile: "mode: atomic\nexample.com/a b.c:d/main.go:1.1,2.2 3 4\n"},
+		{name: "generated", profile: string(genProfile(3, 50, 1))},
+	}
+	for _, tc := range tcs {
+		expected, err := tempFileProfile([]byte(tc.profile))
+		assert.NoError(t, err, tc.name)
+		actual, err := ParseProfile(strings.NewReader(tc.profile))
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, expected, actual, tc.name)
+	}
+
+	// empty response of a center having no service selected
+	profile, err := ParseProfile(strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Empty(t, profile)
+
+	for _, invalid := range []string{
+		"mockService/main.go:30.13,48.33 13 1\n",
+		"mode: \n",
+		"mode: count\nmockService/main.go:30.13,48.33 13\n",
+		"mode: count\nmockService/main.go:30.13,48.33 13 -1\n",
+		"mode: count\n:30.13,48.33 13 1\n",
+		"mode: count\na.go:1.1,2.2 3 4\na.go:1.1,2.2 2 5\n",
+	} {
+		_, err := ParseProfile(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestProfileMerger(t *testing.T) {
+	a, b := genProfile(4, 20, 1), genProfile(4, 20, 2)
+	pa, err := tempFileProfile(a)
+	assert.NoError(t, err)
+	pb, err := tempFileProfile(b)
+	assert.NoError(t, err)
+	expected, err := cov.MergeMultipleProfiles([][]*cover.Profile{pa, pb})
+	assert.NoError(t, err)
+
+	m := NewProfileMerger()
+	assert.NoError(t, m.Parse(bytes.NewReader(a)))
+	assert.NoError(t, m.Parse(bytes.NewReader(b)))
+	assert.Equal(t, expected, m.Profiles())
+
+	merged, err := mergeProfiles([][]*cover.Profile{pa, pb})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, merged)
+	// the profiles merged are not modified
+	reparsed, err := tempFileProfile(a)
+	assert.NoError(t, err)
+	assert.Equal(t, reparsed, pa)
+
+	// a file only in one of the profiles is kept, in order
+	m = NewProfileMerger()
+	assert.NoError(t, m.Parse(strings.NewReader("mode: count\nb.go:1.1,2.2 3 1\n")))
+	assert.NoError(t, m.Parse(strings.NewReader("mode: count\na.go:1.1,2.2 3 1\nb.go:1.1,2.2 3 1\n")))
+	profiles := m.Profiles()
+	assert.Equal(t, 2, len(profiles))
+	assert.Equal(t, "a.go", profiles[0].FileName)
+	assert.Equal(t, 2, profiles[1].Blocks[0].Count)
+
+	// a block listed several times in a profile, as by go test -coverpkg, is merged into one
+	dup := "mode: count\na.go:3.10,5.2 1 1\na.go:6.10,8.2 1 0\na.go:3.10,5.2 1 2\na.go:6.10,8.2 1 1\n"
+	m = NewProfileMerger()
+	assert.NoError(t, m.Parse(strings.NewReader(dup)))
+	assert.NoError(t, m.Parse(strings.NewReader(dup)))
+	profiles = m.Profiles()
+	assert.Equal(t, 1, len(profiles))
+	assert.Equal(t, 2, len(profiles[0].Blocks))
+	assert.Equal(t, 6, profiles[0].Blocks[0].Count)
+	assert.Equal(t, 2, profiles[0].Blocks[1].Count)
+	pd, err := tempFileProfile([]byte(dup))
+	assert.NoError(t, err)
+	merged, err = mergeProfiles([][]*cover.Profile{pd, pd, pd})
+	assert.NoError(t, err)
+	assert.Equal(t, 9, merged[0].Blocks[0].Count)
+	assert.Equal(t, 3, merged[0].Blocks[1].Count)
+
+	// the profiles must be coherent like cov.MergeProfiles requires
+	for _, incoherent := range []string{
+		"mode: set\na.go:1.1,2.2 3 1\n",
+		"mode: count\na.go:1.1,2.2 3 1\na.go:3.1,4.2 3 1\n",
+		"mode: count\na.go:1.1,2.2 2 1\nb.go:1.1,2.2 3 1\n",
+		"mode: count\nb.go:1.1,2.2 3 1\n",
+	} {
+		m = NewProfileMerger()
+		assert.NoError(t, m.Parse(strings.NewReader("mode: count\na.go:1.1,2.2 3 1\nb.go:1.1,2.2 3 1\nb.go:3.1,4.2 3 1\n")))
+		assert.Error(t, m.Parse(strings.NewReader(incoherent)), incoherent)
+	}
+	_, err = mergeProfiles([][]*cover.Profile{pa, pb[1:]})
+	assert.NoError(t, err)
+	pb[0].Blocks = pb[0].Blocks[1:]
+	_, err = mergeProfiles([][]*cover.Profile{pa, pb})
+	assert.Error(t, err)
+}
+
+const (
+	benchAgents = 8
+	benchFiles  = 200
+	benchBlocks = 500
+)
+
+func benchProfiles() [][]byte {
+	res := make([][]byte, benchAgents)
+	for i := range res {
+		res[i] = genProfile(benchFiles, benchBlocks, i)
+	}
+	return res
+}
+
+func BenchmarkMergeWithTempFiles(b *testing.B) {
+	responses := benchProfiles()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		profiles := make([][]*cover.Profile, 0, len(responses))
+		for _, resp := range responses {
+			p, err := tempFileProfile(resp)
+			if err != nil {
+				b.Fatal(err)
+			}
+			profiles = append(profiles, p)
+		}
+		if _, err := cov.MergeMultipleProfiles(profiles); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProfileMerger(b *testing.B) {
+	responses := benchProfiles()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := NewProfileMerger()
+		for _, resp := range responses {
+			if err := m.Parse(bytes.NewReader(resp)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		m.Profiles()
+	}
+}
+
+// BenchmarkParseAndMerge is the path of the center, which keeps the profile of every agent
+func BenchmarkParseAndMerge(b *testing.B) {
+	responses := benchProfiles()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		profiles := make([][]*cover.Profile, 0, len(responses))
+		for _, resp := range responses {
+			p, err := ParseProfile(bytes.NewReader(resp))
+			if err != nil {
+				b.Fatal(err)
+			}
+			profiles = append(profiles, p)
+		}
+		if _, err := mergeProfiles(profiles); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadProfile receives the profile pushed by a service in push mode,
+// which is used instead of fetching it from the service.
+// POST /v1/cover/upload?name=xxx&address=xxx with the profile as body
+func (s *server) uploadProfile(c *gin.Context) {
+	service, err := s.bindService(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	profile, err := ParseProfile(bytes.NewReader(body))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.ensureRegistered(service); err != nil {
+		c.JSON(registerStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	s.agents.heartbeat(service.Address, now)
+	s.persistHealth(service.Address)
+	prev, _ := s.profiles.get(service.Address)
+	s.profiles.push(service.Name, service.Address, profile, now)
+	s.publishProfile(service.Name, service.Address, prev, profile)
+	s.forwardToPeers(c, CoverUploadAPI, service, body)
+
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+}
@@ -0,0 +1,79 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadProfile(t *testing.T) {
+	s := &server{
+		Store: NewMemoryStore(),
+	}
+	router := s.Route(os.Stdout)
+
+	// upload without service
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/cover/upload", strings.NewReader("mode: count\n"))
+	req.Header.Set("Content-Type", "text/plain")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// upload an invalid profile
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/cover/upload?name=foo&address=http://:64447", strings.NewReader("error"))
+	req.Header.Set("Content-Type", "text/plain")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "bad mode line")
+
+	// upload from a service behind NAT, which can not be reached by the center
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/cover/upload?name=foo&address=http://:64447", strings.NewReader("mode: count\nmockService/main.go:30.13,48.33 13 2\n"))
+	req.Header.Set("Content-Type", "text/plain")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"http://:64447"}, s.Store.Get("foo"))
+	assert.Equal(t, HealthHealthy, s.agents.status("http://:64447").health)
+
+	// the pushed profile is used instead of fetching it from the service
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v1/cover/profile", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "mockService/main.go:30.13,48.33 13 2")
+
+	// the pushed profile is retained after the service deregisters
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v1/cover/remove", strings.NewReader(`{"address":["http://:64447"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, s.Store.GetAll())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v1/cover/profile?service=foo", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "mockService/main.go:30.13,48.33 13 2")
+}
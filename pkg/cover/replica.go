@@ -0,0 +1,620 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// replicaHeader marks the requests forwarded by a peer center
+const replicaHeader = "X-Goc-Replica"
+
+// replicaTimeout bounds a request to a peer
+const replicaTimeout = 5 * time.Second
+
+// ReplicaEntry is the replicated state of a registered service.
+// The entry with the greater version wins, the origin breaks the ties.
+type ReplicaEntry struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Removed bool   `json:"removed,omitempty"`
+	Version int64  `json:"version"`
+	Origin  string `json:"origin"`
+}
+
+func (e ReplicaEntry) newerThan(o ReplicaEntry) bool {
+	if e.Version != o.Version {
+		return e.Version > o.Version
+	}
+	return e.Origin > o.Origin
+}
+
+// ReplicaState is the registry shared by the centers, exchanged in full between them
+type ReplicaState struct {
+	// ID identifies the center sending the state
+	ID string `json:"id,omitempty"`
+	// Cleared is the version of the last init, the older entries are dropped
+	Cleared    int64          `json:"cleared"`
+	Entries    []ReplicaEntry `json:"entries"`
+	Tombstones []Tombstone    `json:"tombstones,omitempty"`
+}
+
+// replicatedStore shares the registered services with the peer centers.
+// Every change is pushed to the peers right away, and the states of the peers are
+// pulled periodically to converge after a center restarts or a push is lost.
+// The services are kept in the local store, which is what the center reads.
+type replicatedStore struct {
+	mu         sync.Mutex
+	local      Store
+	id         string
+	peers      []string
+	token      string // presented to the peers
+	client     *http.Client
+	cleared    int64
+	entries    map[string]ReplicaEntry // by name and address
+	tombstones map[string]Tombstone    // by address
+	peerIDs    map[string]string       // the peers by their ids, learned from their states
+
+	// onTombstone and onInit are called when a tombstone or an init is replicated from a peer
+	onTombstone func(t Tombstone)
+	onInit      func()
+}
+
+// NewReplicatedStore creates a store sharing the services kept in local with the peer centers
+func NewReplicatedStore(local Store, peers []string) *replicatedStore {
+	r := &replicatedStore{
+		local:      local,
+		id:         newReplicaID(),
+		peers:      peers,
+		client:     &http.Client{Timeout: replicaTimeout},
+		entries:    make(map[string]ReplicaEntry),
+		tombstones: make(map[string]Tombstone),
+		peerIDs:    make(map[string]string),
+	}
+	// the services kept before the center restarted are the oldest changes
+	for name, addrs := range local.GetAll() {
+		for _, addr := range addrs {
+			r.entries[entryKey(name, addr)] = ReplicaEntry{Name: name, Address: addr, Origin: r.id}
+		}
+	}
+	return r
+}
+
+func newReplicaID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func entryKey(name, addr string) string {
+	return name + "&" + addr
+}
+
+// version returns a version greater than all the ones known
+func (r *replicatedStore) version() int64 {
+	v := time.Now().UnixNano()
+	if v <= r.cleared {
+		v = r.cleared + 1
+	}
+	for _, e := range r.entries {
+		if v <= e.Version {
+			v = e.Version + 1
+		}
+	}
+	return v
+}
+
+// Add adds the given service to the local store and the peers
+func (r *replicatedStore) Add(s ServiceUnderTest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.local.Add(s); err != nil {
+		return err
+	}
+	r.entries[entryKey(s.Name, s.Address)] = ReplicaEntry{Name: s.Name, Address: s.Address, Version: r.version(), Origin: r.id}
+	go r.push(r.stateLocked())
+	return nil
+}
+
+// Get returns the registered service information with the given name
+func (r *replicatedStore) Get(name string) []string {
+	return r.local.Get(name)
+}
+
+// Get returns all the registered service information
+func (r *replicatedStore) GetAll() map[string][]string {
+	return r.local.GetAll()
+}
+
+// Init cleanup all the registered service information of all the centers
+func (r *replicatedStore) Init() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.local.Init(); err != nil {
+		return err
+	}
+	r.cleared = r.version()
+	r.entries = make(map[string]ReplicaEntry)
+	r.tombstones = make(map[string]Tombstone)
+	go r.push(r.stateLocked())
+	return nil
+}
+
+// Set stores the services information into the local store and the peers
+func (r *replicatedStore) Set(services map[string][]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.local.Set(services); err != nil {
+		return err
+	}
+	v := r.version()
+	kept := make(map[string]bool)
+	for name, addrs := range services {
+		for _, addr := range addrs {
+			key := entryKey(name, addr)
+			kept[key] = true
+			if e, ok := r.entries[key]; !ok || e.Removed {
+				r.entries[key] = ReplicaEntry{Name: name, Address: addr, Version: v, Origin: r.id}
+			}
+		}
+	}
+	for key, e := range r.entries {
+		if !kept[key] && !e.Removed {
+			r.entries[key] = ReplicaEntry{Name: e.Name, Address: e.Address, Removed: true, Version: v, Origin: r.id}
+		}
+	}
+	go r.push(r.stateLocked())
+	return nil
+}
+
+// Remove the service from the local store and the peers by address
+func (r *replicatedStore) Remove(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.local.Remove(addr); err != nil {
+		return err
+	}
+	v := r.version()
+	for key, e := range r.entries {
+		if e.Address == addr && !e.Removed {
+			r.entries[key] = ReplicaEntry{Name: e.Name, Address: addr, Removed: true, Version: v, Origin: r.id}
+		}
+	}
+	go r.push(r.stateLocked())
+	return nil
+}
+
+// Records returns the records kept by the local store,
+// or the bare services if it does not keep records
+func (r *replicatedStore) Records() ([]ServiceRecord, error) {
+	if rs, ok := r.local.(RecordStore); ok {
+		return rs.Records()
+	}
+	var records []ServiceRecord
+	for name, addrs := range r.local.GetAll() {
+		for _, addr := range addrs {
+			records = append(records, ServiceRecord{Name: name, Address: addr})
+		}
+	}
+	return records, nil
+}
+
+// UpdateHealth persists the liveness into the local store if it keeps records,
+// the liveness is not replicated since every center checks it by itself
+func (r *replicatedStore) UpdateHealth(addr, health string, lastHeartbeat time.Time) error {
+	if rs, ok := r.local.(RecordStore); ok {
+		return rs.UpdateHealth(addr, health, lastHeartbeat)
+	}
+	return nil
+}
+
+// UpdateLabels persists the labels into the local store if it keeps records,
+// the labels reach the peers with the heartbeats forwarded
+func (r *replicatedStore) UpdateLabels(addr string, labels map[string]string) error {
+	if rs, ok := r.local.(RecordStore); ok {
+		return rs.UpdateLabels(addr, labels)
+	}
+	return nil
+}
+
+// PutTombstone shares the tombstone with the peers
+func (r *replicatedStore) PutTombstone(t Tombstone) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.putTombstoneLocked(t); err != nil {
+		return err
+	}
+	go r.push(r.stateLocked())
+	return nil
+}
+
+func (r *replicatedStore) putTombstoneLocked(t Tombstone) error {
+	r.tombstones[t.Address] = t
+	rs, ok := r.local.(RecordStore)
+	if !ok {
+		return nil
+	}
+	if t.Dropped {
+		return rs.DropTombstone(t.Address)
+	}
+	return rs.PutTombstone(t)
+}
+
+// DropTombstone drops the tombstone of the address, the peers drop it as well
+func (r *replicatedStore) DropTombstone(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the dropped tombstone is kept as a marker newer than the one dropped
+	if err := r.putTombstoneLocked(Tombstone{Address: addr, Collected: time.Now(), Dropped: true}); err != nil {
+		return err
+	}
+	go r.push(r.stateLocked())
+	return nil
+}
+
+// Tombstones returns the tombstones of all the centers
+func (r *replicatedStore) Tombstones() ([]Tombstone, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]Tombstone, 0, len(r.tombstones))
+	for _, t := range r.tombstones {
+		if !t.Dropped {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+// state returns the replicated registry
+func (r *replicatedStore) state() ReplicaState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stateLocked()
+}
+
+func (r *replicatedStore) stateLocked() ReplicaState {
+	st := ReplicaState{ID: r.id, Cleared: r.cleared, Entries: make([]ReplicaEntry, 0, len(r.entries))}
+	for _, e := range r.entries {
+		st.Entries = append(st.Entries, e)
+	}
+	sort.Slice(st.Entries, func(i, j int) bool {
+		return entryKey(st.Entries[i].Name, st.Entries[i].Address) < entryKey(st.Entries[j].Name, st.Entries[j].Address)
+	})
+	for _, t := range r.tombstones {
+		st.Tombstones = append(st.Tombstones, t)
+	}
+	return st
+}
+
+// merge applies the state of a peer, the local store follows the newer entries
+func (r *replicatedStore) merge(st ReplicaState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if st.Cleared > r.cleared {
+		if err := r.local.Init(); err != nil {
+			log.Errorf("failed to replicate init, err: %v", err)
+			return
+		}
+		r.cleared = st.Cleared
+		for key, e := range r.entries {
+			if e.Version <= r.cleared {
+				delete(r.entries, key)
+			} else if !e.Removed {
+				r.addLocal(e)
+			}
+		}
+		for addr, t := range r.tombstones {
+			if t.Collected.UnixNano() <= r.cleared {
+				delete(r.tombstones, addr)
+			}
+		}
+		if r.onInit != nil {
+			r.onInit()
+		}
+	}
+
+	for _, e := range st.Entries {
+		if e.Version <= r.cleared {
+			continue
+		}
+		key := entryKey(e.Name, e.Address)
+		if cur, ok := r.entries[key]; ok && !e.newerThan(cur) {
+			continue
+		}
+		r.entries[key] = e
+		if e.Removed {
+			r.removeLocal(e)
+		} else {
+			r.addLocal(e)
+		}
+	}
+
+	for _, t := range st.Tombstones {
+		if t.Collected.UnixNano() <= r.cleared {
+			continue
+		}
+		if cur, ok := r.tombstones[t.Address]; ok && !t.Collected.After(cur.Collected) {
+			continue
+		}
+		if err := r.putTombstoneLocked(t); err != nil {
+			log.Warnf("failed to persist the tombstone of %s replicated, err: %v", t.Address, err)
+		}
+		if r.onTombstone != nil {
+			r.onTombstone(t)
+		}
+	}
+}
+
+func (r *replicatedStore) addLocal(e ReplicaEntry) {
+	if contains(r.local.Get(e.Name), e.Address) {
+		return
+	}
+	if err := r.local.Add(ServiceUnderTest{Name: e.Name, Address: e.Address}); err != nil && err != ErrServiceAlreadyRegistered {
+		log.Errorf("failed to replicate the registration of %s, err: %v", e.Address, err)
+	}
+}
+
+func (r *replicatedStore) removeLocal(e ReplicaEntry) {
+	// the store removes an address from all the services, add back the others
+	if !contains(r.local.Get(e.Name), e.Address) {
+		return
+	}
+	var others []string
+	for name, addrs := range r.local.GetAll() {
+		if name != e.Name && contains(addrs, e.Address) {
+			others = append(others, name)
+		}
+	}
+	if err := r.local.Remove(e.Address); err != nil {
+		log.Errorf("failed to replicate the removal of %s, err: %v", e.Address, err)
+		return
+	}
+	for _, name := range others {
+		r.addLocal(ReplicaEntry{Name: name, Address: e.Address})
+	}
+}
+
+// push sends the state to all the peers
+func (r *replicatedStore) push(st ReplicaState) {
+	body, err := json.Marshal(st)
+	if err != nil {
+		log.Errorf("failed to encode the replica state, err: %v", err)
+		return
+	}
+	for _, peer := range r.peers {
+		if err := r.send(peer, "POST", CoverReplicaAPI, nil, body, r.token, ""); err != nil {
+			log.Warnf("failed to push the registry to peer %s, err: %v", peer, err)
+		}
+	}
+}
+
+// pull fetches the states of all the peers and merges them
+func (r *replicatedStore) pull() {
+	for _, peer := range r.peers {
+		st, err := r.fetch(peer)
+		if err != nil {
+			log.Warnf("failed to pull the registry from peer %s, err: %v", peer, err)
+			continue
+		}
+		if st.ID != "" {
+			r.mu.Lock()
+			r.peerIDs[st.ID] = peer
+			r.mu.Unlock()
+		}
+		r.merge(st)
+	}
+}
+
+// fetch gets the state of the peer
+func (r *replicatedStore) fetch(peer string) (ReplicaState, error) {
+	var st ReplicaState
+	req, err := http.NewRequest("GET", peer+CoverReplicaAPI, nil)
+	if err != nil {
+		return st, err
+	}
+	setToken(req, r.token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return st, fmt.Errorf("status code %d, %s", resp.StatusCode, msg)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return st, fmt.Errorf("invalid registry, err: %v", err)
+	}
+	return st, nil
+}
+
+// peer returns the url of the peer with the id, known once its state is pulled
+func (r *replicatedStore) peer(id string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.peerIDs[id]
+	return u, ok
+}
+
+// forward replays the request sent by a service on the peers,
+// so that all the centers see the service alive and share its pushed profile.
+// The token and the key of the service are forwarded too, for the peers to call the service with the key.
+func (r *replicatedStore) forward(api string, query url.Values, service ServiceUnderTest, body []byte) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("name", service.Name)
+	query.Set("address", service.Address)
+	for k, v := range service.Labels {
+		query.Add("label", k+"="+v)
+	}
+	token := service.Token
+	if token == "" {
+		token = r.token
+	}
+	for _, peer := range r.peers {
+		if err := r.send(peer, "POST", api, query, body, token, service.Key); err != nil {
+			log.Warnf("failed to forward %s of %s to peer %s, err: %v", api, service.Address, peer, err)
+		}
+	}
+}
+
+func (r *replicatedStore) send(peer, method, api string, query url.Values, body []byte, token, key string) error {
+	u := peer + api
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(replicaHeader, r.id)
+	setToken(req, token)
+	if key != "" {
+		req.Header.Set(agentKeyHeader, key)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status code %d, %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// enableReplication shares the registry of the center with the peers
+func (s *server) enableReplication() *replicatedStore {
+	r := NewReplicatedStore(s.Store, s.Peers)
+	r.token = s.PeerToken
+	r.client.Transport = s.transport()
+	if rs, ok := s.Store.(RecordStore); ok {
+		if tombstones, err := rs.Tombstones(); err == nil {
+			for _, t := range tombstones {
+				r.tombstones[t.Address] = t
+			}
+		}
+	}
+	r.onTombstone = s.entomb
+	r.onInit = func() {
+		s.agents.reset()
+		s.profiles.reset()
+		s.labels.reset()
+		s.agentTokens.reset()
+		s.sessions.reset()
+	}
+	s.Store = r
+	return r
+}
+
+// watchPeers syncs the registry with the peers periodically until the process exits
+func (s *server) watchPeers(r *replicatedStore) {
+	r.pull()
+	if s.SyncInterval <= 0 {
+		return
+	}
+	for range time.Tick(s.SyncInterval) {
+		r.pull()
+	}
+}
+
+// replicated returns the replicated store if the center has peers
+func (s *server) replicated() (*replicatedStore, bool) {
+	r, ok := s.Store.(*replicatedStore)
+	return r, ok
+}
+
+// forwardToPeers replays the request of a service on the peers,
+// unless the request is forwarded by a peer already
+func (s *server) forwardToPeers(c *gin.Context, api string, service ServiceUnderTest, body []byte) {
+	r, ok := s.replicated()
+	if !ok || c.GetHeader(replicaHeader) != "" {
+		return
+	}
+	go r.forward(api, nil, service, body)
+}
+
+// forwardTunnelToPeers tells the peers that the service polling its tunnel is alive,
+// and that they reach it through this center
+func (s *server) forwardTunnelToPeers(c *gin.Context, service ServiceUnderTest) {
+	r, ok := s.replicated()
+	if !ok || c.GetHeader(replicaHeader) != "" {
+		return
+	}
+	go r.forward(CoverHeartbeatAPI, url.Values{"tunnel": {"true"}}, service, nil)
+}
+
+// tunnelPeer returns the peer center the service at the address has its tunnel connected to,
+// and the token to call the peer with
+func (s *server) tunnelPeer(addr string) (string, string, bool) {
+	r, ok := s.replicated()
+	if !ok {
+		return "", "", false
+	}
+	id, ok := s.tunnels.peer(addr)
+	if !ok {
+		return "", "", false
+	}
+	peer, ok := r.peer(id)
+	return peer, r.token, ok
+}
+
+// replicaState returns the replicated registry of the center
+// GET /v1/cover/replica
+func (s *server) replicaState(c *gin.Context) {
+	r, ok := s.replicated()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "replication is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, r.state())
+}
+
+// mergeReplica merges the registry pushed by a peer
+// POST /v1/cover/replica
+func (s *server) mergeReplica(c *gin.Context) {
+	r, ok := s.replicated()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "replication is not enabled"})
+		return
+	}
+	var st ReplicaState
+	if err := c.ShouldBindJSON(&st); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r.merge(st)
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+}
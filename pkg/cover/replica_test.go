@@ -0,0 +1,139 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicatedStoreMerge(t *testing.T) {
+	r := NewReplicatedStore(NewMemoryStore(), nil)
+	assert.NoError(t, r.Add(ServiceUnderTest{Name: "foo", Address: "http://127.0.0.1:8000"}))
+	assert.NoError(t, r.Add(ServiceUnderTest{Name: "bar", Address: "http://127.0.0.1:8000"}))
+	added := r.state().Entries[1].Version // of foo, ordered after bar
+
+	// the older changes of a peer are ignored, the newer ones are applied
+	r.merge(ReplicaState{Entries: []ReplicaEntry{
+		{Name: "foo", Address: "http://127.0.0.1:8000", Removed: true, Version: added - 1, Origin: "peer"},
+		{Name: "foo", Address: "http://127.0.0.1:8001", Version: added + 1, Origin: "peer"},
+	}})
+	assert.Equal(t, map[string][]string{
+		"foo": {"http://127.0.0.1:8000", "http://127.0.0.1:8001"},
+		"bar": {"http://127.0.0.1:8000"},
+	}, r.GetAll())
+
+	// removing the address of one service keeps it in the other
+	r.merge(ReplicaState{Entries: []ReplicaEntry{
+		{Name: "foo", Address: "http://127.0.0.1:8000", Removed: true, Version: added + 2, Origin: "peer"},
+	}})
+	assert.Equal(t, map[string][]string{
+		"foo": {"http://127.0.0.1:8001"},
+		"bar": {"http://127.0.0.1:8000"},
+	}, r.GetAll())
+
+	// init on a peer drops the older entries only
+	cleared := r.version()
+	r.merge(ReplicaState{Cleared: cleared, Entries: []ReplicaEntry{
+		{Name: "baz", Address: "http://127.0.0.1:8002", Version: cleared + 1, Origin: "peer"},
+	}})
+	assert.Equal(t, map[string][]string{"baz": {"http://127.0.0.1:8002"}}, r.GetAll())
+}
+
+func TestReplicatedCenters(t *testing.T) {
+	profileMockSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 1"))
+	}))
+	defer profileMockSvr.Close()
+
+	a := &server{Store: NewMemoryStore()}
+	b := &server{Store: NewMemoryStore()}
+	tsA := httptest.NewServer(a.Route(os.Stdout))
+	defer tsA.Close()
+	tsB := httptest.NewServer(b.Route(os.Stdout))
+	defer tsB.Close()
+	a.Peers = []string{tsB.URL}
+	b.Peers = []string{tsA.URL}
+	a.enableReplication()
+	b.enableReplication()
+
+	replicated := func(s *server, expected map[string][]string) func() bool {
+		return func() bool {
+			return reflect.DeepEqual(expected, s.Store.GetAll())
+		}
+	}
+
+	// register to one center, profile from the other
+	assert.NoError(t, a.Store.Add(ServiceUnderTest{Name: "foo", Address: profileMockSvr.URL}))
+	assert.Eventually(t, replicated(b, map[string][]string{"foo": {profileMockSvr.URL}}), time.Second, 10*time.Millisecond)
+	res, err := NewWorker(tsB.URL).Profile(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 1")
+
+	// the profile of the service removed from one center is retained by both
+	_, err = NewWorker(tsB.URL).Remove(ProfileParam{Address: []string{profileMockSvr.URL}})
+	assert.NoError(t, err)
+	assert.Eventually(t, replicated(a, map[string][]string{}), time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(a.profiles.buried(nil)) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// init on one center cleans up both
+	assert.NoError(t, b.Store.Add(ServiceUnderTest{Name: "bar", Address: profileMockSvr.URL}))
+	assert.Eventually(t, replicated(a, map[string][]string{"bar": {profileMockSvr.URL}}), time.Second, 10*time.Millisecond)
+	_, err = NewWorker(tsA.URL).InitSystem()
+	assert.NoError(t, err)
+	assert.Eventually(t, replicated(b, map[string][]string{}), time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(b.profiles.buried(nil)) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the tombstone cleared on one center is dropped by both
+	assert.NoError(t, a.Store.Add(ServiceUnderTest{Name: "foo", Address: profileMockSvr.URL}))
+	assert.Eventually(t, replicated(b, map[string][]string{"foo": {profileMockSvr.URL}}), time.Second, 10*time.Millisecond)
+	_, err = NewWorker(tsA.URL).Remove(ProfileParam{Address: []string{profileMockSvr.URL}})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(b.profiles.buried(nil)) == 1
+	}, time.Second, 10*time.Millisecond)
+	_, err = NewWorker(tsB.URL).Clear(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(a.profiles.buried(nil)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReplicatedStoreFetch(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"invalid token"}`))
+	}))
+	defer peer.Close()
+
+	// the error of the peer is not taken as an empty registry
+	r := NewReplicatedStore(NewMemoryStore(), []string{peer.URL})
+	_, err := r.fetch(peer.URL)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "status code 401")
+}
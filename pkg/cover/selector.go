@@ -0,0 +1,206 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// requirement is a single condition of a Selector on the value of a label
+type requirement struct {
+	key   string
+	equal bool
+	value string
+}
+
+// Selector selects the services by their labels, e.g. "env=staging,version!=v1".
+// A service is selected if all the requirements are met, a label missing
+// never equals a value. The empty selector selects all the services.
+type Selector []requirement
+
+// ParseSelector parses the selector in the form of "k1=v1,k2!=v2", "==" is the same as "="
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var r requirement
+		switch {
+		case strings.Contains(term, "!="):
+			kv := strings.SplitN(term, "!=", 2)
+			r = requirement{key: kv[0], equal: false, value: kv[1]}
+		case strings.Contains(term, "=="):
+			kv := strings.SplitN(term, "==", 2)
+			r = requirement{key: kv[0], equal: true, value: kv[1]}
+		case strings.Contains(term, "="):
+			kv := strings.SplitN(term, "=", 2)
+			r = requirement{key: kv[0], equal: true, value: kv[1]}
+		default:
+			return nil, fmt.Errorf("invalid selector term %q, should be key=value or key!=value", term)
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if r.key == "" {
+			return nil, fmt.Errorf("invalid selector term %q, the key is empty", term)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// Matches reports whether the labels meet all the requirements of the selector
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		v, ok := labels[r.key]
+		if (ok && v == r.value) != r.equal {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLabels parses the labels in the form of "k1=v1,k2=v2"
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid label %q, should be key=value", kv)
+		}
+		labels[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	return labels, nil
+}
+
+// formatLabels formats the labels in the form of "k1=v1,k2=v2" ordered by key
+func formatLabels(labels map[string]string) string {
+	kvs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// labelIndex holds the labels registered by every address, which are kept
+// after the address is removed so that its tombstone can still be selected.
+// The zero value is ready to use.
+type labelIndex struct {
+	mu     sync.Mutex
+	labels map[string]map[string]string
+}
+
+// set records the labels of the address, it reports whether they changed
+func (li *labelIndex) set(addr string, labels map[string]string) bool {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if li.labels == nil {
+		li.labels = make(map[string]map[string]string)
+	}
+	if reflect.DeepEqual(li.labels[addr], labels) {
+		return false
+	}
+	li.labels[addr] = labels
+	return true
+}
+
+func (li *labelIndex) get(addr string) map[string]string {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	return li.labels[addr]
+}
+
+func (li *labelIndex) reset() {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	li.labels = nil
+}
+
+// matcher returns whether a service at an address is selected by the names,
+// addresses, name patterns and label selector in the param
+func (s *server) matcher(p ProfileParam) (func(name, addr string) bool, error) {
+	sel, err := ParseSelector(p.Selector)
+	if err != nil {
+		return nil, err
+	}
+	patterns := make([]*regexp.Regexp, 0, len(p.ServicePatterns))
+	for _, pattern := range p.ServicePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service pattern %s, err: %v", pattern, err)
+		}
+		patterns = append(patterns, re)
+	}
+
+	return func(name, addr string) bool {
+		if len(p.Service) > 0 || len(p.Address) > 0 || len(patterns) > 0 {
+			selected := contains(p.Service, name) || contains(p.Address, addr)
+			for _, re := range patterns {
+				selected = selected || re.MatchString(name)
+			}
+			if !selected {
+				return false
+			}
+		}
+		return sel.Matches(s.labels.get(addr))
+	}, nil
+}
+
+// selectAddrs returns the registered addresses selected by the param, and the matcher of it.
+// Unless force is set, the services and addresses given explicitly must be registered.
+func (s *server) selectAddrs(p ProfileParam, force bool, allInfos map[string][]string) ([]string, func(name, addr string) bool, error) {
+	match, err := s.matcher(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	filterAddrList, err := filterAddrs(p.Service, p.Address, force, allInfos)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(p.ServicePatterns) > 0 {
+		// the services matching the patterns are selected besides the ones given
+		filterAddrList = nil
+		for _, addrs := range allInfos {
+			filterAddrList = append(filterAddrList, addrs...)
+		}
+	}
+
+	names := serviceNames(allInfos)
+	selected := make([]string, 0, len(filterAddrList))
+	for _, addr := range filterAddrList {
+		if match(names[addr], addr) {
+			selected = append(selected, addr)
+		}
+	}
+	if len(selected) < len(filterAddrList) {
+		log.Infof("%d of %d addresses selected by service patterns %v and selector %q", len(selected), len(filterAddrList), p.ServicePatterns, p.Selector)
+	}
+	return selected, match, nil
+}
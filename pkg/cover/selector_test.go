@@ -0,0 +1,119 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"env": "staging", "version": "v2"}
+	tcs := []struct {
+		selector string
+		matches  bool
+		err      bool
+	}{
+		{selector: "", matches: true},
+		{selector: "env=staging", matches: true},
+		{selector: "env==staging,version!=v1", matches: true},
+		{selector: "env=staging, version=v1", matches: false},
+		{selector: "env!=staging", matches: false},
+		{selector: "pod=foo", matches: false},
+		{selector: "pod!=foo", matches: true},
+		{selector: "env", err: true},
+		{selector: "=staging", err: true},
+	}
+	for _, tc := range tcs {
+		sel, err := ParseSelector(tc.selector)
+		if tc.err {
+			assert.Error(t, err, tc.selector)
+			continue
+		}
+		assert.NoError(t, err, tc.selector)
+		assert.Equal(t, tc.matches, sel.Matches(labels), tc.selector)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("env=staging, commit=abc=1,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"env": "staging", "commit": "abc=1"}, labels)
+
+	_, err = ParseLabels("env")
+	assert.Error(t, err)
+}
+
+func TestProfileWithSelector(t *testing.T) {
+	mockSvr := func(count string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 " + count))
+		}))
+	}
+	staging := mockSvr("1")
+	defer staging.Close()
+	prod := mockSvr("2")
+	defer prod.Close()
+
+	s := &server{Store: NewMemoryStore()}
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+	client := NewWorker(ts.URL)
+	assert.NoError(t, s.ensureRegistered(ServiceUnderTest{Name: "api-foo", Address: staging.URL, Labels: map[string]string{"env": "staging"}}))
+	assert.NoError(t, s.ensureRegistered(ServiceUnderTest{Name: "api-bar", Address: prod.URL, Labels: map[string]string{"env": "prod"}}))
+
+	res, err := client.Profile(ProfileParam{Selector: "env=staging"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 1")
+
+	res, err = client.Profile(ProfileParam{ServicePatterns: []string{"^api-"}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 3")
+
+	res, err = client.Profile(ProfileParam{ServicePatterns: []string{"bar$"}, Selector: "env!=staging"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 2")
+
+	_, err = client.Profile(ProfileParam{Selector: "env=canary"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no profiles")
+
+	_, err = client.Profile(ProfileParam{Selector: "env"})
+	assert.Error(t, err)
+
+	// the tombstones are selected by the labels as well
+	_, err = client.Remove(ProfileParam{Selector: "env=prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"api-foo": {staging.URL}}, s.Store.GetAll())
+	res, err = client.Profile(ProfileParam{Selector: "env=prod"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 2")
+
+	// list the services selected with their labels
+	res, err = client.ListServiceStatus(ProfileParam{Selector: "env=staging"})
+	assert.NoError(t, err)
+	var statuses []ServiceStatus
+	assert.NoError(t, json.Unmarshal(res, &statuses))
+	assert.Equal(t, 1, len(statuses))
+	assert.Equal(t, "api-foo", statuses[0].Name)
+	assert.Equal(t, map[string]string{"env": "staging"}, statuses[0].Labels)
+}
@@ -18,19 +18,21 @@ package cover
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/tools/cover"
-	"k8s.io/test-infra/gopherage/pkg/cov"
 )
 
 // LogFile a file to save log.
@@ -39,6 +41,80 @@ const LogFile = "goc.log"
 type server struct {
 	PersistenceFile string
 	Store           Store
+
+	// HeartbeatTTL is how long a registered address may stay silent before
+	// the center probes it, zero disables the liveness check
+	HeartbeatTTL time.Duration
+	// EvictUnhealthy removes the addresses failing the probe from the store,
+	// otherwise they are only marked unhealthy
+	EvictUnhealthy bool
+	// SnapshotInterval is how often the center collects the profiles of all the
+	// services to keep them after the services die, zero disables it
+	SnapshotInterval time.Duration
+	// Peers are the other centers sharing the registry with this one, so that
+	// a service can register to any of them and each returns the full profile
+	Peers []string
+	// SyncInterval is how often the registry is pulled from the peers
+	SyncInterval time.Duration
+	// Upstreams are the independent centers whose profiles are merged into the ones of this center
+	Upstreams []string
+	// MaxConcurrency is the number of addresses a profile request collects from at the same time, zero is unlimited
+	MaxConcurrency int
+	// AgentTimeout bounds the collection from a single address, zero is unlimited
+	AgentTimeout time.Duration
+	// ProfileTimeout bounds the collection of a profile request, the addresses not answered
+	// by then are reported timeout, zero is unlimited
+	ProfileTimeout time.Duration
+	// SourceRoot is the module root, or the GOPATH src directory, to find the sources for the html report
+	SourceRoot string
+	// SourceDir is where the sources uploaded at build time are extracted, empty disables the upload
+	SourceDir string
+	// ReadTokens are the static tokens allowed to get the profiles and list the services
+	ReadTokens []string
+	// WriteTokens are the static tokens allowed to call all the APIs
+	WriteTokens []string
+	// RegisterTokens are the static tokens only allowed to register the services
+	RegisterTokens []string
+	// TokenSecret verifies the tokens signed by SignToken, e.g. the ones built into the services.
+	// The APIs require no token if neither the tokens nor the secret are set.
+	TokenSecret string
+	// PeerToken is presented to the peers and the upstream centers
+	PeerToken string
+	// TLSCert and TLSKey are the files of the certificate to serve over https, plain http if empty
+	TLSCert, TLSKey string
+	// ClientCA is the file of the CA the clients are required to present a certificate signed by, over https
+	ClientCA string
+	// ClientTLS is used to contact the services, the peers and the upstream centers over https
+	ClientTLS *tls.Config
+	// StreamInterval is how often the services are collected while streams are open, DefaultStreamInterval if zero
+	StreamInterval time.Duration
+
+	agents      agentTracker
+	profiles    profileCache
+	tunnels     tunnelHub
+	labels      labelIndex
+	metrics     centerMetrics
+	agentTokens agentTokens
+	blocks      blockCache
+	sessions    sessionBook
+	feed        coverageFeed
+
+	clientTransport clientTransport
+}
+
+// NewServer new a server with the store of the given type, which is one of
+// "file", "bolt" and "memory"
+func NewServer(storeType, persistenceFile, dbFile string) (*server, error) {
+	switch storeType {
+	case "file":
+		return NewFileBasedServer(persistenceFile)
+	case "bolt":
+		return NewBoltBasedServer(dbFile, persistenceFile)
+	case "memory":
+		return NewMemoryBasedServer(), nil
+	default:
+		return nil, fmt.Errorf("unknown store type %q, should be one of file, bolt and memory", storeType)
+	}
 }
 
 // NewFileBasedServer new a file based server with persistenceFile
@@ -53,6 +129,22 @@ func NewFileBasedServer(persistenceFile string) (*server, error) {
 	}, nil
 }
 
+// NewBoltBasedServer new a server keeping the services in the bolt database at dbFile,
+// the services persisted in the legacy file by a file based server are migrated
+func NewBoltBasedServer(dbFile, legacyFile string) (*server, error) {
+	store, err := NewBoltStore(dbFile, legacyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &server{
+		Store: store,
+	}
+	if err := s.restore(store, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to restore from %s, err: %v", dbFile, err)
+	}
+	return s, nil
+}
+
 // NewMemoryBasedServer new a memory based server without persistenceFile
 func NewMemoryBasedServer() *server {
 	return &server{
@@ -70,6 +162,24 @@ func (s *server) Run(port string) {
 	// both log to stdout and file by default
 	mw := io.MultiWriter(f, os.Stdout)
 	r := s.Route(mw)
+	// the store is replaced before any goroutine uses it
+	if len(s.Peers) > 0 {
+		go s.watchPeers(s.enableReplication())
+	}
+	if s.HeartbeatTTL > 0 {
+		go s.watchLiveness()
+	}
+	if s.SnapshotInterval > 0 {
+		go s.watchSnapshots()
+	}
+	if s.TLSCert != "" || s.TLSKey != "" {
+		config, err := NewServerTLSConfig(s.TLSCert, s.TLSKey, s.ClientCA)
+		if err != nil {
+			log.Fatalf("failed to load the tls config, err: %v", err)
+		}
+		srv := &http.Server{Addr: port, Handler: r, TLSConfig: config}
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
 	log.Fatal(r.Run(port))
 }
 
@@ -79,18 +189,42 @@ func (s *server) Route(w io.Writer) *gin.Engine {
 		gin.DefaultWriter = w
 	}
 	r := gin.Default()
+	read, write, register := s.authorize(ScopeRead), s.authorize(ScopeWrite), s.authorize(ScopeRegister)
 	// api to show the registered services
-	r.StaticFile("static", "./"+s.PersistenceFile)
+	r.Group("/", read).StaticFile("static", "./"+s.PersistenceFile)
+	// the web UI, which calls the apis below with the token entered
+	r.GET(DashboardPath, s.dashboard)
+	r.GET("/", func(c *gin.Context) { c.Redirect(http.StatusFound, DashboardPath) })
+
+	r.GET(MetricsAPI, read, s.serveMetrics)
 
 	v1 := r.Group("/v1")
 	{
-		v1.POST("/cover/register", s.registerService)
-		v1.GET("/cover/profile", s.profile)
-		v1.POST("/cover/profile", s.profile)
-		v1.POST("/cover/clear", s.clear)
-		v1.POST("/cover/init", s.initSystem)
-		v1.GET("/cover/list", s.listServices)
-		v1.POST("/cover/remove", s.removeServices)
+		v1.POST("/cover/register", register, s.registerService)
+		v1.POST("/cover/heartbeat", register, s.heartbeat)
+		v1.POST("/cover/upload", register, s.uploadProfile)
+		v1.GET("/cover/tunnel", register, s.pollTunnel)
+		v1.POST("/cover/tunnel/reply", register, s.replyTunnel)
+		v1.GET("/cover/profile", read, s.profile)
+		v1.POST("/cover/profile", read, s.profile)
+		v1.GET("/cover/html", read, s.html)
+		v1.POST("/cover/html", read, s.html)
+		v1.GET("/cover/summary", read, s.summary)
+		v1.GET("/cover/file", read, s.fileBlocks)
+		v1.POST("/cover/source", write, s.uploadSource)
+		v1.POST("/cover/clear", write, s.clear)
+		v1.POST("/cover/pause", write, s.pause)
+		v1.POST("/cover/resume", write, s.resume)
+		v1.POST("/cover/init", write, s.initSystem)
+		v1.GET("/cover/list", read, s.listServices)
+		v1.GET("/cover/stream", read, s.stream)
+		v1.POST("/cover/remove", register, s.removeServices)
+		v1.POST("/cover/session/start", write, s.sessionStart)
+		v1.POST("/cover/session/stop", write, s.sessionStop)
+		v1.GET("/cover/session/list", read, s.listSessions)
+		v1.GET("/cover/session/profile", read, s.sessionProfile)
+		v1.GET("/cover/replica", read, s.replicaState)
+		v1.POST("/cover/replica", write, s.mergeReplica)
 	}
 
 	return r
@@ -100,6 +234,14 @@ func (s *server) Route(w io.Writer) *gin.Engine {
 type ServiceUnderTest struct {
 	Name    string `form:"name" json:"name" binding:"required"`
 	Address string `form:"address" json:"address" binding:"required"`
+	// Labels are sent as the repeated 'label' parameter in the form of key=value
+	Labels map[string]string `form:"-" json:"labels,omitempty"`
+	// Token is the one the service registered with
+	Token string `form:"-" json:"-"`
+	// Key is generated by the service at start, the center presents it when calling the service
+	Key string `form:"-" json:"-"`
+	// scope is granted to the token, the register scope only registers the addresses not taken by other tokens
+	scope string
 }
 
 // ProfileParam is param of profile API
@@ -109,30 +251,141 @@ type ProfileParam struct {
 	Address           []string `form:"address" json:"address"`
 	CoverFilePatterns []string `form:"coverfile" json:"coverfile"`
 	SkipFilePatterns  []string `form:"skipfile" json:"skipfile"`
+	// Packages only keeps the files under any of the import path prefixes, e.g. "github.com/qiniu/goc/pkg"
+	Packages []string `form:"package" json:"package"`
+	// SkipTombstones excludes the retained profiles of the services which deregistered or died
+	SkipTombstones bool `form:"skiptombstones" json:"skiptombstones"`
+	// Federated is set on the queries fanned out by a federated query, the center answers
+	// with its own services only, and an empty response if none matches
+	Federated bool `form:"federated" json:"federated"`
+	// ServicePatterns selects the services whose names match any of the regular expressions
+	ServicePatterns []string `form:"servicepattern" json:"servicepattern"`
+	// Selector selects the services by their labels, e.g. "env=staging,version!=v1"
+	Selector string `form:"selector" json:"selector"`
+	// Timeout bounds the collection from all the addresses, e.g. "1m", the center's default if empty
+	Timeout string `form:"timeout" json:"timeout"`
+	// AgentTimeout bounds the collection from a single address, the center's default if empty
+	AgentTimeout string `form:"agenttimeout" json:"agenttimeout"`
+	// Report answers with a ProfileEnvelope listing the result of every address besides the profile
+	Report bool `form:"report" json:"report"`
+	// Format is one of text, cobertura, lcov, sonar and json, the Accept header is honored if empty
+	Format string `form:"format" json:"format"`
+	// PathMappings map the import paths to the paths in the repository, e.g. "github.com/qiniu/goc=."
+	PathMappings []string `form:"pathmap" json:"pathmap"`
 }
 
-//listServices list all the registered services
+// listServices list all the registered services,
+// with detail=true the liveness of every address is listed instead
 func (s *server) listServices(c *gin.Context) {
-	services := s.Store.GetAll()
+	var body ProfileParam
+	if err := c.ShouldBindQuery(&body); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	match, err := s.matcher(body)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.Query("detail") == "true" {
+		statuses := make([]ServiceStatus, 0)
+		for _, st := range s.serviceStatuses() {
+			if match(st.Name, st.Address) {
+				statuses = append(statuses, st)
+			}
+		}
+		c.JSON(http.StatusOK, statuses)
+		return
+	}
+	services := make(map[string][]string)
+	for name, addrs := range s.Store.GetAll() {
+		for _, addr := range addrs {
+			if match(name, addr) {
+				services[name] = append(services[name], addr)
+			}
+		}
+	}
 	c.JSON(http.StatusOK, services)
 }
 
 func (s *server) registerService(c *gin.Context) {
-	var service ServiceUnderTest
-	if err := c.ShouldBind(&service); err != nil {
+	service, err := s.bindService(c)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	u, err := url.Parse(service.Address)
+	if err := s.ensureRegistered(service); err != nil {
+		c.JSON(registerStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	s.agents.alive(service.Address, time.Now())
+	s.persistHealth(service.Address)
+	s.blocks.forget(service.Address)
+
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+	return
+}
+
+// heartbeat refreshes the liveness of a registered service,
+// the service is registered again if the center has lost it
+func (s *server) heartbeat(c *gin.Context) {
+	service, err := s.bindService(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+
+	if err := s.ensureRegistered(service); err != nil {
+		c.JSON(registerStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	s.agents.heartbeat(service.Address, time.Now())
+	s.persistHealth(service.Address)
+	s.forwardToPeers(c, CoverHeartbeatAPI, service, nil)
+	// the service polling its tunnel on the peer is reached through the peer
+	if id := c.GetHeader(replicaHeader); id != "" && c.Query("tunnel") == "true" {
+		s.tunnels.connectedToPeer(service.Address, id, time.Now())
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+}
+
+// bindService parses the service in request, the registered host is replaced
+// by the real one if they are different
+func (s *server) bindService(c *gin.Context) (ServiceUnderTest, error) {
+	var service ServiceUnderTest
+	if err := c.ShouldBind(&service); err != nil {
+		return service, err
+	}
+	return s.resolveService(c, service)
+}
+
+// resolveService completes the service bound from the request
+func (s *server) resolveService(c *gin.Context, service ServiceUnderTest) (ServiceUnderTest, error) {
+	service.Token = bearerToken(c.GetHeader("Authorization"))
+	service.Key = c.GetHeader(agentKeyHeader)
+	service.scope = c.GetString(scopeKey)
+	if labels := append(c.QueryArray("label"), c.PostFormArray("label")...); len(labels) > 0 {
+		var err error
+		if service.Labels, err = ParseLabels(strings.Join(labels, ",")); err != nil {
+			return service, err
+		}
+	}
+
+	u, err := url.Parse(service.Address)
+	if err != nil {
+		return service, err
+	}
 	host, port, err := net.SplitHostPort(u.Host)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+		return service, err
+	}
+
+	// the peer forwarding the request has resolved the address already
+	if c.GetHeader(replicaHeader) != "" {
+		return service, nil
 	}
 
 	realIP := c.ClientIP()
@@ -140,19 +393,46 @@ func (s *server) registerService(c *gin.Context) {
 	// refer: https://github.com/qiniu/goc/issues/177
 	if net.ParseIP(realIP).To4() != nil && host != realIP {
 		log.Printf("the registered host %s of service %s is different with the real one %s, here we choose the real one", service.Name, host, realIP)
-		service.Address = fmt.Sprintf("http://%s:%s", realIP, port)
+		service.Address = fmt.Sprintf("%s://%s:%s", u.Scheme, realIP, port)
 	}
+	return service, nil
+}
+
+// errAddressTaken is returned when a service registers an address taken by a healthy service of another token
+var errAddressTaken = errors.New("the address is registered with another token")
 
+// registerStatus is the status code to respond the error of ensureRegistered with
+func registerStatus(err error) int {
+	if err == errAddressTaken {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *server) ensureRegistered(service ServiceUnderTest) error {
+	if service.scope == ScopeRegister && !s.agents.isUnhealthy(service.Address) &&
+		!s.agentTokens.owns(service.Address, service.Token) {
+		return errAddressTaken
+	}
 	address := s.Store.Get(service.Name)
 	if !contains(address, service.Address) {
 		if err := s.Store.Add(service); err != nil && err != ErrServiceAlreadyRegistered {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return err
 		}
+		// the counters of a process registering again include its tombstone already
+		s.unbury(service.Address)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"result": "success"})
-	return
+	if service.Key != "" {
+		s.agentTokens.remember(service.Address, service.Token, service.Key)
+	}
+	if service.Labels != nil && s.labels.set(service.Address, service.Labels) {
+		if rs, ok := s.Store.(RecordStore); ok {
+			if err := rs.UpdateLabels(service.Address, service.Labels); err != nil {
+				log.Warnf("failed to persist the labels of %s, err: %v", service.Address, err)
+			}
+		}
+	}
+	return nil
 }
 
 // profile API examples:
@@ -164,51 +444,134 @@ func (s *server) profile(c *gin.Context) {
 		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
 		return
 	}
+	if body.Format == "" {
+		body.Format = FormatFromAccept(c.GetHeader("Accept"))
+	}
+	if err := checkFormat(body.Format); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	mappings, err := ParsePathMappings(body.PathMappings)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+
+	merged, report, ok := s.mergedProfile(c, body)
+	if !ok {
+		return
+	}
+
+	if body.Report {
+		var buf bytes.Buffer
+		if err := Export(&buf, body.Format, merged, mappings); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, ProfileEnvelope{Profile: buf.String(), Report: report})
+		return
+	}
 
+	c.Header("Content-Type", ContentType(body.Format))
+	if err := Export(c.Writer, body.Format, merged, mappings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+}
+
+// mergedProfile collects and merges the profiles selected by the param.
+// On failure the error is responded, and false is returned.
+func (s *server) mergedProfile(c *gin.Context, body ProfileParam) ([]*cover.Profile, ProfileReport, bool) {
 	allInfos := s.Store.GetAll()
-	filterAddrList, err := filterAddrs(body.Service, body.Address, body.Force, allInfos)
+	names := serviceNames(allInfos)
+	if !body.SkipTombstones {
+		// the services only having tombstones are still valid to select
+		for _, name := range s.profiles.buriedServices() {
+			if _, ok := allInfos[name]; !ok {
+				allInfos[name] = nil
+			}
+		}
+	}
+	federating := len(s.Upstreams) > 0 && !body.Federated
+	// the services not found may be registered in other centers
+	filterAddrList, match, err := s.selectAddrs(body, body.Force || body.Federated || federating, allInfos)
 	if err != nil {
 		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
-		return
+		return nil, ProfileReport{}, false
 	}
 
+	agentTimeout, timeout, err := s.collectTimeouts(body)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return nil, ProfileReport{}, false
+	}
+	ctx, cancel := withTimeout(c.Request.Context(), timeout)
+	collected, reports := s.collectProfiles(ctx, filterAddrList, names, agentTimeout, agentQuery(body))
+	cancel()
+
+	var report = ProfileReport{Addresses: reports}
 	var mergedProfiles = make([][]*cover.Profile, 0)
-	for _, addr := range filterAddrList {
-		pp, err := NewWorker(addr).Profile(ProfileParam{})
-		if err != nil {
+	for i, r := range reports {
+		if r.Status == CollectTimeout || r.Status == CollectFailed {
 			if body.Force {
-				log.Warnf("get profile from [%s] failed, error: %s", addr, err.Error())
+				log.Warnf("get profile from [%s] failed, error: %s", r.Address, r.Error)
 				continue
 			}
-
-			c.JSON(http.StatusExpectationFailed, gin.H{"error": fmt.Sprintf("failed to get profile from %s, error %s", addr, err.Error())})
-			return
+			c.Writer.Header().Set(ProfileReportHeader, report.summary())
+			c.JSON(http.StatusExpectationFailed, gin.H{"error": fmt.Sprintf("failed to get profile from %s, error %s", r.Address, r.Error), "report": report})
+			return nil, report, false
 		}
+		if collected[i] != nil {
+			mergedProfiles = append(mergedProfiles, collected[i])
+		}
+	}
 
-		profile, err := convertProfile(pp)
+	var tombs []*cachedProfile
+	if !body.SkipTombstones {
+		tombs = s.profiles.buried(match)
+	}
+
+	if federating {
+		upstream, failures, err := FederatedProfile(s.Upstreams, body, WithToken(s.PeerToken), withTransport(s.transport()))
+		report.FailedCenters = failures
+		for _, f := range failures {
+			log.Warnf("get profile from upstream center failed, %s", f)
+			c.Writer.Header().Add(FailedCenterHeader, f.String())
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error(), "report": report})
+			return nil, report, false
+		}
+		if len(upstream) > 0 {
+			mergedProfiles = append(mergedProfiles, upstream)
 		}
-		mergedProfiles = append(mergedProfiles, profile)
 	}
 
-	if len(mergedProfiles) == 0 {
-		c.JSON(http.StatusExpectationFailed, gin.H{"error": "no profiles"})
-		return
+	c.Writer.Header().Set(ProfileReportHeader, report.summary())
+	if len(mergedProfiles) == 0 && len(tombs) == 0 {
+		if body.Federated {
+			c.Status(http.StatusOK)
+			return nil, report, false
+		}
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": "no profiles", "report": report})
+		return nil, report, false
 	}
 
-	merged, err := cov.MergeMultipleProfiles(mergedProfiles)
+	merged, skipped, err := mergeWithTombstones(mergedProfiles, tombs)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, report, false
+	}
+	if len(skipped) > 0 {
+		report.SkippedTombstones = skipped
+		c.Writer.Header().Set(ProfileReportHeader, report.summary())
 	}
 
 	if len(body.CoverFilePatterns) > 0 {
 		merged, err = filterProfile(body.CoverFilePatterns, merged)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to filter profile based on the patterns: %v, error: %v", body.CoverFilePatterns, err)})
-			return
+			return nil, report, false
 		}
 	}
 
@@ -216,58 +579,103 @@ func (s *server) profile(c *gin.Context) {
 		merged, err = skipProfile(body.SkipFilePatterns, merged)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to skip profile based on the patterns: %v, error: %v", body.SkipFilePatterns, err)})
-			return
+			return nil, report, false
 		}
 	}
 
-	if err := cov.DumpProfile(merged, c.Writer); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if len(body.Packages) > 0 {
+		merged = packageProfile(body.Packages, merged)
 	}
+
+	return merged, report, true
 }
 
 // filterProfile filters profiles of the packages matching the coverFile pattern
 func filterProfile(coverFile []string, profiles []*cover.Profile) ([]*cover.Profile, error) {
-	var out = make([]*cover.Profile, 0)
-	for _, profile := range profiles {
-		for _, pattern := range coverFile {
-			matched, err := regexp.MatchString(pattern, profile.FileName)
-			if err != nil {
-				return nil, fmt.Errorf("filterProfile failed with pattern %s for profile %s, err: %v", pattern, profile.FileName, err)
-			}
-			if matched {
-				out = append(out, profile)
-				break // no need to check again for the file
-			}
-		}
+	match, err := fileMatcher(coverFile, nil, nil)
+	if err != nil {
+		return nil, err
 	}
+	return matchProfiles(match, profiles), nil
+}
+
+// packageProfile keeps the profiles of the files under any of the package prefixes
+func packageProfile(packages []string, profiles []*cover.Profile) []*cover.Profile {
+	match, _ := fileMatcher(nil, nil, packages)
+	return matchProfiles(match, profiles)
+}
 
-	return out, nil
+// underPackages reports whether the file is in any of the packages or their subpackages
+func underPackages(file string, packages []string) bool {
+	for _, pkg := range packages {
+		if strings.HasPrefix(file, strings.TrimSuffix(pkg, "/")+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 // skipProfile skips profiles of the packages matching the skipFile pattern
 func skipProfile(skipFile []string, profiles []*cover.Profile) ([]*cover.Profile, error) {
-	var out = make([]*cover.Profile, 0)
-	for _, profile := range profiles {
-		var shouldSkip bool
-		for _, pattern := range skipFile {
-			matched, err := regexp.MatchString(pattern, profile.FileName)
+	match, err := fileMatcher(nil, skipFile, nil)
+	if err != nil {
+		return nil, err
+	}
+	return matchProfiles(match, profiles), nil
+}
+
+// fileMatcher matches the files by the coverfile and the skipfile patterns and the package prefixes,
+// it is shared by the profile APIs and the stream so that they select the same files
+func fileMatcher(coverFiles, skipFiles, packages []string) (func(file string) bool, error) {
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		res := make([]*regexp.Regexp, 0, len(patterns))
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
 			if err != nil {
-				return nil, fmt.Errorf("filterProfile failed with pattern %s for profile %s, err: %v", pattern, profile.FileName, err)
+				return nil, fmt.Errorf("invalid file pattern %s, err: %v", pattern, err)
 			}
-
-			if matched {
-				shouldSkip = true
-				break // no need to check again for the file
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	covers, err := compile(coverFiles)
+	if err != nil {
+		return nil, err
+	}
+	skips, err := compile(skipFiles)
+	if err != nil {
+		return nil, err
+	}
+	return func(file string) bool {
+		for _, re := range skips {
+			if re.MatchString(file) {
+				return false
 			}
 		}
+		if len(packages) > 0 && !underPackages(file, packages) {
+			return false
+		}
+		if len(covers) == 0 {
+			return true
+		}
+		for _, re := range covers {
+			if re.MatchString(file) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
 
-		if !shouldSkip {
+// matchProfiles keeps the profiles of the files matched
+func matchProfiles(match func(file string) bool, profiles []*cover.Profile) []*cover.Profile {
+	var out = make([]*cover.Profile, 0)
+	for _, profile := range profiles {
+		if match(profile.FileName) {
 			out = append(out, profile)
 		}
 	}
-
-	return out, nil
+	return out
 }
 
 func (s *server) clear(c *gin.Context) {
@@ -277,27 +685,75 @@ func (s *server) clear(c *gin.Context) {
 		return
 	}
 	svrsUnderTest := s.Store.GetAll()
-	filterAddrList, err := filterAddrs(body.Service, body.Address, true, svrsUnderTest)
+	filterAddrList, match, err := s.selectAddrs(body, true, svrsUnderTest)
 	if err != nil {
 		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
 		return
 	}
 	for _, addr := range filterAddrList {
-		pp, err := NewWorker(addr).Clear(ProfileParam{})
+		pp, err := s.worker(addr).Clear(ProfileParam{})
 		if err != nil {
 			c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
 			return
 		}
+		// the cached profile is outdated once the counters are cleared
+		s.profiles.forget(addr)
 		fmt.Fprintf(c.Writer, "Register service %s coverage counter %s", addr, string(pp))
 	}
+	// the tombstones are cleared together with the counters, or they would come back in the profile
+	for _, t := range s.profiles.buried(match) {
+		s.unbury(t.address)
+		fmt.Fprintf(c.Writer, "Tombstone of service %s cleared.", t.address)
+	}
+}
+
+// pause excludes the counts of the services selected from the coverage until they are resumed,
+// e.g. during the warm-up traffic or load tests
+func (s *server) pause(c *gin.Context) {
+	s.control(c, Action.Pause)
+}
 
+func (s *server) resume(c *gin.Context) {
+	s.control(c, Action.Resume)
+}
+
+// control pauses or resumes the counting of the services selected as by clear
+func (s *server) control(c *gin.Context, call func(Action, ProfileParam) ([]byte, error)) {
+	var body ProfileParam
+	if err := c.ShouldBind(&body); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	filterAddrList, _, err := s.selectAddrs(body, true, s.Store.GetAll())
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	for _, addr := range filterAddrList {
+		res, err := call(s.worker(addr), ProfileParam{})
+		if err != nil {
+			c.JSON(http.StatusExpectationFailed, gin.H{"error": fmt.Sprintf("%s: %v", addr, err)})
+			return
+		}
+		// the counters reported change once paused or resumed
+		s.profiles.forget(addr)
+		fmt.Fprintf(c.Writer, "%s: %s", addr, string(res))
+	}
 }
 
 func (s *server) initSystem(c *gin.Context) {
+	// the sessions stopping meanwhile are not persisted again after the store is cleared
+	s.sessions.reset()
 	if err := s.Store.Init(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	s.agents.reset()
+	s.profiles.reset()
+	s.labels.reset()
+	s.metrics.reset()
+	s.agentTokens.reset()
+	s.blocks.reset()
 
 	c.JSON(http.StatusOK, "")
 }
@@ -309,36 +765,49 @@ func (s *server) removeServices(c *gin.Context) {
 		return
 	}
 	svrsUnderTest := s.Store.GetAll()
-	filterAddrList, err := filterAddrs(body.Service, body.Address, true, svrsUnderTest)
+	filterAddrList, _, err := s.selectAddrs(body, true, svrsUnderTest)
 	if err != nil {
 		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
 		return
 	}
+	if !s.canRemove(c, filterAddrList) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "token of scope register only removes the addresses of the service presenting their key"})
+		return
+	}
+	names := serviceNames(svrsUnderTest)
 	for _, addr := range filterAddrList {
+		// keep the last profile of the service before it goes away,
+		// the services in push mode upload it by themselves on exit
+		if _, ok := s.profiles.pushed(addr); !ok {
+			ctx, cancel := s.agentContext()
+			if _, err := s.collect(ctx, names[addr], addr, time.Now()); err != nil {
+				log.Warnf("failed to collect the last profile of %s, err: %v", addr, err)
+			}
+			cancel()
+		}
 		err := s.Store.Remove(addr)
 		if err != nil {
 			c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
 			return
 		}
+		s.agents.forget(addr)
+		s.metrics.forget(addr)
+		s.agentTokens.forget(addr)
+		s.tunnels.forget(addr)
+		s.bury(addr)
 		fmt.Fprintf(c.Writer, "Register service %s removed from the center.", addr)
 	}
 }
 
-func convertProfile(p []byte) ([]*cover.Profile, error) {
-	// Annoyingly, ParseProfiles only accepts a filename, so we have to write the bytes to disk
-	// so it can read them back.
-	// We could probably also just give it /dev/stdin, but that'll break on Windows.
-	tf, err := ioutil.TempFile("", "")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp file, err: %v", err)
-	}
-	defer tf.Close()
-	defer os.Remove(tf.Name())
-	if _, err := io.Copy(tf, bytes.NewReader(p)); err != nil {
-		return nil, fmt.Errorf("failed to copy data to temp file, err: %v", err)
+// serviceNames maps the registered addresses to their service names
+func serviceNames(allInfos map[string][]string) map[string]string {
+	names := make(map[string]string)
+	for name, addrs := range allInfos {
+		for _, addr := range addrs {
+			names[addr] = name
+		}
 	}
-
-	return cover.ParseProfiles(tf.Name())
+	return names
 }
 
 func contains(arr []string, str string) bool {
@@ -232,6 +232,45 @@ func TestClearService(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "use 'service' flag and 'address' flag at the same time may cause ambiguity, please use them separately")
 }
 
+func TestPauseAndResumeServices(t *testing.T) {
+	var calls []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		calls = append(calls, r.URL.Path)
+		if r.URL.Path == CoverPauseAPI {
+			fmt.Fprintln(w, "counting paused")
+			return
+		}
+		fmt.Fprintln(w, "counting resumed")
+	}))
+	defer agent.Close()
+	// built before the pause API
+	legacy := httptest.NewServer(http.NotFoundHandler())
+	defer legacy.Close()
+
+	s := &server{Store: NewMemoryStore()}
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: agent.URL}))
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "bar", Address: legacy.URL}))
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+	client := NewWorker(ts.URL)
+
+	res, err := client.Pause(ProfileParam{Service: []string{"foo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, agent.URL+": counting paused\n", string(res))
+	res, err = client.Resume(ProfileParam{Service: []string{"foo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, agent.URL+": counting resumed\n", string(res))
+	assert.Equal(t, []string{CoverPauseAPI, CoverResumeAPI}, calls)
+
+	_, err = client.Pause(ProfileParam{Service: []string{"bar"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), legacy.URL)
+
+	_, err = client.Pause(ProfileParam{Service: []string{"foo"}, Address: []string{agent.URL}})
+	assert.Error(t, err)
+}
+
 func TestRemoveServices(t *testing.T) {
 	testObj := new(MockStore)
 	testObj.On("GetAll").Return(map[string][]string{"foo": {"test1", "test2"}})
@@ -517,6 +556,41 @@ func TestSkipProfile(t *testing.T) {
 	}
 }
 
+func TestPackageProfile(t *testing.T) {
+	profiles := []*cover.Profile{
+		{FileName: "github.com/qiniu/goc/cmd/server.go"},
+		{FileName: "github.com/qiniu/goc/pkg/cover/server.go"},
+		{FileName: "github.com/qiniu/goc/pkg/build/build.go"},
+		{FileName: "github.com/qiniu/gocx/main.go"},
+	}
+	out := packageProfile([]string{"github.com/qiniu/goc/pkg/", "github.com/qiniu/goc/cmd"}, profiles)
+	assert.Equal(t, profiles[:3], out)
+	out = packageProfile([]string{"github.com/qiniu/goc"}, profiles)
+	assert.Equal(t, profiles[:3], out)
+	assert.Empty(t, packageProfile([]string{"github.com/qiniu/go"}, profiles))
+}
+
+func TestFileMatcher(t *testing.T) {
+	match, err := fileMatcher([]string{"^a/"}, []string{"_test.go$"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, match("a/main.go"))
+	assert.False(t, match("a/main_test.go"))
+	assert.False(t, match("b/main.go"))
+
+	match, err = fileMatcher(nil, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, match("b/main.go"))
+
+	match, err = fileMatcher(nil, nil, []string{"a/b"})
+	assert.NoError(t, err)
+	assert.True(t, match("a/b/main.go"))
+	assert.True(t, match("a/b/c/main.go"))
+	assert.False(t, match("a/bc/main.go"))
+
+	_, err = fileMatcher([]string{"("}, nil, nil)
+	assert.Error(t, err)
+}
+
 func stringifyCoverProfile(profiles []*cover.Profile) string {
 	res := make([]cover.Profile, 0, len(profiles))
 	for _, p := range profiles {
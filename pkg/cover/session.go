@@ -0,0 +1,467 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/tools/cover"
+	"k8s.io/test-infra/gopherage/pkg/cov"
+)
+
+// Session is a named phase of the tests, e.g. a suite, whose profile is what the services
+// covered between its start and stop, without clearing the counters of the services
+type Session struct {
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+	// Stopped is zero while the session is active
+	Stopped time.Time `json:"stopped"`
+	// Failed lists the addresses the profiles could not be collected from at start or stop,
+	// which are counted from their last profile known by the center
+	Failed []string `json:"failed,omitempty"`
+	// Profile is what the session covered in text format, set once stopped
+	Profile string `json:"profile,omitempty"`
+	// Baseline is the profile of every address at start in text format, dropped once stopped
+	Baseline map[string]string `json:"baseline,omitempty"`
+	// Processes identifies the process at every address of the baseline, dropped once stopped.
+	// The baseline of an address is not subtracted if another process is there at stop.
+	Processes map[string]string `json:"processes,omitempty"`
+}
+
+// SessionStore is implemented by the stores persisting the sessions
+type SessionStore interface {
+	// PutSession persists the session, replacing the one of the same name
+	PutSession(s Session) error
+
+	// Sessions returns all the persisted sessions
+	Sessions() ([]Session, error)
+}
+
+// sessionBook holds the stopped sessions and the active one, at most one session is active.
+// The zero value is ready to use.
+type sessionBook struct {
+	// op serializes the starts and the stops, which collect the profiles without holding mu
+	op       sync.Mutex
+	mu       sync.Mutex
+	active   *Session
+	baseline map[string][]*cover.Profile // of the active session, by address
+	stopped  map[string]*Session
+	// epoch is increased by reset, the starts and the stops begun before are dropped
+	epoch int
+}
+
+// check returns an error if the session can not be started
+func (b *sessionBook) check(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active != nil {
+		return fmt.Errorf("session %s is active, stop it first", b.active.Name)
+	}
+	if _, ok := b.stopped[name]; ok {
+		return fmt.Errorf("session %s exists", name)
+	}
+	return nil
+}
+
+// restore adds the persisted session
+func (b *sessionBook) restore(s Session) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !s.Stopped.IsZero() {
+		if b.stopped == nil {
+			b.stopped = make(map[string]*Session)
+		}
+		b.stopped[s.Name] = &s
+		return nil
+	}
+	baseline := make(map[string][]*cover.Profile, len(s.Baseline))
+	for addr, p := range s.Baseline {
+		profile, err := ParseProfile(strings.NewReader(p))
+		if err != nil {
+			return fmt.Errorf("invalid baseline of %s, err: %v", addr, err)
+		}
+		baseline[addr] = profile
+	}
+	b.active, b.baseline = &s, baseline
+	return nil
+}
+
+// reset drops all the sessions, e.g. on init
+func (b *sessionBook) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active, b.baseline, b.stopped = nil, nil, nil
+	b.epoch++
+}
+
+// begin returns the epoch a start or a stop begins in
+func (b *sessionBook) begin() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.epoch
+}
+
+// list returns the sessions without their profiles, ordered by their start
+func (b *sessionBook) list() []Session {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := make([]Session, 0, len(b.stopped)+1)
+	for _, s := range b.stopped {
+		res = append(res, sessionSummary(s))
+	}
+	if b.active != nil {
+		res = append(res, sessionSummary(b.active))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Started.Before(res[j].Started) })
+	return res
+}
+
+func sessionSummary(s *Session) Session {
+	return Session{Name: s.Name, Started: s.Started, Stopped: s.Stopped, Failed: s.Failed}
+}
+
+func (b *sessionBook) get(name string) (*Session, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.stopped[name]
+	return s, ok
+}
+
+// subtractProfile returns the counts of the profile increased since the baseline, both of the same binary.
+// A block counted less than in the baseline was cleared in between, so it is counted from zero.
+// In set mode, the blocks already covered at the baseline are not counted.
+func subtractProfile(profile, baseline []*cover.Profile) []*cover.Profile {
+	base := make(map[string]*cover.Profile, len(baseline))
+	for _, p := range baseline {
+		base[p.FileName] = p
+	}
+	res := make([]*cover.Profile, 0, len(profile))
+	for _, p := range profile {
+		delta := &cover.Profile{FileName: p.FileName, Mode: p.Mode, Blocks: make([]cover.ProfileBlock, len(p.Blocks))}
+		copy(delta.Blocks, p.Blocks)
+		if b, ok := base[p.FileName]; ok && sameBlocks(p, b) {
+			for i := range delta.Blocks {
+				if c := b.Blocks[i].Count; delta.Blocks[i].Count >= c {
+					delta.Blocks[i].Count -= c
+				}
+			}
+		}
+		res = append(res, delta)
+	}
+	return res
+}
+
+func sameBlocks(a, b *cover.Profile) bool {
+	if len(a.Blocks) != len(b.Blocks) {
+		return false
+	}
+	for i := range a.Blocks {
+		x, y := a.Blocks[i], b.Blocks[i]
+		if x.StartLine != y.StartLine || x.StartCol != y.StartCol || x.EndLine != y.EndLine || x.EndCol != y.EndCol {
+			return false
+		}
+	}
+	return true
+}
+
+// processID identifies the process at the address by the key it generated at start, empty if unknown
+func (s *server) processID(addr string) string {
+	key := s.agentTokens.key(addr)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// restarted reports whether another process is at the address than at the start of the session
+func (s *server) restarted(session *Session, addr string) bool {
+	was, is := session.Processes[addr], s.processID(addr)
+	return was != "" && is != "" && was != is
+}
+
+// snapshotAll collects the profiles of all the registered addresses, the ones failed are
+// taken from the last profiles known by the center, and listed with those never known
+func (s *server) snapshotAll(ctx context.Context) (map[string][]*cover.Profile, []string) {
+	allInfos := s.Store.GetAll()
+	names := serviceNames(allInfos)
+	addrs := make([]string, 0, len(names))
+	for addr := range names {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	ctx, cancel := withTimeout(ctx, s.ProfileTimeout)
+	defer cancel()
+	collected, reports := s.collectProfiles(ctx, addrs, names, s.AgentTimeout, "")
+
+	profiles := make(map[string][]*cover.Profile, len(addrs))
+	var failed []string
+	for i, addr := range addrs {
+		if collected[i] != nil {
+			profiles[addr] = collected[i]
+			continue
+		}
+		failed = append(failed, addr)
+		if p, ok := s.profiles.last(addr); ok {
+			profiles[addr] = p.profile
+			continue
+		}
+		log.Warnf("no profile of %s for the session, %s: %s", addr, reports[i].Status, reports[i].Error)
+	}
+	return profiles, failed
+}
+
+// startSession records the baseline of a new session
+func (s *server) startSession(ctx context.Context, name string, now time.Time) (Session, error) {
+	b := &s.sessions
+	b.op.Lock()
+	defer b.op.Unlock()
+	if err := b.check(name); err != nil {
+		return Session{}, err
+	}
+	epoch := b.begin()
+
+	baseline, failed := s.snapshotAll(ctx)
+	session := &Session{
+		Name:      name,
+		Started:   now,
+		Failed:    failed,
+		Baseline:  make(map[string]string, len(baseline)),
+		Processes: make(map[string]string),
+	}
+	for addr, p := range baseline {
+		var buf bytes.Buffer
+		if err := cov.DumpProfile(p, &buf); err != nil {
+			return Session{}, err
+		}
+		session.Baseline[addr] = buf.String()
+		if id := s.processID(addr); id != "" {
+			session.Processes[addr] = id
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.epoch != epoch {
+		return Session{}, fmt.Errorf("the center was initialized while session %s was starting", name)
+	}
+	if err := s.persistSession(*session); err != nil {
+		return Session{}, err
+	}
+	b.active, b.baseline = session, baseline
+	return sessionSummary(session), nil
+}
+
+// stopSession computes the profile of the active session since its baseline
+func (s *server) stopSession(ctx context.Context, now time.Time) (Session, error) {
+	b := &s.sessions
+	b.op.Lock()
+	defer b.op.Unlock()
+	b.mu.Lock()
+	active, baseline, epoch := b.active, b.baseline, b.epoch
+	b.mu.Unlock()
+	if active == nil {
+		return Session{}, fmt.Errorf("no active session")
+	}
+
+	current, failed := s.snapshotAll(ctx)
+	s.addSessionTombstones(current, baseline, active.Started)
+	deltas := make([][]*cover.Profile, 0, len(current))
+	for addr, p := range current {
+		base := baseline[addr]
+		// the counters of the process restarted during the session started from zero
+		if s.restarted(active, addr) {
+			log.Infof("%s restarted during session %s, its profile is counted in full", addr, active.Name)
+			base = nil
+		}
+		deltas = append(deltas, subtractProfile(p, base))
+	}
+	session := &Session{Name: active.Name, Started: active.Started, Stopped: now, Failed: mergeFailed(active.Failed, failed)}
+	if len(deltas) > 0 {
+		merged, err := mergeProfiles(deltas)
+		if err != nil {
+			return Session{}, err
+		}
+		var buf bytes.Buffer
+		if err := cov.DumpProfile(merged, &buf); err != nil {
+			return Session{}, err
+		}
+		session.Profile = buf.String()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.epoch != epoch {
+		return Session{}, fmt.Errorf("the center was initialized while session %s was stopping", session.Name)
+	}
+	if err := s.persistSession(*session); err != nil {
+		return Session{}, err
+	}
+	if b.stopped == nil {
+		b.stopped = make(map[string]*Session)
+	}
+	b.stopped[session.Name] = session
+	b.active, b.baseline = nil, nil
+	return sessionSummary(session), nil
+}
+
+// addSessionTombstones adds the tombstones of the addresses gone during the session to the profiles,
+// i.e. of the addresses in the baseline, and of the ones registered after the session started
+func (s *server) addSessionTombstones(profiles, baseline map[string][]*cover.Profile, started time.Time) {
+	for _, t := range s.profiles.tombs() {
+		if _, ok := profiles[t.address]; ok {
+			continue
+		}
+		if _, ok := baseline[t.address]; ok || t.collected.After(started) {
+			profiles[t.address] = t.profile
+		}
+	}
+}
+
+func mergeFailed(a, b []string) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, addr := range append(append([]string{}, a...), b...) {
+		if !seen[addr] {
+			seen[addr] = true
+			res = append(res, addr)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// sessionStore returns the store persisting the sessions, if any
+func (s *server) sessionStore() (SessionStore, bool) {
+	store := s.Store
+	// the sessions are not replicated, but kept by the local store
+	if r, ok := store.(*replicatedStore); ok {
+		store = r.local
+	}
+	ss, ok := store.(SessionStore)
+	return ss, ok
+}
+
+func (s *server) persistSession(session Session) error {
+	ss, ok := s.sessionStore()
+	if !ok {
+		return nil
+	}
+	if err := ss.PutSession(session); err != nil {
+		return fmt.Errorf("failed to persist session %s, err: %v", session.Name, err)
+	}
+	return nil
+}
+
+// sessionStart starts a session named by the name parameter.
+// POST /v1/cover/session/start?name=xxx
+func (s *server) sessionStart(c *gin.Context) {
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": "invalid session name"})
+		return
+	}
+	session, err := s.startSession(c.Request.Context(), name, time.Now())
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// sessionStop stops the active session.
+// POST /v1/cover/session/stop
+func (s *server) sessionStop(c *gin.Context) {
+	session, err := s.stopSession(c.Request.Context(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// listSessions lists the sessions without their profiles.
+// GET /v1/cover/session/list
+func (s *server) listSessions(c *gin.Context) {
+	c.JSON(http.StatusOK, s.sessions.list())
+}
+
+// sessionProfile returns the profile of the stopped session, in the format of the parameters
+// of the profile API, filtered by the coverfile and skipfile patterns.
+// GET /v1/cover/session/profile?name=xxx
+func (s *server) sessionProfile(c *gin.Context) {
+	var body ProfileParam
+	if err := c.ShouldBind(&body); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Format == "" {
+		body.Format = FormatFromAccept(c.GetHeader("Accept"))
+	}
+	if err := checkFormat(body.Format); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	mappings, err := ParsePathMappings(body.PathMappings)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	session, ok := s.sessions.get(c.Query("name"))
+	if !ok {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": fmt.Sprintf("no stopped session %s", c.Query("name"))})
+		return
+	}
+	if session.Profile == "" {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": "no profiles"})
+		return
+	}
+
+	profiles, err := ParseProfile(strings.NewReader(session.Profile))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(body.CoverFilePatterns) > 0 {
+		if profiles, err = filterProfile(body.CoverFilePatterns, profiles); err != nil {
+			c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if len(body.SkipFilePatterns) > 0 {
+		if profiles, err = skipProfile(body.SkipFilePatterns, profiles); err != nil {
+			c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if len(body.Packages) > 0 {
+		profiles = packageProfile(body.Packages, profiles)
+	}
+	c.Header("Content-Type", ContentType(body.Format))
+	if err := Export(c.Writer, body.Format, profiles, mappings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
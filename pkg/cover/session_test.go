@@ -0,0 +1,243 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubtractProfile(t *testing.T) {
+	baseline, err := ParseProfile(strings.NewReader("mode: count\n" +
+		"a.go:1.1,2.2 1 3\na.go:3.1,4.2 1 5\n" +
+		"b.go:1.1,2.2 1 2\n"))
+	assert.NoError(t, err)
+	profile, err := ParseProfile(strings.NewReader("mode: count\n" +
+		"a.go:1.1,2.2 1 4\na.go:3.1,4.2 1 2\n" +
+		"b.go:1.1,3.2 1 7\n" +
+		"c.go:1.1,2.2 1 1\n"))
+	assert.NoError(t, err)
+
+	delta := subtractProfile(profile, baseline)
+	assert.Equal(t, 3, len(delta))
+	// a.go:3.1,4.2 was cleared in between, so it is counted from zero
+	assert.Equal(t, 1, delta[0].Blocks[0].Count)
+	assert.Equal(t, 2, delta[0].Blocks[1].Count)
+	// b.go is changed and c.go is new, both are counted in full
+	assert.Equal(t, 7, delta[1].Blocks[0].Count)
+	assert.Equal(t, 1, delta[2].Blocks[0].Count)
+	// the profile is left untouched
+	assert.Equal(t, 4, profile[0].Blocks[0].Count)
+}
+
+func TestSession(t *testing.T) {
+	var count int64 = 3
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 " + strconv.FormatInt(atomic.LoadInt64(&count), 10)))
+	}))
+	defer agent.Close()
+
+	s := &server{Store: NewMemoryStore()}
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: agent.URL}))
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+	client := NewWorker(ts.URL)
+
+	_, err := client.StopSession()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no active session")
+	_, err = client.StartSession(" ")
+	assert.Error(t, err)
+
+	res, err := client.StartSession("smoke")
+	assert.NoError(t, err)
+	var session Session
+	assert.NoError(t, json.Unmarshal(res, &session))
+	assert.Equal(t, "smoke", session.Name)
+	assert.True(t, session.Stopped.IsZero())
+	_, err = client.StartSession("e2e")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "session smoke is active")
+
+	atomic.StoreInt64(&count, 10)
+	res, err = client.StopSession()
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(res, &session))
+	assert.False(t, session.Stopped.IsZero())
+	assert.Empty(t, session.Profile)
+
+	profile, err := client.SessionProfile("smoke", ProfileParam{})
+	assert.NoError(t, err)
+	assert.Equal(t, "mode: count\nmockService/main.go:30.13,48.33 13 7\n", string(profile))
+	_, err = client.SessionProfile("e2e", ProfileParam{})
+	assert.Error(t, err)
+	_, err = client.StartSession("smoke")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "session smoke exists")
+
+	// the agent failed at stop is counted from its last known profile
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "bar", Address: "http://127.0.0.1:1"}))
+	_, err = client.StartSession("e2e")
+	assert.NoError(t, err)
+	res, err = client.StopSession()
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(res, &session))
+	assert.Equal(t, []string{"http://127.0.0.1:1"}, session.Failed)
+	profile, err = client.SessionProfile("e2e", ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(profile), "mockService/main.go:30.13,48.33 13 0")
+
+	res, err = client.ListSessions()
+	assert.NoError(t, err)
+	var sessions []Session
+	assert.NoError(t, json.Unmarshal(res, &sessions))
+	assert.Equal(t, 2, len(sessions))
+	assert.Equal(t, "smoke", sessions[0].Name)
+	assert.Equal(t, "e2e", sessions[1].Name)
+}
+
+func TestSessionKeepsTombstones(t *testing.T) {
+	newAgent := func(count *int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 " + strconv.FormatInt(atomic.LoadInt64(count), 10)))
+		}))
+	}
+	old, gone, late := int64(100), int64(3), int64(4)
+	oldAgent, goneAgent, lateAgent := newAgent(&old), newAgent(&gone), newAgent(&late)
+	defer oldAgent.Close()
+	defer goneAgent.Close()
+	defer lateAgent.Close()
+
+	s := &server{Store: NewMemoryStore()}
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+	client := NewWorker(ts.URL)
+
+	// the tombstone left before the session is not counted
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: oldAgent.URL}))
+	_, err := client.Remove(ProfileParam{Address: []string{oldAgent.URL}})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: goneAgent.URL}))
+	_, err = client.StartSession("smoke")
+	assert.NoError(t, err)
+
+	// the services gone during the session are counted from their tombstones
+	atomic.StoreInt64(&gone, 10)
+	_, err = client.Remove(ProfileParam{Address: []string{goneAgent.URL}})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "bar", Address: lateAgent.URL}))
+	_, err = client.Remove(ProfileParam{Address: []string{lateAgent.URL}})
+	assert.NoError(t, err)
+	assert.Empty(t, s.Store.GetAll())
+
+	_, err = client.StopSession()
+	assert.NoError(t, err)
+	profile, err := client.SessionProfile("smoke", ProfileParam{})
+	assert.NoError(t, err)
+	assert.Equal(t, "mode: count\nmockService/main.go:30.13,48.33 13 11\n", string(profile))
+}
+
+func TestBoltBasedSessionRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "goc.db")
+
+	var count int64 = 3
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 " + strconv.FormatInt(atomic.LoadInt64(&count), 10)))
+	}))
+	defer agent.Close()
+
+	s, err := NewBoltBasedServer(dbFile, "")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: agent.URL}))
+	now := time.Now()
+	_, err = s.startSession(context.Background(), "smoke", now)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Store.(*boltStore).Close())
+
+	// the restarted center stops the session started before
+	s, err = NewBoltBasedServer(dbFile, "")
+	assert.NoError(t, err)
+	atomic.StoreInt64(&count, 5)
+	_, err = s.stopSession(context.Background(), now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Store.(*boltStore).Close())
+
+	// and the stopped session survives the restart
+	s, err = NewBoltBasedServer(dbFile, "")
+	assert.NoError(t, err)
+	session, ok := s.sessions.get("smoke")
+	assert.True(t, ok)
+	assert.Equal(t, "mode: count\nmockService/main.go:30.13,48.33 13 2\n", session.Profile)
+	assert.Empty(t, session.Baseline)
+
+	// but not the init
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	assert.Equal(t, http.StatusOK, requestStatus(t, "POST", ts.URL+CoverInitSystemAPI, ""))
+	ts.Close()
+	assert.Empty(t, s.sessions.list())
+	assert.NoError(t, s.Store.(*boltStore).Close())
+	s, err = NewBoltBasedServer(dbFile, "")
+	assert.NoError(t, err)
+	defer s.Store.(*boltStore).Close()
+	assert.Empty(t, s.sessions.list())
+}
+
+func TestSessionOfRestartedProcess(t *testing.T) {
+	var count int64 = 3
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 " + strconv.FormatInt(atomic.LoadInt64(&count), 10)))
+	}))
+	defer agent.Close()
+
+	s := &server{Store: NewMemoryStore()}
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+	client := NewWorker(ts.URL)
+	register := ts.URL + CoverRegisterServiceAPI + "?name=foo&address=" + agent.URL
+	assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", register, "", "k1", ""))
+
+	// the process restarted during the session is counted from zero, not from the baseline
+	for i, key := range []string{"k1", "k2"} {
+		name := strconv.Itoa(i)
+		atomic.StoreInt64(&count, 3)
+		_, err := client.StartSession(name)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, requestWithKey(t, "POST", register, "", key, ""))
+		atomic.StoreInt64(&count, 5)
+		_, err = client.StopSession()
+		assert.NoError(t, err)
+		session, ok := s.sessions.get(name)
+		assert.True(t, ok)
+		assert.Empty(t, session.Processes)
+		assert.Equal(t, "mode: count\nmockService/main.go:30.13,48.33 13 "+[]string{"2", "5"}[i]+"\n", session.Profile)
+	}
+}
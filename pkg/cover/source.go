@@ -0,0 +1,206 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// SourceFunc returns the source of a file in the profiles, which is named by
+// the import path of its package
+type SourceFunc func(file string) ([]byte, error)
+
+// ArchiveSources writes the go files of the packages into w as a tar.gz archive,
+// in which a file is named like in the profiles, e.g. github.com/qiniu/goc/cmd/root.go
+func ArchiveSources(w io.Writer, pkgs map[string]*Package) error {
+	importPaths := make([]string, 0, len(pkgs))
+	for importPath, pkg := range pkgs {
+		if !pkg.Standard && !pkg.Goroot {
+			importPaths = append(importPaths, importPath)
+		}
+	}
+	sort.Strings(importPaths)
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, importPath := range importPaths {
+		pkg := pkgs[importPath]
+		for _, file := range append(append([]string{}, pkg.GoFiles...), pkg.CgoFiles...) {
+			if err := archiveFile(tw, pkg.ImportPath+"/"+file, filepath.Join(pkg.Dir, file)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func archiveFile(tw *tar.Writer, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// cleanSourceName checks that the file named in a profile or an archive stays
+// under the directory it is looked up in
+func cleanSourceName(file string) (string, error) {
+	name := path.Clean(filepath.ToSlash(file))
+	if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || filepath.VolumeName(file) != "" {
+		return "", fmt.Errorf("invalid source file name %s", file)
+	}
+	return name, nil
+}
+
+// SourceLookup looks a file up in dir, where the archives uploaded at build time are
+// extracted, then in the module root, or the GOPATH src directory if there is no go.mod
+// in it. Either of them can be empty.
+func SourceLookup(root, dir string) SourceFunc {
+	modPath := modulePath(root)
+	return func(file string) ([]byte, error) {
+		name, err := cleanSourceName(file)
+		if err != nil {
+			return nil, err
+		}
+		if dir != "" {
+			src, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+			if err == nil || !os.IsNotExist(err) || root == "" {
+				return src, err
+			}
+		}
+		if root == "" {
+			return nil, fmt.Errorf("no source of %s", file)
+		}
+		if modPath != "" {
+			if name == modPath || !strings.HasPrefix(name, modPath+"/") {
+				return nil, fmt.Errorf("%s is not in module %s", file, modPath)
+			}
+			name = strings.TrimPrefix(name, modPath+"/")
+		}
+		return ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+	}
+}
+
+// modulePath reads the module path from the go.mod in root, empty if there is none
+func modulePath(root string) string {
+	if root == "" {
+		return ""
+	}
+	f, err := os.Open(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "module") {
+			return strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "module")), `"`)
+		}
+	}
+	return ""
+}
+
+// extractSources extracts the tar.gz archive of the sources into dir
+func extractSources(r io.Reader, dir string) (int, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := cleanSourceName(hdr.Name)
+		if err != nil {
+			return n, err
+		}
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return n, err
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			return n, err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// uploadSource receives the archive of the sources made by ArchiveSources at build time,
+// the files of the same name uploaded before are replaced.
+// POST /v1/cover/source
+func (s *server) uploadSource(c *gin.Context) {
+	if s.SourceDir == "" {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": "source upload is disabled"})
+		return
+	}
+	n, err := extractSources(c.Request.Body, s.SourceDir)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": fmt.Sprintf("invalid source archive, err: %v", err)})
+		return
+	}
+	log.Infof("%d source files uploaded from %s", n, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"result": "success", "files": n})
+}
@@ -0,0 +1,119 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceLookup(t *testing.T) {
+	root, err := ioutil.TempDir("", "goc-source")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "pkg"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/foo\n\ngo 1.13\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "pkg", "b.go"), []byte("package pkg\n"), 0644))
+
+	lookup := SourceLookup(root, "")
+	src, err := lookup("example.com/foo/pkg/b.go")
+	assert.NoError(t, err)
+	assert.Equal(t, "package pkg\n", string(src))
+	for _, invalid := range []string{"example.com/bar/pkg/b.go", "example.com/foo/../../etc/passwd", "/etc/passwd", "../go.mod"} {
+		_, err := lookup(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	// a root without go.mod is a GOPATH src directory
+	src, err = SourceLookup(filepath.Join(root, ".."), "")(filepath.Base(root) + "/pkg/b.go")
+	assert.NoError(t, err)
+	assert.Equal(t, "package pkg\n", string(src))
+
+	_, err = SourceLookup("", "")("example.com/foo/pkg/b.go")
+	assert.Error(t, err)
+}
+
+func TestArchiveAndExtractSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-source")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644))
+
+	var buf bytes.Buffer
+	assert.NoError(t, ArchiveSources(&buf, map[string]*Package{
+		"example.com/foo": {Dir: dir, ImportPath: "example.com/foo", GoFiles: []string{"main.go"}},
+		"fmt":             {Dir: "/nonexistent", ImportPath: "fmt", GoFiles: []string{"print.go"}, Standard: true},
+	}))
+
+	out := filepath.Join(dir, "out")
+	n, err := extractSources(&buf, out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	src, err := SourceLookup("", out)("example.com/foo/main.go")
+	assert.NoError(t, err)
+	assert.Equal(t, "package main\n", string(src))
+
+	// the files out of the directory are rejected
+	buf.Reset()
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "../evil.go", Mode: 0644, Size: 1}))
+	_, err = tw.Write([]byte("x"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	_, err = extractSources(&buf, out)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "evil.go"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHTMLWithUploadedSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-source")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(htmlSource), 0644))
+
+	s, center, closeCenter := newCenterWithAgent(t, "foo", htmlProfile)
+	defer closeCenter()
+
+	var archive bytes.Buffer
+	assert.NoError(t, ArchiveSources(&archive, map[string]*Package{
+		"example.com/foo": {Dir: dir, ImportPath: "example.com/foo", GoFiles: []string{"main.go"}},
+	}))
+	_, err = NewWorker(center.URL).UploadSource(bytes.NewReader(archive.Bytes()))
+	assert.Error(t, err, "the upload is disabled without SourceDir")
+
+	s.SourceDir = filepath.Join(dir, "sources")
+	_, err = NewWorker(center.URL).UploadSource(&archive)
+	assert.NoError(t, err)
+
+	page, err := NewWorker(center.URL).HTML(ProfileParam{Service: []string{"foo"}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(page), `<span class="cov10" title="5">`)
+	assert.Contains(t, string(page), `source not found`)
+
+	_, err = NewWorker(center.URL).HTML(ProfileParam{Service: []string{"bar"}})
+	assert.Error(t, err)
+}
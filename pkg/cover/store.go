@@ -20,10 +20,12 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -51,6 +53,50 @@ type Store interface {
 	Remove(addr string) error
 }
 
+// ServiceRecord is the state of a registered address kept by a RecordStore
+type ServiceRecord struct {
+	Name          string            `json:"name"`
+	Address       string            `json:"address"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	RegisteredAt  time.Time         `json:"registeredAt"`
+	Health        string            `json:"health,omitempty"`
+	LastHeartbeat time.Time         `json:"lastHeartbeat"`
+}
+
+// Tombstone is the last profile of a service which deregistered or died
+type Tombstone struct {
+	Name      string    `json:"name"`
+	Address   string    `json:"address"`
+	Collected time.Time `json:"collected"`
+	Profile   string    `json:"profile"` // in text format
+	// Dropped marks the tombstone dropped at the time of Collected, so that the peers drop it as well
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// RecordStore is implemented by the stores keeping richer records of the services
+// besides their addresses, so that they survive the restart of the center
+type RecordStore interface {
+	Store
+
+	// Records returns the records of all the registered addresses
+	Records() ([]ServiceRecord, error)
+
+	// UpdateHealth persists the liveness of the given address
+	UpdateHealth(addr, health string, lastHeartbeat time.Time) error
+
+	// UpdateLabels persists the labels registered by the given address
+	UpdateLabels(addr string, labels map[string]string) error
+
+	// PutTombstone persists the tombstone, replacing the one of the same address
+	PutTombstone(t Tombstone) error
+
+	// DropTombstone drops the persisted tombstone of the address
+	DropTombstone(addr string) error
+
+	// Tombstones returns all the persisted tombstones
+	Tombstones() ([]Tombstone, error)
+}
+
 // fileStore holds the registered services into memory and persistent to a local file
 type fileStore struct {
 	mu             sync.RWMutex
@@ -75,7 +121,7 @@ func NewFileStore(persistenceFile string) (store Store, err error) {
 	}
 
 	if err := l.load(); err != nil {
-		log.Fatalf("load failed, file: %s, err: %v", l.persistentFile, err)
+		return nil, fmt.Errorf("load failed, file: %s, err: %v", l.persistentFile, err)
 	}
 
 	return l, nil
@@ -131,8 +177,6 @@ func (l *fileStore) Init() error {
 
 // load all registered service from file to memory
 func (l *fileStore) load() error {
-	var svrsMap = make(map[string][]string, 0)
-
 	f, err := os.Open(l.persistentFile)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -142,7 +186,20 @@ func (l *fileStore) load() error {
 	}
 	defer f.Close()
 
-	ns := bufio.NewScanner(f)
+	svrsMap, err := parseServices(f)
+	if err != nil {
+		return fmt.Errorf("read file failed, file: %s, err: %v", l.persistentFile, err)
+	}
+
+	// set information to memory
+	l.memoryStore.Set(svrsMap)
+	return nil
+}
+
+// parseServices parses the services persisted by fileStore, one 'name&address' per line
+func parseServices(r io.Reader) (map[string][]string, error) {
+	var svrsMap = make(map[string][]string, 0)
+	ns := bufio.NewScanner(r)
 	for ns.Scan() {
 		line := ns.Text()
 		ss := strings.FieldsFunc(line, split)
@@ -159,12 +216,9 @@ func (l *fileStore) load() error {
 	}
 
 	if err := ns.Err(); err != nil {
-		return fmt.Errorf("read file failed, file: %s, err: %v", l.persistentFile, err)
+		return nil, err
 	}
-
-	// set information to memory
-	l.memoryStore.Set(svrsMap)
-	return nil
+	return svrsMap, nil
 }
 
 func (l *fileStore) Set(services map[string][]string) error {
@@ -0,0 +1,300 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/tools/cover"
+)
+
+const (
+	// DefaultStreamInterval is how often the services are collected while streams are open
+	DefaultStreamInterval = 2 * time.Second
+
+	// EventCovered carries the blocks of a file newly covered by a service
+	EventCovered = "covered"
+	// EventCleared tells the counters of a service were cleared, so its blocks are covered anew
+	EventCleared = "cleared"
+
+	// streamBuffer is the number of events a stream may fall behind before it is closed,
+	// the client reconnects to start over from the current coverage
+	streamBuffer = 1024
+	// streamKeepAlive is how often a comment is sent over an idle stream
+	streamKeepAlive = 15 * time.Second
+)
+
+// CoverageEvent is sent over the stream whenever a change of the coverage is detected
+type CoverageEvent struct {
+	Type    string `json:"type"`
+	Service string `json:"service"`
+	Address string `json:"address"`
+	// File and Blocks are set for the covered events
+	File   string      `json:"file,omitempty"`
+	Blocks []JSONBlock `json:"blocks,omitempty"`
+}
+
+// subscriber is an open stream, which receives the events of the services and the files it matches
+type subscriber struct {
+	matchService func(name, addr string) bool
+	matchFile    func(file string) bool
+	events       chan CoverageEvent
+}
+
+// coverageFeed dispatches the changes of the profiles collected to the open streams,
+// and keeps collecting the profiles while any stream is open. The zero value is ready to use.
+type coverageFeed struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	// stop ends the collection, nil if no stream is open
+	stop chan struct{}
+}
+
+// subscribe adds the stream, and starts the collection with the first one
+func (f *coverageFeed) subscribe(sub *subscriber, watch func(stop <-chan struct{})) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subscribers == nil {
+		f.subscribers = make(map[*subscriber]struct{})
+	}
+	f.subscribers[sub] = struct{}{}
+	if f.stop == nil {
+		f.stop = make(chan struct{})
+		go watch(f.stop)
+	}
+}
+
+// unsubscribe removes the stream, and stops the collection with the last one
+func (f *coverageFeed) unsubscribe(sub *subscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subscribers[sub]; !ok {
+		return
+	}
+	delete(f.subscribers, sub)
+	close(sub.events)
+	if len(f.subscribers) == 0 && f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+// matchAny reports whether any stream is interested in the address
+func (f *coverageFeed) matchAny(name, addr string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subscribers {
+		if sub.matchService(name, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish sends the changes from the previous profile of the address to the current one
+func (f *coverageFeed) publish(name, addr string, prev, profile []*cover.Profile) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subscribers) == 0 {
+		return
+	}
+	var subs []*subscriber
+	for sub := range f.subscribers {
+		if sub.matchService(name, addr) {
+			subs = append(subs, sub)
+		}
+	}
+	if len(subs) == 0 {
+		return
+	}
+
+	for _, ev := range coverageEvents(name, addr, prev, profile) {
+		for _, sub := range subs {
+			if _, open := f.subscribers[sub]; !open {
+				continue
+			}
+			if ev.Type == EventCovered && !sub.matchFile(ev.File) {
+				continue
+			}
+			select {
+			case sub.events <- ev:
+			default:
+				// the stream falls too far behind, close it rather than lose the events silently
+				delete(f.subscribers, sub)
+				close(sub.events)
+			}
+		}
+	}
+	if len(f.subscribers) == 0 && f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+// coverageEvents returns the blocks covered in the profile but not in the previous one of the same
+// address. The blocks of a file changed, e.g. by a new binary, are all taken as newly covered, and
+// a block covered before but not anymore means the counters were cleared.
+func coverageEvents(name, addr string, prev, profile []*cover.Profile) []CoverageEvent {
+	before := make(map[string]*cover.Profile, len(prev))
+	for _, p := range prev {
+		before[p.FileName] = p
+	}
+	var events []CoverageEvent
+	cleared := false
+	for _, p := range profile {
+		b, ok := before[p.FileName]
+		if ok && !sameBlocks(p, b) {
+			b, ok = nil, false
+		}
+		var blocks []JSONBlock
+		for i, block := range p.Blocks {
+			was := ok && b.Blocks[i].Count > 0
+			if block.Count > 0 && !was {
+				blocks = append(blocks, JSONBlock{
+					StartLine: block.StartLine,
+					StartCol:  block.StartCol,
+					EndLine:   block.EndLine,
+					EndCol:    block.EndCol,
+					NumStmt:   block.NumStmt,
+					Count:     block.Count,
+				})
+			}
+			if block.Count == 0 && was {
+				cleared = true
+			}
+		}
+		if len(blocks) > 0 {
+			events = append(events, CoverageEvent{Type: EventCovered, Service: name, Address: addr, File: p.FileName, Blocks: blocks})
+		}
+	}
+	if cleared {
+		events = append([]CoverageEvent{{Type: EventCleared, Service: name, Address: addr}}, events...)
+	}
+	return events
+}
+
+// publishProfile sends the changes of the profile just cached to the open streams
+func (s *server) publishProfile(name, addr string, prev *cachedProfile, profile []*cover.Profile) {
+	var before []*cover.Profile
+	if prev != nil {
+		before = prev.profile
+	}
+	s.feed.publish(name, addr, before, profile)
+}
+
+// watchStreams collects the profiles of the addresses watched by the streams periodically until stopped,
+// the changes are published as they are collected
+func (s *server) watchStreams(stop <-chan struct{}) {
+	interval := s.StreamInterval
+	if interval <= 0 {
+		interval = DefaultStreamInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.collectStreams()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) collectStreams() {
+	names := serviceNames(s.Store.GetAll())
+	addrs := make([]string, 0, len(names))
+	for addr, name := range names {
+		if s.feed.matchAny(name, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	sort.Strings(addrs)
+	ctx, cancel := withTimeout(context.Background(), s.ProfileTimeout)
+	defer cancel()
+	s.collectProfiles(ctx, addrs, names, s.AgentTimeout, "")
+}
+
+// stream pushes the blocks newly covered by the services as server-sent events, starting with the ones
+// covered in the profiles the center holds. The services are selected as by the profile API, and the
+// files by the coverfile and skipfile patterns and the package prefixes.
+// GET /v1/cover/stream?service=xxx&coverfile=xxx
+func (s *server) stream(c *gin.Context) {
+	var body ProfileParam
+	if err := c.ShouldBindQuery(&body); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	matchService, err := s.matcher(body)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	matchFile, err := fileMatcher(body.CoverFilePatterns, body.SkipFilePatterns, body.Packages)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub := &subscriber{matchService: matchService, matchFile: matchFile, events: make(chan CoverageEvent, streamBuffer)}
+	s.feed.subscribe(sub, s.watchStreams)
+	defer s.feed.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	for _, p := range s.profiles.all() {
+		if !matchService(p.name, p.address) {
+			continue
+		}
+		for _, ev := range coverageEvents(p.name, p.address, nil, p.profile) {
+			if matchFile(ev.File) {
+				c.SSEvent(ev.Type, ev)
+			}
+		}
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			c.SSEvent(ev.Type, ev)
+		case <-keepAlive.C:
+			if _, err := c.Writer.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
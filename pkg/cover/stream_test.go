@@ -0,0 +1,151 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoverageEvents(t *testing.T) {
+	prev, err := ParseProfile(strings.NewReader("mode: count\n" +
+		"a.go:1.1,2.2 1 1\na.go:3.1,4.2 1 0\n" +
+		"b.go:1.1,2.2 1 0\n"))
+	assert.NoError(t, err)
+	profile, err := ParseProfile(strings.NewReader("mode: count\n" +
+		"a.go:1.1,2.2 1 2\na.go:3.1,4.2 1 1\n" +
+		"b.go:1.1,2.2 1 0\n"))
+	assert.NoError(t, err)
+
+	events := coverageEvents("foo", "http://127.0.0.1:8900", prev, profile)
+	assert.Equal(t, []CoverageEvent{{
+		Type:    EventCovered,
+		Service: "foo",
+		Address: "http://127.0.0.1:8900",
+		File:    "a.go",
+		Blocks:  []JSONBlock{{StartLine: 3, StartCol: 1, EndLine: 4, EndCol: 2, NumStmt: 1, Count: 1}},
+	}}, events)
+
+	// the counters cleared are told before the blocks covered anew
+	events = coverageEvents("foo", "http://127.0.0.1:8900", profile, prev)
+	assert.Equal(t, []CoverageEvent{{Type: EventCleared, Service: "foo", Address: "http://127.0.0.1:8900"}}, events)
+	cleared, err := ParseProfile(strings.NewReader("mode: count\n" +
+		"a.go:1.1,2.2 1 0\na.go:3.1,4.2 1 0\n" +
+		"b.go:1.1,2.2 1 3\n"))
+	assert.NoError(t, err)
+	events = coverageEvents("foo", "http://127.0.0.1:8900", profile, cleared)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, EventCleared, events[0].Type)
+	assert.Equal(t, "b.go", events[1].File)
+
+	assert.Empty(t, coverageEvents("foo", "http://127.0.0.1:8900", profile, profile))
+}
+
+func TestStream(t *testing.T) {
+	var count int64
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("mode: count\n" +
+			"mockService/main.go:30.13,48.33 13 1\n" +
+			"mockService/main.go:50.13,52.2 1 " + strconv.FormatInt(atomic.LoadInt64(&count), 10) + "\n" +
+			"mockService/other.go:1.1,2.2 1 1\n"))
+	}))
+	defer agent.Close()
+
+	s := &server{Store: NewMemoryStore(), StreamInterval: 50 * time.Millisecond}
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: agent.URL}))
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "bar", Address: "http://127.0.0.1:1"}))
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + CoverStreamAPI + "?coverfile=main.go$&servicepattern=^fo")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	events := make(chan CoverageEvent)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data:"); data != scanner.Text() {
+				var ev CoverageEvent
+				assert.NoError(t, json.Unmarshal([]byte(data), &ev))
+				events <- ev
+			}
+		}
+	}()
+	next := func() CoverageEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+			return CoverageEvent{}
+		}
+	}
+
+	// the blocks covered are first sent as they are collected, the other files are filtered out
+	ev := next()
+	assert.Equal(t, EventCovered, ev.Type)
+	assert.Equal(t, "foo", ev.Service)
+	assert.Equal(t, "mockService/main.go", ev.File)
+	assert.Equal(t, []JSONBlock{{StartLine: 30, StartCol: 13, EndLine: 48, EndCol: 33, NumStmt: 13, Count: 1}}, ev.Blocks)
+
+	// then only the blocks newly covered
+	atomic.StoreInt64(&count, 2)
+	ev = next()
+	assert.Equal(t, []JSONBlock{{StartLine: 50, StartCol: 13, EndLine: 52, EndCol: 2, NumStmt: 1, Count: 2}}, ev.Blocks)
+
+	// and the clears
+	atomic.StoreInt64(&count, 0)
+	assert.Equal(t, EventCleared, next().Type)
+
+	// a new stream starts with the profiles the center holds
+	res2, err := http.Get(ts.URL + CoverStreamAPI + "?service=foo&skipfile=main.go$")
+	assert.NoError(t, err)
+	scanner := bufio.NewScanner(res2.Body)
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "data:") {
+	}
+	assert.Contains(t, scanner.Text(), `"file":"mockService/other.go"`)
+	res2.Body.Close()
+
+	// the collection stops with the last stream
+	res.Body.Close()
+	for range events {
+	}
+	assert.Eventually(t, func() bool {
+		s.feed.mu.Lock()
+		defer s.feed.mu.Unlock()
+		return s.feed.stop == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	res, err = http.Get(ts.URL + CoverStreamAPI + "?coverfile=(")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusExpectationFailed, res.StatusCode)
+	res.Body.Close()
+}
@@ -0,0 +1,172 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/tools/cover"
+)
+
+// ProfileSummary is the coverage of every package and every file of a profile,
+// the coverages are the ratios of the statements covered
+type ProfileSummary struct {
+	Mode       string           `json:"mode"`
+	Statements int              `json:"statements"`
+	Covered    int              `json:"covered"`
+	Coverage   float64          `json:"coverage"`
+	Packages   []PackageSummary `json:"packages"`
+}
+
+// PackageSummary is the coverage of a package
+type PackageSummary struct {
+	Package    string        `json:"package"`
+	Statements int           `json:"statements"`
+	Covered    int           `json:"covered"`
+	Coverage   float64       `json:"coverage"`
+	Files      []FileSummary `json:"files"`
+}
+
+// FileSummary is the coverage of a file, Path is where it is in the repository
+type FileSummary struct {
+	ImportPath string  `json:"importPath"`
+	Path       string  `json:"path"`
+	Statements int     `json:"statements"`
+	Covered    int     `json:"covered"`
+	Coverage   float64 `json:"coverage"`
+}
+
+// Summarize returns the coverage of the packages and the files of the profiles, ordered by their names
+func Summarize(profiles []*cover.Profile, mappings []PathMapping) ProfileSummary {
+	res := ProfileSummary{Packages: make([]PackageSummary, 0)}
+	pkgs := make(map[string]int)
+	for _, p := range profiles {
+		res.Mode = p.Mode
+		total, covered := statements(p)
+		name := path.Dir(p.FileName)
+		i, ok := pkgs[name]
+		if !ok {
+			i = len(res.Packages)
+			pkgs[name] = i
+			res.Packages = append(res.Packages, PackageSummary{Package: name})
+		}
+		pkg := &res.Packages[i]
+		pkg.Files = append(pkg.Files, FileSummary{
+			ImportPath: p.FileName,
+			Path:       mapPath(p.FileName, mappings),
+			Statements: total,
+			Covered:    covered,
+			Coverage:   ratio(covered, total),
+		})
+		pkg.Statements += total
+		pkg.Covered += covered
+		res.Statements += total
+		res.Covered += covered
+	}
+	for i := range res.Packages {
+		pkg := &res.Packages[i]
+		pkg.Coverage = ratio(pkg.Covered, pkg.Statements)
+		sort.Slice(pkg.Files, func(a, b int) bool { return pkg.Files[a].ImportPath < pkg.Files[b].ImportPath })
+	}
+	sort.Slice(res.Packages, func(a, b int) bool { return res.Packages[a].Package < res.Packages[b].Package })
+	res.Coverage = ratio(res.Covered, res.Statements)
+	return res
+}
+
+// findFile returns the profile of the file given by its import path or its path in the repository,
+// or by the end of either of them if only one file ends so
+func findFile(profiles []*cover.Profile, file string, mappings []PathMapping) (*cover.Profile, error) {
+	file = strings.TrimPrefix(path.Clean(file), "./")
+	var candidates []*cover.Profile
+	for _, p := range profiles {
+		mapped := strings.TrimPrefix(mapPath(p.FileName, mappings), "./")
+		if p.FileName == file || mapped == file {
+			return p, nil
+		}
+		if strings.HasSuffix(p.FileName, "/"+file) || strings.HasSuffix(mapped, "/"+file) {
+			candidates = append(candidates, p)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("no coverage of %s", file)
+	case 1:
+		return candidates[0], nil
+	}
+	names := make([]string, 0, len(candidates))
+	for _, p := range candidates {
+		names = append(names, p.FileName)
+	}
+	return nil, fmt.Errorf("%s is ambiguous, could be %s", file, strings.Join(names, ", "))
+}
+
+// summary returns the coverage of every package and every file of the merged profile
+// of the services selected as by the profile API.
+// GET /v1/cover/summary?service=xxx
+func (s *server) summary(c *gin.Context) {
+	var body ProfileParam
+	if err := c.ShouldBind(&body); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	mappings, err := ParsePathMappings(body.PathMappings)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	merged, _, ok := s.mergedProfile(c, body)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, Summarize(merged, mappings))
+}
+
+// fileBlocks returns the blocks of a file in the merged profile of the services selected
+// as by the profile API. The file is given by its import path or its path in the repository.
+// GET /v1/cover/file?path=xxx&service=xxx
+func (s *server) fileBlocks(c *gin.Context) {
+	var body ProfileParam
+	if err := c.ShouldBind(&body); err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	file := c.Query("path")
+	if file == "" {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": "invalid path"})
+		return
+	}
+	mappings, err := ParsePathMappings(body.PathMappings)
+	if err != nil {
+		c.JSON(http.StatusExpectationFailed, gin.H{"error": err.Error()})
+		return
+	}
+	merged, _, ok := s.mergedProfile(c, body)
+	if !ok {
+		return
+	}
+	p, err := findFile(merged, file, mappings)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, newJSONFile(p, mappings))
+}
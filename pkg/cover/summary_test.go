@@ -0,0 +1,116 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const summaryProfile = "mode: count\n" +
+	"github.com/qiniu/goc/pkg/cover/server.go:1.1,2.2 3 1\n" +
+	"github.com/qiniu/goc/pkg/cover/server.go:3.1,4.2 1 0\n" +
+	"github.com/qiniu/goc/pkg/cover/store.go:1.1,2.2 2 0\n" +
+	"github.com/qiniu/goc/cmd/server.go:1.1,2.2 4 2\n"
+
+func TestSummarize(t *testing.T) {
+	profiles, err := ParseProfile(strings.NewReader(summaryProfile))
+	assert.NoError(t, err)
+	mappings, err := ParsePathMappings([]string{"github.com/qiniu/goc=."})
+	assert.NoError(t, err)
+
+	summary := Summarize(profiles, mappings)
+	assert.Equal(t, "count", summary.Mode)
+	assert.Equal(t, 10, summary.Statements)
+	assert.Equal(t, 7, summary.Covered)
+	assert.Equal(t, 2, len(summary.Packages))
+	assert.Equal(t, PackageSummary{
+		Package: "github.com/qiniu/goc/cmd", Statements: 4, Covered: 4, Coverage: 1,
+		Files: []FileSummary{{ImportPath: "github.com/qiniu/goc/cmd/server.go", Path: "cmd/server.go", Statements: 4, Covered: 4, Coverage: 1}},
+	}, summary.Packages[0])
+	pkg := summary.Packages[1]
+	assert.Equal(t, "github.com/qiniu/goc/pkg/cover", pkg.Package)
+	assert.Equal(t, 0.5, pkg.Coverage)
+	assert.Equal(t, "pkg/cover/server.go", pkg.Files[0].Path)
+	assert.Equal(t, 0.75, pkg.Files[0].Coverage)
+	assert.Equal(t, "pkg/cover/store.go", pkg.Files[1].Path)
+}
+
+func TestFindFile(t *testing.T) {
+	profiles, err := ParseProfile(strings.NewReader(summaryProfile))
+	assert.NoError(t, err)
+	mappings, err := ParsePathMappings([]string{"github.com/qiniu/goc=."})
+	assert.NoError(t, err)
+
+	for _, file := range []string{"github.com/qiniu/goc/pkg/cover/server.go", "pkg/cover/server.go", "./pkg/cover/server.go", "cover/server.go"} {
+		p, err := findFile(profiles, file, mappings)
+		assert.NoError(t, err, file)
+		assert.Equal(t, "github.com/qiniu/goc/pkg/cover/server.go", p.FileName)
+	}
+	p, err := findFile(profiles, "pkg/cover/store.go", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "github.com/qiniu/goc/pkg/cover/store.go", p.FileName)
+
+	_, err = findFile(profiles, "server.go", mappings)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ambiguous")
+	_, err = findFile(profiles, "main.go", mappings)
+	assert.Error(t, err)
+}
+
+func TestSummaryAndFileAPI(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(summaryProfile))
+	}))
+	defer agent.Close()
+	s := &server{Store: NewMemoryStore()}
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: agent.URL}))
+	router := s.Route(os.Stdout)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", CoverSummaryAPI+"?service=foo&pathmap=github.com/qiniu/goc=.&skipfile=cmd/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var summary ProfileSummary
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+	assert.Equal(t, 1, len(summary.Packages))
+	assert.Equal(t, 0.5, summary.Coverage)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", CoverFileAPI+"?path=pkg/cover/server.go&pathmap=github.com/qiniu/goc=.", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file JSONFile
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Equal(t, "github.com/qiniu/goc/pkg/cover/server.go", file.ImportPath)
+	assert.Equal(t, "pkg/cover/server.go", file.Path)
+	assert.Equal(t, []JSONBlock{
+		{StartLine: 1, StartCol: 1, EndLine: 2, EndCol: 2, NumStmt: 3, Count: 1},
+		{StartLine: 3, StartCol: 1, EndLine: 4, EndCol: 2, NumStmt: 1, Count: 0},
+	}, file.Blocks)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", CoverFileAPI+"?path=main.go", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", CoverFileAPI, nil))
+	assert.Equal(t, http.StatusExpectationFailed, w.Code)
+}
@@ -0,0 +1,159 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA issues the certificates for 127.0.0.1 into the directory
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// File is the PEM of the CA
+	File string
+	n    int64
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	ca := &testCA{t: t, dir: dir}
+	ca.File, _, ca.cert, ca.key = ca.issue("ca", nil, nil)
+	return ca
+}
+
+// Issue returns the files of a certificate for both the server and the client authentication
+func (ca *testCA) Issue(name string) (certFile, keyFile string) {
+	certFile, keyFile, _, _ = ca.issue(name, ca.cert, ca.key)
+	return
+}
+
+func (ca *testCA) issue(name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(ca.t, err)
+	ca.n++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.n),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.NoError(ca.t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(ca.t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(ca.t, err)
+
+	certFile, keyFile := filepath.Join(ca.dir, name+".pem"), filepath.Join(ca.dir, name+"-key.pem")
+	assert.NoError(ca.t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(ca.t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert, key
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.Issue("server")
+
+	config, err := NewClientTLSConfig("", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+	config, err = NewClientTLSConfig(ca.File, certFile, keyFile)
+	assert.NoError(t, err)
+	assert.NotNil(t, config.RootCAs)
+	assert.Equal(t, 1, len(config.Certificates))
+	_, err = NewClientTLSConfig(keyFile, "", "")
+	assert.Error(t, err)
+	_, err = NewClientTLSConfig("", certFile, "")
+	assert.Error(t, err)
+
+	_, err = NewServerTLSConfig(certFile, "", "")
+	assert.Error(t, err)
+	config, err = NewServerTLSConfig(certFile, keyFile, ca.File)
+	assert.NoError(t, err)
+	assert.NotNil(t, config.ClientCAs)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goc-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir)
+	agentCert, agentKey := ca.Issue("agent")
+	centerCert, centerKey := ca.Issue("center")
+
+	// the agent only answers the clients presenting a certificate of the CA
+	agent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 1"))
+	}))
+	agent.TLS, err = NewServerTLSConfig(agentCert, agentKey, ca.File)
+	assert.NoError(t, err)
+	agent.StartTLS()
+	defer agent.Close()
+
+	clientTLS, err := NewClientTLSConfig(ca.File, centerCert, centerKey)
+	assert.NoError(t, err)
+	s := &server{Store: NewMemoryStore(), ClientTLS: clientTLS}
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: agent.URL}))
+	center := httptest.NewUnstartedServer(s.Route(os.Stdout))
+	center.TLS, err = NewServerTLSConfig(centerCert, centerKey, ca.File)
+	assert.NoError(t, err)
+	center.StartTLS()
+	defer center.Close()
+
+	assert.NoError(t, s.probe(agent.URL))
+	profile, err := NewWorker(center.URL, WithTLSConfig(clientTLS)).Profile(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(profile), "mockService/main.go:30.13,48.33 13 1")
+
+	// neither the center nor the agent answers the clients without a certificate
+	anonymous, err := NewClientTLSConfig(ca.File, "", "")
+	assert.NoError(t, err)
+	_, err = NewWorker(center.URL, WithTLSConfig(anonymous)).Profile(ProfileParam{})
+	assert.Error(t, err)
+	assert.Error(t, (&server{ClientTLS: anonymous}).probe(agent.URL))
+	// nor are they trusted without the CA
+	_, err = NewWorker(center.URL).Profile(ProfileParam{})
+	assert.Error(t, err)
+}
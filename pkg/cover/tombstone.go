@@ -0,0 +1,331 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/tools/cover"
+	"k8s.io/test-infra/gopherage/pkg/cov"
+)
+
+// cachedProfile is the last profile collected from an address
+type cachedProfile struct {
+	name      string
+	address   string
+	profile   []*cover.Profile
+	collected time.Time
+	pushed    bool // uploaded by the service itself in push mode
+}
+
+// profileCache holds the latest profile of every live address, and the
+// tombstones, i.e. the last profiles of the addresses which deregistered or died.
+// The zero value is ready to use.
+type profileCache struct {
+	mu         sync.Mutex
+	latest     map[string]*cachedProfile
+	tombstones map[string]*cachedProfile
+	// gen is increased on every change, so that the summaries of the cache are only recomputed after changes
+	gen uint64
+}
+
+// update caches the profile just collected from the address
+func (pc *profileCache) update(name, addr string, profile []*cover.Profile, now time.Time) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.gen++
+	if pc.latest == nil {
+		pc.latest = make(map[string]*cachedProfile)
+	}
+	pc.latest[addr] = &cachedProfile{name: name, address: addr, profile: profile, collected: now}
+}
+
+// push caches the profile uploaded by the service in push mode
+func (pc *profileCache) push(name, addr string, profile []*cover.Profile, now time.Time) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.gen++
+	if pc.latest == nil {
+		pc.latest = make(map[string]*cachedProfile)
+	}
+	pc.latest[addr] = &cachedProfile{name: name, address: addr, profile: profile, collected: now, pushed: true}
+}
+
+// pushed returns the profile uploaded by the service at the address
+func (pc *profileCache) pushed(addr string) (*cachedProfile, bool) {
+	p, ok := pc.get(addr)
+	if !ok || !p.pushed {
+		return nil, false
+	}
+	return p, true
+}
+
+// get returns the latest profile cached for the address
+func (pc *profileCache) get(addr string) (*cachedProfile, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	p, ok := pc.latest[addr]
+	return p, ok
+}
+
+// all returns the latest profiles of all the live addresses
+func (pc *profileCache) all() []*cachedProfile {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	res := make([]*cachedProfile, 0, len(pc.latest))
+	for _, p := range pc.latest {
+		res = append(res, p)
+	}
+	return res
+}
+
+// last returns the latest profile of the address, or its tombstone if it is gone
+func (pc *profileCache) last(addr string) (*cachedProfile, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if p, ok := pc.latest[addr]; ok {
+		return p, true
+	}
+	p, ok := pc.tombstones[addr]
+	return p, ok
+}
+
+// bury turns the latest profile of the address into a tombstone.
+// A tombstone left by a previous process on the same address is merged with it,
+// the server drops it when the address registers again though, see server.unbury.
+// The resulting tombstone is returned, nil if there was no profile to bury.
+func (pc *profileCache) bury(addr string) *cachedProfile {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	p, ok := pc.latest[addr]
+	if !ok {
+		return nil
+	}
+	delete(pc.latest, addr)
+	pc.gen++
+
+	if pc.tombstones == nil {
+		pc.tombstones = make(map[string]*cachedProfile)
+	}
+	if prev, ok := pc.tombstones[addr]; ok {
+		merged, err := mergeProfiles([][]*cover.Profile{prev.profile, p.profile})
+		if err != nil {
+			log.Warnf("failed to merge the tombstones of %s, keep the latest one, err: %v", addr, err)
+		} else {
+			p.profile = merged
+		}
+	}
+	pc.tombstones[addr] = p
+	return p
+}
+
+// unbury drops the tombstone of the address, it reports whether there was one
+func (pc *profileCache) unbury(addr string) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if _, ok := pc.tombstones[addr]; !ok {
+		return false
+	}
+	delete(pc.tombstones, addr)
+	pc.gen++
+	return true
+}
+
+// tombs returns the tombstones of all the addresses
+func (pc *profileCache) tombs() []*cachedProfile {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	res := make([]*cachedProfile, 0, len(pc.tombstones))
+	for _, p := range pc.tombstones {
+		res = append(res, p)
+	}
+	return res
+}
+
+// entomb restores a tombstone persisted before the center restarted
+func (pc *profileCache) entomb(p *cachedProfile) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.gen++
+	if pc.tombstones == nil {
+		pc.tombstones = make(map[string]*cachedProfile)
+	}
+	pc.tombstones[p.address] = p
+}
+
+// buried returns the tombstones of the services matched, the latest collected first.
+// All the tombstones are returned if match is nil.
+func (pc *profileCache) buried(match func(name, addr string) bool) []*cachedProfile {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	var res []*cachedProfile
+	for addr, p := range pc.tombstones {
+		if match == nil || match(p.name, addr) {
+			res = append(res, p)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].collected.After(res[j].collected) })
+	return res
+}
+
+// byService returns the latest profiles and the tombstones grouped by service,
+// with the generation of the cache
+func (pc *profileCache) byService() (map[string][][]*cover.Profile, uint64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	res := make(map[string][][]*cover.Profile)
+	for _, cached := range []map[string]*cachedProfile{pc.latest, pc.tombstones} {
+		for _, p := range cached {
+			res[p.name] = append(res[p.name], p.profile)
+		}
+	}
+	return res, pc.gen
+}
+
+// buriedServices returns the names of services having tombstones
+func (pc *profileCache) buriedServices() []string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	var names []string
+	for _, p := range pc.tombstones {
+		if !contains(names, p.name) {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// forget drops the latest profile of the address without leaving a tombstone
+func (pc *profileCache) forget(addr string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.gen++
+	delete(pc.latest, addr)
+}
+
+func (pc *profileCache) reset() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.gen++
+	pc.latest = nil
+	pc.tombstones = nil
+}
+
+// bury keeps the last profile of the address as a tombstone,
+// which is persisted as well if the store keeps records
+func (s *server) bury(addr string) {
+	p := s.profiles.bury(addr)
+	if p == nil {
+		return
+	}
+	rs, ok := s.Store.(RecordStore)
+	if !ok {
+		return
+	}
+	var buf bytes.Buffer
+	if err := cov.DumpProfile(p.profile, &buf); err != nil {
+		log.Warnf("failed to dump the tombstone of %s, err: %v", addr, err)
+		return
+	}
+	t := Tombstone{Name: p.name, Address: addr, Collected: p.collected, Profile: buf.String()}
+	if err := rs.PutTombstone(t); err != nil {
+		log.Warnf("failed to persist the tombstone of %s, err: %v", addr, err)
+	}
+}
+
+// unbury drops the tombstone of the address, which is dropped from the store as well if it keeps records
+func (s *server) unbury(addr string) {
+	if !s.profiles.unbury(addr) {
+		return
+	}
+	rs, ok := s.Store.(RecordStore)
+	if !ok {
+		return
+	}
+	if err := rs.DropTombstone(addr); err != nil {
+		log.Warnf("failed to drop the persisted tombstone of %s, err: %v", addr, err)
+	}
+}
+
+// mergeWithTombstones merges the profiles collected and the tombstones. Unlike a profile collected,
+// a tombstone mismatching the blocks merged before does not fail the merge but is skipped,
+// e.g. the last profile of the previous build after a rolling deploy.
+// The addresses of the tombstones skipped are returned.
+func mergeWithTombstones(profiles [][]*cover.Profile, tombs []*cachedProfile) ([]*cover.Profile, []string, error) {
+	m := NewProfileMerger()
+	for _, p := range profiles {
+		if err := m.Add(p); err != nil {
+			return nil, nil, err
+		}
+	}
+	var skipped []string
+	for _, t := range tombs {
+		if err := m.fits(t.profile); err != nil {
+			log.Warnf("skip the tombstone of %s mismatching the profiles merged, err: %v", t.address, err)
+			skipped = append(skipped, t.address)
+			continue
+		}
+		if err := m.Add(t.profile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return m.Profiles(), skipped, nil
+}
+
+// watchSnapshots collects the profiles of all the healthy addresses periodically
+// until the process exits, so that they are kept as tombstones once the services die
+func (s *server) watchSnapshots() {
+	for now := range time.Tick(s.SnapshotInterval) {
+		s.snapshot(now)
+	}
+}
+
+func (s *server) snapshot(now time.Time) {
+	for name, addrs := range s.Store.GetAll() {
+		for _, addr := range addrs {
+			if s.agents.isUnhealthy(addr) {
+				continue
+			}
+			// the services in push mode keep their profiles fresh by themselves
+			if _, ok := s.profiles.pushed(addr); ok {
+				continue
+			}
+			ctx, cancel := s.agentContext()
+			if _, err := s.collect(ctx, name, addr, now); err != nil {
+				log.Warnf("failed to snapshot the profile of %s, err: %v", addr, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// collect gets the profile from the address and caches it
+func (s *server) collect(ctx context.Context, name, addr string, now time.Time) ([]*cover.Profile, error) {
+	profile, err := s.scrape(ctx, addr, "")
+	if err != nil {
+		return nil, err
+	}
+	prev, _ := s.profiles.get(addr)
+	s.profiles.update(name, addr, profile, now)
+	s.publishProfile(name, addr, prev, profile)
+	return profile, nil
+}
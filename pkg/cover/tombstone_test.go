@@ -0,0 +1,191 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/tools/cover"
+)
+
+func TestProfileCacheBury(t *testing.T) {
+	var pc profileCache
+	now := time.Now()
+	profile := func(count int) []*cover.Profile {
+		return []*cover.Profile{
+			{
+				FileName: "a/b.go",
+				Mode:     "count",
+				Blocks:   []cover.ProfileBlock{{StartLine: 1, EndLine: 2, NumStmt: 1, Count: count}},
+			},
+		}
+	}
+
+	// nothing to bury
+	pc.bury("http://127.0.0.1:8000")
+	assert.Nil(t, pc.buried(nil))
+
+	pc.update("foo", "http://127.0.0.1:8000", profile(1), now)
+	pc.update("bar", "http://127.0.0.1:8001", profile(5), now)
+	cached, ok := pc.get("http://127.0.0.1:8000")
+	assert.True(t, ok)
+	assert.Equal(t, "foo", cached.name)
+
+	// the latest profiles of live services are not tombstones
+	assert.Nil(t, pc.buried(nil))
+
+	pc.bury("http://127.0.0.1:8000")
+	_, ok = pc.get("http://127.0.0.1:8000")
+	assert.False(t, ok)
+	assert.Equal(t, [][]*cover.Profile{profile(1)}, profilesOf(pc.buried(nil)))
+	assert.Equal(t, []string{"foo"}, pc.buriedServices())
+
+	// another process died on the same address
+	pc.update("foo", "http://127.0.0.1:8000", profile(2), now)
+	pc.bury("http://127.0.0.1:8000")
+	assert.Equal(t, [][]*cover.Profile{profile(3)}, profilesOf(pc.buried(func(name, addr string) bool { return name == "foo" })))
+	assert.Equal(t, [][]*cover.Profile{profile(3)}, profilesOf(pc.buried(func(name, addr string) bool { return addr == "http://127.0.0.1:8000" })))
+	assert.Nil(t, pc.buried(func(name, addr string) bool { return name == "bar" }))
+
+	pc.reset()
+	assert.Nil(t, pc.buried(nil))
+	_, ok = pc.get("http://127.0.0.1:8001")
+	assert.False(t, ok)
+}
+
+func profilesOf(tombs []*cachedProfile) [][]*cover.Profile {
+	var res [][]*cover.Profile
+	for _, t := range tombs {
+		res = append(res, t.profile)
+	}
+	return res
+}
+
+func TestMergeWithTombstones(t *testing.T) {
+	profile := func(file string, count int, blocks ...int) []*cover.Profile {
+		p := &cover.Profile{FileName: file, Mode: "count"}
+		for _, line := range blocks {
+			p.Blocks = append(p.Blocks, cover.ProfileBlock{StartLine: line, EndLine: line + 1, NumStmt: 1, Count: count})
+		}
+		return []*cover.Profile{p}
+	}
+	now := time.Now()
+	tombs := []*cachedProfile{
+		{address: "http://127.0.0.1:8001", profile: profile("a.go", 2, 1, 3), collected: now},
+		// the previous build of a.go
+		{address: "http://127.0.0.1:8002", profile: profile("a.go", 5, 1, 5, 9), collected: now.Add(-time.Minute)},
+		{address: "http://127.0.0.1:8003", profile: profile("b.go", 1, 1), collected: now.Add(-time.Hour)},
+	}
+
+	merged, skipped, err := mergeWithTombstones([][]*cover.Profile{profile("a.go", 1, 1, 3)}, tombs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://127.0.0.1:8002"}, skipped)
+	assert.Equal(t, append(profile("a.go", 3, 1, 3), profile("b.go", 1, 1)...), merged)
+
+	// the tombstones are checked against each other without profiles collected
+	merged, skipped, err = mergeWithTombstones(nil, tombs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://127.0.0.1:8002"}, skipped)
+	assert.Equal(t, append(profile("a.go", 2, 1, 3), profile("b.go", 1, 1)...), merged)
+
+	// the profiles collected must still be coherent
+	_, _, err = mergeWithTombstones([][]*cover.Profile{profile("a.go", 1, 1, 3), profile("a.go", 1, 1)}, nil)
+	assert.Error(t, err)
+}
+
+func TestProfileWithTombstones(t *testing.T) {
+	profileMockSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 1"))
+	}))
+	defer profileMockSvr.Close()
+
+	s := &server{
+		Store: NewMemoryStore(),
+	}
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+	client := NewWorker(ts.URL)
+
+	assert.NoError(t, s.Store.Add(ServiceUnderTest{Name: "foo", Address: profileMockSvr.URL}))
+
+	// the service deregisters, its last profile is retained
+	_, err := client.Remove(ProfileParam{Address: []string{profileMockSvr.URL}})
+	assert.NoError(t, err)
+	assert.Empty(t, s.Store.GetAll())
+
+	res, err := client.Profile(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 1")
+
+	// the service only having tombstones can still be selected
+	res, err = client.Profile(ProfileParam{Service: []string{"foo"}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 1")
+
+	_, err = client.Profile(ProfileParam{SkipTombstones: true})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no profiles")
+
+	// init drops the tombstones
+	_, err = client.InitSystem()
+	assert.NoError(t, err)
+	_, err = client.Profile(ProfileParam{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no profiles")
+}
+
+func TestDropTombstones(t *testing.T) {
+	profileMockSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("mode: count\nmockService/main.go:30.13,48.33 13 1"))
+	}))
+	defer profileMockSvr.Close()
+
+	s := &server{
+		Store: NewMemoryStore(),
+	}
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+	client := NewWorker(ts.URL)
+
+	// the process registering again still counts what its tombstone does
+	_, err := client.RegisterService(ServiceUnderTest{Name: "foo", Address: profileMockSvr.URL})
+	assert.NoError(t, err)
+	_, err = client.Remove(ProfileParam{Address: []string{profileMockSvr.URL}})
+	assert.NoError(t, err)
+	assert.Len(t, s.profiles.buried(nil), 1)
+	_, err = client.RegisterService(ServiceUnderTest{Name: "foo", Address: profileMockSvr.URL})
+	assert.NoError(t, err)
+	assert.Empty(t, s.profiles.buried(nil))
+	_, err = client.Remove(ProfileParam{Address: []string{profileMockSvr.URL}})
+	assert.NoError(t, err)
+	res, err := client.Profile(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 1")
+
+	// the tombstones are cleared with the counters
+	res, err = client.Clear(ProfileParam{Service: []string{"foo"}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "Tombstone of service "+profileMockSvr.URL+" cleared.")
+	assert.Empty(t, s.profiles.buried(nil))
+}
@@ -0,0 +1,408 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// tunnelPollTimeout is how long the center holds a poll of the tunnel before
+	// answering with no content, the service polls again right after
+	tunnelPollTimeout = 20 * time.Second
+	// tunnelRoundTripTimeout bounds a request routed over the tunnel
+	tunnelRoundTripTimeout = 30 * time.Second
+	// tunnelPeerTTL is how long a tunnel connected to a peer center is considered open
+	// after the peer last forwarded a poll of it
+	tunnelPeerTTL = 2 * tunnelPollTimeout
+)
+
+// TunnelRequest is a request routed to a service over its tunnel
+type TunnelRequest struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Body   []byte `json:"body,omitempty"`
+}
+
+// TunnelResponse is the response sent back by the service for a TunnelRequest
+type TunnelResponse struct {
+	ID         string `json:"id"`
+	StatusCode int    `json:"statusCode"`
+	Body       []byte `json:"body,omitempty"`
+}
+
+type tunnel struct {
+	requests chan *TunnelRequest
+	polling  int       // polls being held
+	lastPoll time.Time // last time a poll started or ended
+}
+
+// tunnelHub holds the tunnels opened by the services which only allow outbound connections.
+// A service opens its tunnel by long polling the center for requests and replying the results.
+// The zero value is ready to use.
+type tunnelHub struct {
+	mu      sync.Mutex
+	tunnels map[string]*tunnel
+	pending map[string]*pendingRequest
+	// the tunnels connected to the peer centers, the ids of the peers and the last polls by address
+	peers map[string]peerTunnel
+}
+
+type peerTunnel struct {
+	id       string
+	lastPoll time.Time
+}
+
+// pendingRequest waits for the response of the service at addr
+type pendingRequest struct {
+	addr string
+	ch   chan *TunnelResponse
+}
+
+// newTunnelID returns a random id, so that a service can not guess the ids of the requests routed to the others
+func newTunnelID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (h *tunnelHub) get(addr string) *tunnel {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tunnels == nil {
+		h.tunnels = make(map[string]*tunnel)
+	}
+	t, ok := h.tunnels[addr]
+	if !ok {
+		t = &tunnel{requests: make(chan *TunnelRequest, 16)}
+		h.tunnels[addr] = t
+	}
+	return t
+}
+
+// connected reports whether the service at the address is polling its tunnel
+func (h *tunnelHub) connected(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tunnels[addr]
+	if !ok {
+		return false
+	}
+	return t.polling > 0 || time.Since(t.lastPoll) < tunnelPollTimeout
+}
+
+// connectedToPeer records that the service at the address is polling its tunnel on the peer with the id
+func (h *tunnelHub) connectedToPeer(addr, id string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.peers == nil {
+		h.peers = make(map[string]peerTunnel)
+	}
+	h.peers[addr] = peerTunnel{id: id, lastPoll: now}
+}
+
+// peer returns the id of the peer the service at the address is polling its tunnel on,
+// unless the service polls this center
+func (h *tunnelHub) peer(addr string) (string, bool) {
+	if h.connected(addr) {
+		return "", false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.peers[addr]
+	if !ok || time.Since(p.lastPoll) >= tunnelPeerTTL {
+		return "", false
+	}
+	return p.id, true
+}
+
+// forget drops the tunnel of the address removed or evicted
+func (h *tunnelHub) forget(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.tunnels, addr)
+	delete(h.peers, addr)
+}
+
+// poll waits for the next request routed to the address, nil is returned on timeout
+func (h *tunnelHub) poll(ctx context.Context, addr string, timeout time.Duration) *TunnelRequest {
+	t := h.get(addr)
+	h.mu.Lock()
+	t.polling++
+	t.lastPoll = time.Now()
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		t.polling--
+		t.lastPoll = time.Now()
+		h.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case req := <-t.requests:
+		return req
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// reply delivers the response sent by the service at the address to the request waiting for it
+func (h *tunnelHub) reply(addr string, resp *TunnelResponse) error {
+	h.mu.Lock()
+	p, ok := h.pending[resp.ID]
+	h.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no request waiting for response %s", resp.ID)
+	}
+	if p.addr != addr {
+		return fmt.Errorf("response %s is not for the service at %s", resp.ID, addr)
+	}
+	select {
+	case p.ch <- resp:
+	default: // replied already
+	}
+	return nil
+}
+
+// roundTrip routes the request to the service at the address and waits for the response
+func (h *tunnelHub) roundTrip(addr, method, path string, body []byte, timeout time.Duration) (*TunnelResponse, error) {
+	id, err := newTunnelID()
+	if err != nil {
+		return nil, err
+	}
+	t := h.get(addr)
+	ch := make(chan *TunnelResponse, 1)
+	h.mu.Lock()
+	if h.pending == nil {
+		h.pending = make(map[string]*pendingRequest)
+	}
+	h.pending[id] = &pendingRequest{addr: addr, ch: ch}
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, id)
+		h.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case t.requests <- &TunnelRequest{ID: id, Method: method, Path: path, Body: body}:
+	case <-timer.C:
+		return nil, fmt.Errorf("tunnel of %s is busy", addr)
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("request over the tunnel of %s timeout", addr)
+	}
+}
+
+// tunnelClient contacts with the service over its tunnel
+type tunnelClient struct {
+	addr string
+	hub  *tunnelHub
+	// timeout of a request, tunnelRoundTripTimeout if zero
+	timeout time.Duration
+}
+
+func (c *tunnelClient) do(method, path string) ([]byte, error) {
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = tunnelRoundTripTimeout
+	}
+	resp, err := c.hub.roundTrip(c.addr, method, path, nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.Body, fmt.Errorf("%s", resp.Body)
+	}
+	return resp.Body, nil
+}
+
+func (c *tunnelClient) Profile(param ProfileParam) ([]byte, error) {
+	return c.profile(agentQuery(param))
+}
+
+func (c *tunnelClient) profile(query string) ([]byte, error) {
+	return c.do("GET", CoverProfileAPI+query)
+}
+
+func (c *tunnelClient) Clear(param ProfileParam) ([]byte, error) {
+	return c.do("POST", CoverProfileClearAPI)
+}
+
+func (c *tunnelClient) Pause(param ProfileParam) ([]byte, error) {
+	return c.do("POST", CoverPauseAPI)
+}
+
+func (c *tunnelClient) Resume(param ProfileParam) ([]byte, error) {
+	return c.do("POST", CoverResumeAPI)
+}
+
+func (c *tunnelClient) Remove(param ProfileParam) ([]byte, error) {
+	return nil, fmt.Errorf("remove is not supported over tunnel")
+}
+
+func (c *tunnelClient) InitSystem() ([]byte, error) {
+	return nil, fmt.Errorf("init is not supported over tunnel")
+}
+
+func (c *tunnelClient) ListServices(param ProfileParam) ([]byte, error) {
+	return nil, fmt.Errorf("list is not supported over tunnel")
+}
+
+func (c *tunnelClient) ListServiceStatus(param ProfileParam) ([]byte, error) {
+	return nil, fmt.Errorf("list is not supported over tunnel")
+}
+
+func (c *tunnelClient) RegisterService(svr ServiceUnderTest) ([]byte, error) {
+	return nil, fmt.Errorf("register is not supported over tunnel")
+}
+
+func (c *tunnelClient) HTML(param ProfileParam) ([]byte, error) {
+	return nil, fmt.Errorf("html is not supported over tunnel")
+}
+
+func (c *tunnelClient) UploadSource(archive io.Reader) ([]byte, error) {
+	return nil, fmt.Errorf("upload is not supported over tunnel")
+}
+
+func (c *tunnelClient) StartSession(name string) ([]byte, error) {
+	return nil, fmt.Errorf("session is not supported over tunnel")
+}
+
+func (c *tunnelClient) StopSession() ([]byte, error) {
+	return nil, fmt.Errorf("session is not supported over tunnel")
+}
+
+func (c *tunnelClient) ListSessions() ([]byte, error) {
+	return nil, fmt.Errorf("session is not supported over tunnel")
+}
+
+func (c *tunnelClient) SessionProfile(name string, param ProfileParam) ([]byte, error) {
+	return nil, fmt.Errorf("session is not supported over tunnel")
+}
+
+// peerTunnelClient contacts with the service over its tunnel connected to a peer center,
+// by calling the APIs of the peer for the address
+type peerTunnelClient struct {
+	Action
+	addr string
+}
+
+func (c *peerTunnelClient) Profile(param ProfileParam) ([]byte, error) {
+	return c.Action.Profile(ProfileParam{Address: []string{c.addr}, Federated: true, SkipTombstones: true,
+		CoverFilePatterns: param.CoverFilePatterns, SkipFilePatterns: param.SkipFilePatterns, Packages: param.Packages})
+}
+
+func (c *peerTunnelClient) Clear(param ProfileParam) ([]byte, error) {
+	return c.Action.Clear(ProfileParam{Address: []string{c.addr}})
+}
+
+func (c *peerTunnelClient) Pause(param ProfileParam) ([]byte, error) {
+	return c.Action.Pause(ProfileParam{Address: []string{c.addr}})
+}
+
+func (c *peerTunnelClient) Resume(param ProfileParam) ([]byte, error) {
+	return c.Action.Resume(ProfileParam{Address: []string{c.addr}})
+}
+
+// worker returns the Action to contact with the service at the address,
+// over its tunnel if it has one connected to this center or a peer
+func (s *server) worker(addr string) Action {
+	if s.tunnels.connected(addr) {
+		return &tunnelClient{addr: addr, hub: &s.tunnels}
+	}
+	if peer, token, ok := s.tunnelPeer(addr); ok {
+		return &peerTunnelClient{Action: NewWorker(peer, WithToken(token), withTransport(s.transport())), addr: addr}
+	}
+	return NewWorker(addr, WithToken(s.agentTokens.key(addr)), withTransport(s.transport()))
+}
+
+// pollTunnel is long polled by a service to receive the requests routed to it.
+// GET /v1/cover/tunnel?name=xxx&address=xxx
+func (s *server) pollTunnel(c *gin.Context) {
+	service, err := s.bindService(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.ensureRegistered(service); err != nil {
+		c.JSON(registerStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	s.agents.heartbeat(service.Address, time.Now())
+	s.persistHealth(service.Address)
+	s.forwardTunnelToPeers(c, service)
+
+	req := s.tunnels.poll(c.Request.Context(), service.Address, tunnelPollTimeout)
+	if req == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, req)
+}
+
+// replyTunnel receives the response of a request routed over a tunnel,
+// which is only accepted from the service the request was routed to.
+// POST /v1/cover/tunnel/reply?name=xxx&address=xxx
+func (s *server) replyTunnel(c *gin.Context) {
+	var service ServiceUnderTest
+	if err := c.ShouldBindQuery(&service); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	service, err := s.resolveService(c, service)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// only the process polling the tunnel knows the key of the address
+	if s.agentTokens.key(service.Address) != "" && !s.agentTokens.hasKey(service.Address, service.Key) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "the key of the service is required"})
+		return
+	}
+	var resp TunnelResponse
+	if err := c.ShouldBindJSON(&resp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.tunnels.reply(service.Address, &resp); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+}
@@ -0,0 +1,202 @@
+/*
+ Copyright 2020 Qiniu Cloud (qiniu.com)
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cover
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelHub(t *testing.T) {
+	var hub tunnelHub
+	addr := "http://127.0.0.1:64448"
+	assert.False(t, hub.connected(addr))
+
+	// poll timeout
+	assert.Nil(t, hub.poll(context.Background(), addr, 10*time.Millisecond))
+	assert.True(t, hub.connected(addr))
+
+	// reply without request
+	assert.Error(t, hub.reply(addr, &TunnelResponse{ID: "1"}))
+
+	// no one polls the tunnel
+	_, err := hub.roundTrip("http://127.0.0.1:64449", "GET", CoverProfileAPI, nil, 10*time.Millisecond)
+	assert.Error(t, err)
+
+	go func() {
+		req := hub.poll(context.Background(), addr, time.Second)
+		if req == nil {
+			return
+		}
+		// only the service the request is routed to replies it
+		assert.Error(t, hub.reply("http://127.0.0.1:64449", &TunnelResponse{ID: req.ID, StatusCode: http.StatusOK}))
+		_ = hub.reply(addr, &TunnelResponse{ID: req.ID, StatusCode: http.StatusOK, Body: []byte(req.Method + " " + req.Path)})
+	}()
+	resp, err := hub.roundTrip(addr, "GET", CoverProfileAPI, nil, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "GET /v1/cover/profile", string(resp.Body))
+
+	hub.forget(addr)
+	assert.False(t, hub.connected(addr))
+	assert.NotContains(t, hub.tunnels, addr)
+}
+
+func TestProfileOverTunnel(t *testing.T) {
+	s := &server{
+		Store: NewMemoryStore(),
+	}
+	ts := httptest.NewServer(s.Route(os.Stdout))
+	defer ts.Close()
+
+	// a service which can not be reached by the center opens its tunnel
+	addr := "http://127.0.0.1:64450"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveTunnel(ctx, ts.URL, addr)
+
+	client := NewWorker(ts.URL)
+	assert.Eventually(t, func() bool {
+		return s.tunnels.connected(addr)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{addr}, s.Store.Get("foo"))
+
+	res, err := client.Profile(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 1")
+
+	res, err = client.Clear(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "clear call successfully")
+
+	// another service can not reply the requests routed to the service,
+	cancel()
+	go func() {
+		_, _ = s.tunnels.roundTrip(addr, "POST", CoverProfileClearAPI, nil, time.Second)
+	}()
+	var id string
+	assert.Eventually(t, func() bool {
+		s.tunnels.mu.Lock()
+		defer s.tunnels.mu.Unlock()
+		for id = range s.tunnels.pending {
+			return true
+		}
+		return false
+	}, 5*time.Second, time.Millisecond)
+	// nor another process at the address, which does not know its key
+	s.agentTokens.remember(addr, "", "k1")
+	reply, _ := json.Marshal(TunnelResponse{ID: id, StatusCode: http.StatusOK})
+	for _, r := range []struct {
+		addr   string
+		key    string
+		status int
+	}{{"http://127.0.0.1:64452", "", http.StatusNotFound}, {addr, "k2", http.StatusForbidden}, {addr, "k1", http.StatusOK}} {
+		req, err := http.NewRequest("POST", ts.URL+CoverTunnelReplyAPI+"?name=foo&address="+r.addr, bytes.NewReader(reply))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(agentKeyHeader, r.key)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, r.status, resp.StatusCode, r.addr)
+	}
+
+	// the tunnel is dropped with the service
+	s.AgentTimeout = 100 * time.Millisecond
+	_, err = client.Remove(ProfileParam{Address: []string{addr}})
+	assert.NoError(t, err)
+	assert.False(t, s.tunnels.connected(addr))
+}
+
+func TestProfileOverPeerTunnel(t *testing.T) {
+	a := &server{Store: NewMemoryStore()}
+	b := &server{Store: NewMemoryStore()}
+	tsA := httptest.NewServer(a.Route(os.Stdout))
+	defer tsA.Close()
+	tsB := httptest.NewServer(b.Route(os.Stdout))
+	defer tsB.Close()
+	a.Peers = []string{tsB.URL}
+	b.Peers = []string{tsA.URL}
+	a.enableReplication()
+	rb := b.enableReplication()
+	rb.pull()
+
+	// the service opens its tunnel on a, b reaches it through a
+	addr := "http://127.0.0.1:64451"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveTunnel(ctx, tsA.URL, addr)
+
+	assert.Eventually(t, func() bool {
+		_, _, ok := b.tunnelPeer(addr)
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{addr}, b.Store.Get("foo"))
+
+	// the tombstone of a former process on the address, known by both, is only merged once
+	for _, s := range []*server{a, b} {
+		s.entomb(Tombstone{Name: "foo", Address: addr, Profile: "mode: count\nmockService/bar.go:1.1,2.2 1 1\n"})
+	}
+	client := NewWorker(tsB.URL)
+	res, err := client.Profile(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "mockService/main.go:30.13,48.33 13 1")
+	assert.Contains(t, string(res), "mockService/bar.go:1.1,2.2 1 1")
+
+	res, err = client.Clear(ProfileParam{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(res), "clear call successfully")
+}
+
+// serveTunnel polls the tunnel of the service at addr on the center, until canceled
+func serveTunnel(ctx context.Context, center, addr string) {
+	for {
+		req, err := http.NewRequest("GET", center+CoverTunnelAPI+"?name=foo&address="+addr, nil)
+		if err != nil {
+			return
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		var tr TunnelRequest
+		_ = json.NewDecoder(resp.Body).Decode(&tr)
+		resp.Body.Close()
+
+		body := []byte("clear call successfully")
+		if strings.HasPrefix(tr.Path, CoverProfileAPI) {
+			body = []byte("mode: count\nmockService/main.go:30.13,48.33 13 1\n")
+		}
+		reply, _ := json.Marshal(TunnelResponse{ID: tr.ID, StatusCode: http.StatusOK, Body: body})
+		resp, err = http.Post(center+CoverTunnelReplyAPI+"?name=foo&address="+addr, "application/json", bytes.NewReader(reply))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+}
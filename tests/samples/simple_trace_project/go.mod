@@ -0,0 +1,3 @@
+module example.com/simple-trace-project
+
+go 1.14
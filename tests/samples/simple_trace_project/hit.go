@@ -0,0 +1,5 @@
+package main
+
+func hit() string {
+	return "hit"
+}
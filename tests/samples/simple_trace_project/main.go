@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+func main() {
+	http.HandleFunc("/hit", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, hit())
+	})
+	log.Fatal(http.ListenAndServe(os.Getenv("SAMPLE_ADDR"), nil))
+}
@@ -18,7 +18,7 @@ export class GocServer {
         border:  '2px solid white',
         color:  'white'
     });;
-    private lastProfile = '';
+    private lastBlocks = '';
     private lastFileNeedsRender = '';
 
     construct() { }
@@ -35,14 +35,13 @@ export class GocServer {
 
             this.getConfigurations();
             this.setDebugLogger();
-            let profile = await this.getLatestProfile();
-            this.renderFile(packages, profile);
+            await this.renderFile(packages);
         }
     }
 
     stopQueryLoop() {
         this.timer = false;
-        this.lastProfile = '';
+        this.lastBlocks = '';
         this.lastFileNeedsRender = '';
 
         this.clearHightlight()
@@ -69,19 +68,65 @@ export class GocServer {
         this._logger.info('goc server url: ', this._serverUrl);
     }
 
-    async getLatestProfile(): Promise<string> {
-        let profileApi = `${this._serverUrl}/v1/cover/profile?force=true`;
+    // getFileBlocks gets the blocks of the file from the goc server, empty if the file is not covered
+    async getFileBlocks(importPath: string): Promise<any[]> {
+        let fileApi = `${this._serverUrl}/v1/cover/file?force=true&path=${encodeURIComponent(importPath)}`;
+
+        try {
+            let res = await axios.get(fileApi, );
+            this._logger.debug(JSON.stringify(res.data));
+            return res.data.blocks || [];
+        } catch(err) {
+            if (err.response && err.response.status == 404) {
+                // the goc servers older than the file api answer 404 without an error
+                if (!err.response.data || !err.response.data.error) {
+                    return this.getProfileBlocks(importPath);
+                }
+                this._logger.debug(importPath, ' not covered');
+            } else {
+                this._logger.error(err.message);
+            }
+        }
+
+        return [];
+    }
+
+    // getProfileBlocks gets the blocks of the file from the profile filtered by the goc server
+    async getProfileBlocks(importPath: string): Promise<any[]> {
+        let pattern = '^' + importPath.replace(/[.*+?^${}()|[\]\\]/g, '\\$&') + '$';
+        let profileApi = `${this._serverUrl}/v1/cover/profile?force=true&coverfile=${encodeURIComponent(pattern)}`;
 
         try {
             let res = await axios.get(profileApi, );
             let body: string = res.data.toString();
             this._logger.debug(body);
-            return body;
+            return this.parseProfile(body, importPath);
         } catch(err) {
             this._logger.error(err.message);
-        } 
+        }
+
+        return [];
+    }
 
-        return "";
+    // parseProfile returns the blocks of the file in the profile, in the format of the file api
+    parseProfile(profile: string, importPath: string): any[] {
+        let blocks: any[] = [];
+        let rxp = /^(.+):(\d+)\.(\d+),(\d+)\.(\d+) (\d+) (\d+)$/;
+        for (let line of profile.split('\n')) {
+            let matches = rxp.exec(line.trim());
+            if (!matches || matches[1] != importPath) {
+                continue;
+            }
+            blocks.push({
+                startLine: Number(matches[2]),
+                startCol: Number(matches[3]),
+                endLine: Number(matches[4]),
+                endCol: Number(matches[5]),
+                numStmt: Number(matches[6]),
+                count: Number(matches[7]),
+            });
+        }
+        return blocks;
     }
 
     checkGoEnv() : Boolean {
@@ -116,77 +161,60 @@ export class GocServer {
         return packages;
     }
 
-    renderFile(packages: Array<any>, profile: string) {
+    async renderFile(packages: Array<any>) {
         let activeTextEditor = vscode.window.activeTextEditor;
         let fileNeedsRender = activeTextEditor?.document.fileName || '---';
 
         this._logger.debug('current active source code file: ', fileNeedsRender);
+        this._logger.debug('go list packages length: ', packages.length);
+
+        let importPath = this.getImportPath(packages, fileNeedsRender);
+        if (importPath == '') {
+            return;
+        }
+        let blocks = await this.getFileBlocks(importPath);
+
         // check if needs to rerender
-        if (profile == this.lastProfile && fileNeedsRender == this.lastFileNeedsRender) {
+        let lastBlocks = JSON.stringify(blocks);
+        if (lastBlocks == this.lastBlocks && fileNeedsRender == this.lastFileNeedsRender) {
             return;
         }
-        this.lastProfile = profile;
+        this.lastBlocks = lastBlocks;
         this.lastFileNeedsRender = fileNeedsRender;
 
-        this._logger.debug('go list packages length: ', packages.length);
+        this.triggerUpdateDecoration(this.getRanges(blocks));
+    }
 
+    // getImportPath returns the import path of the source code file, empty if not in the packages
+    getImportPath(packages: Array<any>, fileNeedsRender: string): string {
         for (let i=0; i<packages.length; i++) {
             let p = packages[i];
             let baseDir: string = p['Dir'];
             for (let gofile of p['GoFiles']) {
                 let filepath = path.join(baseDir, gofile);
-                // this._logger.debug('compare two path: ', filepath, fileNeedsRender);
                 if (filepath == fileNeedsRender) {
-                    let importPath: string = path.join(p['ImportPath'], gofile);
-                    let ranges = this.parseProfile(profile, importPath);
-                    this.triggerUpdateDecoration(ranges);
-                    return;
+                    // on windows the path is different from posix
+                    // needs transform
+                    return upath.toUnix(path.join(p['ImportPath'], gofile));
                 }
             }
         }
+        return '';
     }
 
-    parseProfile(profile: string, importPathNeedsRender: string): vscode.Range[] {
-        let lines = profile.split('\n');
-        this._logger.debug('profile lines: ', lines.length);
-        if (lines.length <= 1) {
-            this._logger.error("empty coverage profile from server");
-            return [];
-        }
-
-
+    getRanges(blocks: any[]): vscode.Range[] {
         let ranges: vscode.Range[] = [];
-        for (let i=0; i<lines.length; i++) {
-            let line = lines[i];
-            let importPath: string = line.split(':')[0];
-            let blockInfo: string = line.split(':')[1];
-            
-            // on windows the path is different from posix
-            // needs transform
-            importPathNeedsRender = upath.toUnix(importPathNeedsRender)
-            if (importPath != importPathNeedsRender) {
-                continue;
-            }
-
-            let rxp = /(\d+)\.(\d+),(\d+)\.(\d+)\s(\d+)\s(\d+)/g
-            let matches = rxp.exec(blockInfo)!;
-            let startLine = matches[1];
-            let startCol = matches[2];
-            let endLine = matches[3];
-            let endCol = matches[4];
-            let stmts = matches[5];
-            let count = matches[6];
-
+        for (let block of blocks) {
             // no need to render code block not covered
-            if (count == '0') {
+            if (block.count == 0) {
                 continue;
             }
 
             let range = new vscode.Range(
-                new vscode.Position(Number(startLine)-1, Number(startCol)-1),
-                new vscode.Position(Number(endLine)-1, Number(endCol)-1)
+                new vscode.Position(block.startLine-1, block.startCol-1),
+                new vscode.Position(block.endLine-1, block.endCol-1)
             );
-            
+
             ranges.push(range);
         }
 